@@ -0,0 +1,142 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checksumHeader holds the SHA-256 of a backup's body.
+const checksumHeader = "X-Checksum-Sha256"
+
+// adminToken is the bearer token needed for the /admin/ endpoints, which are disabled if it is empty. It comes from
+// ADMIN_TOKEN.
+var adminToken string
+
+// bearerToken returns the token from the request's 'Authorization: Bearer ...' header, or "".
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// adminOnly lets the request through to `fn` only if it has the admin token.
+func adminOnly(fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFoundHandler().ServeHTTP(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="publish.li admin"`)
+			http.Error(w, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// adminBackup sends a consistent snapshot of the store while it carries on serving. Add '?gzip=1' to compress it. The
+// snapshot is written to a temporary file first, so that its SHA-256 can go in the X-Checksum-Sha256 header and a
+// failure can still be reported with a 500.
+func adminBackup(store PageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		snapshotter, ok := store.(Snapshotter)
+		if !ok {
+			http.Error(w, "501 this store can't be backed up online", http.StatusNotImplemented)
+			return
+		}
+
+		compress := r.FormValue("gzip") == "1"
+		filename := "publish-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+		if compress {
+			filename += ".gz"
+		}
+
+		tmp, errTemp := ioutil.TempFile("", "publish-backup-")
+		if errTemp != nil {
+			log.Printf("Error: %v\n", errTemp)
+			http.Error(w, "Internal Error. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		// everything written goes through the hash, and the gzip writer (if any) sits in front of both
+		hash := sha256.New()
+		var out io.Writer = io.MultiWriter(tmp, hash)
+		var gz *gzip.Writer
+		if compress {
+			gz = gzip.NewWriter(out)
+			out = gz
+		}
+
+		size, errSnapshot := snapshotter.WriteSnapshot(out)
+		if errSnapshot == nil && gz != nil {
+			errSnapshot = gz.Close()
+		}
+		var length int64
+		if errSnapshot == nil {
+			length, errSnapshot = tmp.Seek(0, io.SeekCurrent)
+		}
+		if errSnapshot == nil {
+			_, errSnapshot = tmp.Seek(0, io.SeekStart)
+		}
+		if errSnapshot != nil {
+			log.Printf("Error: backup failed after %d bytes: %v\n", size, errSnapshot)
+			http.Error(w, "Internal Error. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(checksumHeader, hex.EncodeToString(hash.Sum(nil)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		if _, err := io.Copy(w, tmp); err != nil {
+			log.Printf("Error: sending the backup: %v\n", err)
+			return
+		}
+
+		log.Printf("Backup : %d bytes\n", size)
+	}
+}
@@ -0,0 +1,175 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useAdminToken sets ADMIN_TOKEN until the test is done.
+func useAdminToken(t *testing.T, token string) {
+	orig := adminToken
+	t.Cleanup(func() { adminToken = orig })
+
+	adminToken = token
+}
+
+func TestBackup(t *testing.T) {
+	useAdminToken(t, "admin")
+	dir := t.TempDir()
+	store, err := NewBoltStore(filepath.Join(dir, "publish.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(adminOnly(adminBackup(store))))
+	defer server.Close()
+
+	// the snapshot is a BoltDB file, which arrives whole or not at all
+	filename := filepath.Join(dir, "backup.db")
+	if err := cmdBackup([]string{"-url", server.URL, filename}); err != nil {
+		t.Fatal(err)
+	}
+	expectBackupPages(t, filename, "first-aaaaaaaa")
+
+	// and the same again, compressed
+	gzFilename := filepath.Join(dir, "backup.db.gz")
+	if err := cmdBackup([]string{"-gzip", "-url", server.URL, gzFilename}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(gzFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unzipped := filepath.Join(dir, "unzipped.db")
+	out, err := os.Create(unzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, gz); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	expectBackupPages(t, unzipped, "first-aaaaaaaa")
+
+	// without the token there's nothing to see
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func expectBackupPages(t *testing.T, filename string, names ...string) {
+	store, err := NewBoltStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	found := []string{}
+	err = store.IteratePages(func(page *Page) error {
+		found = append(found, page.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(found, ",") != strings.Join(names, ",") {
+		t.Fatalf("expected pages %v in the backup, got %v", names, found)
+	}
+}
+
+func TestBackupWithoutChecksum(t *testing.T) {
+	useAdminToken(t, "admin")
+
+	// as if the server were too old to send one
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("half a snapshot"))
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "backup.db")
+	err := cmdBackup([]string{"-url", server.URL, filename})
+	if err == nil || !strings.Contains(err.Error(), "did not send a checksum") {
+		t.Fatalf("expected the backup to fail, got %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatal("a failed backup was kept")
+	}
+	if matches, _ := filepath.Glob(filename + "*"); len(matches) != 0 {
+		t.Fatalf("a failed backup left files behind: %v", matches)
+	}
+}
+
+// failingSnapshot writes part of a snapshot and then fails.
+type failingSnapshot struct {
+	PageStore
+}
+
+func (failingSnapshot) WriteSnapshot(w io.Writer) (int64, error) {
+	n, _ := w.Write([]byte("half a snapshot"))
+	return int64(n), errors.New("disk on fire")
+}
+
+func TestBackupFailureIsAnError(t *testing.T) {
+	w := httptest.NewRecorder()
+	adminBackup(failingSnapshot{NewMemoryStore()})(w, httptest.NewRequest("GET", "/admin/backup", nil))
+	if w.Code != http.StatusInternalServerError || w.Header().Get(checksumHeader) != "" {
+		t.Fatalf("expected a 500 without a checksum, got %d %v", w.Code, w.Header())
+	}
+	if strings.Contains(w.Body.String(), "half a snapshot") {
+		t.Fatal("part of the snapshot was sent")
+	}
+}
+
+func TestBackupNeedsSnapshotter(t *testing.T) {
+	w := httptest.NewRecorder()
+	adminBackup(NewMemoryStore())(w, httptest.NewRequest("GET", "/admin/backup", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", w.Code)
+	}
+
+	body, _ := ioutil.ReadAll(w.Body)
+	if !strings.Contains(string(body), "can't be backed up") {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
@@ -0,0 +1,362 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the machine readable codes in an /api/v1 error
+const (
+	errCodeInvalidJson      = "invalid_json"
+	errCodeInvalidPage      = "invalid_page"
+	errCodeTooLarge         = "request_too_large"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeGone             = "gone"
+	errCodeVersionConflict  = "version_conflict"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeRateLimited      = "rate_limited"
+	errCodeInternal         = "internal_error"
+)
+
+const apiV1PagesPath = "/api/v1/pages"
+const apiV1OpenApiPath = "/api/v1/openapi.json"
+
+// apiPageRequest is the body of a request to create, update or delete a page. Only the secret is needed to delete one,
+// but it should be sent as the bearer token rather than in the body.
+type apiPageRequest struct {
+	Secret      string    `json:"secret"` // deprecated
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	Website     string    `json:"website"`
+	Twitter     string    `json:"twitter"`
+	Facebook    string    `json:"facebook"`
+	GitHub      string    `json:"github"`
+	Instagram   string    `json:"instagram"`
+	Content     string    `json:"content"`
+	Unpublished bool      `json:"unpublished"`
+	Expires     time.Time `json:"expires"`
+	Version     int64     `json:"version"` // the version being updated
+}
+
+func (req *apiPageRequest) page() Page {
+	return Page{
+		Title:       req.Title,
+		Author:      req.Author,
+		Website:     req.Website,
+		Twitter:     req.Twitter,
+		Facebook:    req.Facebook,
+		GitHub:      req.GitHub,
+		Instagram:   req.Instagram,
+		Content:     req.Content,
+		Unpublished: req.Unpublished,
+		Expires:     req.Expires,
+		Version:     req.Version,
+	}
+}
+
+// apiPage is a page as /api/v1 returns it, which never includes the hash of its secret. The secret itself is only
+// there when the page has just been created.
+type apiPage struct {
+	Name        string     `json:"name"`
+	Secret      string     `json:"secret,omitempty"`
+	Title       string     `json:"title"`
+	Author      string     `json:"author"`
+	Website     string     `json:"website"`
+	Twitter     string     `json:"twitter"`
+	Facebook    string     `json:"facebook"`
+	GitHub      string     `json:"github"`
+	Instagram   string     `json:"instagram"`
+	Content     string     `json:"content"`
+	Html        string     `json:"html"`
+	Unpublished bool       `json:"unpublished"`
+	Quarantined bool       `json:"quarantined,omitempty"` // held back until an operator has checked it isn't spam
+	Version     int64      `json:"version"`
+	Inserted    time.Time  `json:"inserted"`
+	Updated     time.Time  `json:"updated"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Url         string     `json:"url"`
+}
+
+func newApiPage(page *Page) *apiPage {
+	out := &apiPage{
+		Name:        page.Name,
+		Title:       page.Title,
+		Author:      page.Author,
+		Website:     page.Website,
+		Twitter:     page.Twitter,
+		Facebook:    page.Facebook,
+		GitHub:      page.GitHub,
+		Instagram:   page.Instagram,
+		Content:     page.Content,
+		Html:        string(page.Html),
+		Unpublished: page.Unpublished,
+		Quarantined: page.Quarantined,
+		Version:     page.Version,
+		Inserted:    page.Inserted,
+		Updated:     page.Updated,
+		Url:         baseUrl + "/" + page.Name,
+	}
+	if !page.Expires.IsZero() {
+		expires := page.Expires
+		out.Expires = &expires
+	}
+	return out
+}
+
+// apiError is the body of every /api/v1 response which isn't a success, inside an "error" object. A version conflict
+// also has the page as it is now, so that the client can merge its changes into it, and an invalid page has what is
+// wrong with each field.
+type apiError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Page    *apiPage    `json:"page,omitempty"`
+	Fields  FieldErrors `json:"fields,omitempty"`
+}
+
+func sendApiJson(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func sendApiError(w http.ResponseWriter, status int, code string, msg string) {
+	sendApiJson(w, status, map[string]apiError{"error": {Code: code, Message: msg}})
+}
+
+func sendApiFieldErrors(w http.ResponseWriter, errs FieldErrors) {
+	msg := apiError{Code: errCodeInvalidPage, Message: errs.Error(), Fields: errs}
+	sendApiJson(w, http.StatusBadRequest, map[string]apiError{"error": msg})
+}
+
+func sendApiInternalError(w http.ResponseWriter, err error) {
+	log.Printf("Error: %v\n", err)
+	sendApiError(w, http.StatusInternalServerError, errCodeInternal, "Internal Error. Please try again later.")
+}
+
+func sendApiMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	sendApiError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Use one of "+allow+".")
+}
+
+// allowApiRequest checks the request against `limiter`, sending a 429 and returning false if the client is over it.
+func allowApiRequest(limiter *rateLimiter, w http.ResponseWriter, r *http.Request) bool {
+	if limiter.allowRequest(w, r) {
+		return true
+	}
+	sendApiError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests. Try again after "+w.Header().Get("Retry-After")+" seconds.")
+	return false
+}
+
+// decodeApiRequest reads the request body into `req`, sending a 400 and returning false if it can't.
+func decodeApiRequest(w http.ResponseWriter, r *http.Request, req *apiPageRequest) bool {
+	err := decodePageRequest(r, req)
+	if err == ErrRequestTooLarge {
+		sendApiError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Sprintf("The request can be at most %d bytes.", maxRequestSize))
+		return false
+	}
+	if err != nil {
+		sendApiError(w, http.StatusBadRequest, errCodeInvalidJson, "Invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// apiV1OpenApi serves the OpenAPI document which describes /api/v1, and the original /api.
+func apiV1OpenApi(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "static/openapi.json")
+}
+
+// apiV1Handler serves POST /api/v1/pages to create a page, and GET, PUT and DELETE /api/v1/pages/{name} to fetch,
+// update and delete one.
+func apiV1Handler(store PageStore, limits rateLimits) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+
+		if path == apiV1PagesPath {
+			if r.Method != "POST" {
+				sendApiMethodNotAllowed(w, "POST")
+				return
+			}
+			if allowApiRequest(limits.create, w, r) {
+				apiV1Create(store, w, r)
+			}
+			return
+		}
+
+		name := strings.TrimPrefix(path, apiV1PagesPath+"/")
+		if name == path || !validPageName(name) {
+			sendApiError(w, http.StatusNotFound, errCodeNotFound, "There is nothing here.")
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if allowApiRequest(limits.fetch, w, r) {
+				apiV1Get(store, w, r, name)
+			}
+		case "PUT":
+			if allowApiRequest(limits.update, w, r) {
+				apiV1Update(store, w, r, name)
+			}
+		case "DELETE":
+			if allowApiRequest(limits.update, w, r) {
+				apiV1Delete(store, w, r, name)
+			}
+		default:
+			sendApiMethodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+		}
+	}
+}
+
+// apiV1Create makes a new page. There is no honeypot in this API, since nothing here fills in the editor's form, so
+// pages created or updated through it are only checked by the other spam filters.
+func apiV1Create(store PageStore, w http.ResponseWriter, r *http.Request) {
+	req := apiPageRequest{}
+	if !decodeApiRequest(w, r, &req) {
+		return
+	}
+
+	page := req.page()
+	secret, errCreate := createPage(store, &page, "")
+	if errs, ok := errCreate.(FieldErrors); ok {
+		sendApiFieldErrors(w, errs)
+		return
+	}
+	if errCreate != nil {
+		sendApiInternalError(w, errCreate)
+		return
+	}
+
+	out := newApiPage(&page)
+	out.Secret = secret
+	w.Header().Set("Location", baseUrl+apiV1PagesPath+"/"+page.Name)
+	sendApiJson(w, http.StatusCreated, out)
+}
+
+// getApiPage fetches the named page, sending a 404 or 410 and returning nil if it isn't there.
+func getApiPage(store PageStore, w http.ResponseWriter, name string) *Page {
+	page, errGet := store.GetPage(name)
+	if errGet != nil {
+		sendApiInternalError(w, errGet)
+		return nil
+	}
+
+	if page == nil {
+		sendApiError(w, http.StatusNotFound, errCodeNotFound, "This page does not exist.")
+		return nil
+	}
+
+	if page.IsDeleted() || page.IsExpired(clock()) {
+		sendApiError(w, http.StatusGone, errCodeGone, "This page has been deleted.")
+		return nil
+	}
+
+	return page
+}
+
+func apiV1Get(store PageStore, w http.ResponseWriter, r *http.Request, name string) {
+	page := getApiPage(store, w, name)
+	if page == nil {
+		return
+	}
+
+	// an unpublished or quarantined page looks just like one which doesn't exist, except to its author
+	if (page.Unpublished || page.Quarantined) && !secretMatches(page, bearerToken(r)) {
+		sendApiError(w, http.StatusNotFound, errCodeNotFound, "This page does not exist.")
+		return
+	}
+
+	upgradeHtml(store, page)
+	sendApiJson(w, http.StatusOK, newApiPage(page))
+}
+
+func apiV1Update(store PageStore, w http.ResponseWriter, r *http.Request, name string) {
+	req := apiPageRequest{}
+	if !decodeApiRequest(w, r, &req) {
+		return
+	}
+
+	page := getApiPage(store, w, name)
+	if page == nil {
+		return
+	}
+
+	if !secretMatches(page, requestSecret(w, r, req.Secret)) {
+		sendApiError(w, http.StatusForbidden, errCodeForbidden, "The secret does not match this page.")
+		return
+	}
+
+	errEdit := editPage(store, page, req.page(), "")
+	if errEdit == ErrVersionConflict {
+		current := getApiPage(store, w, name)
+		if current == nil {
+			return
+		}
+		msg := apiError{
+			Code:    errCodeVersionConflict,
+			Message: "This page has been changed since that version.",
+			Page:    newApiPage(current),
+		}
+		sendApiJson(w, http.StatusConflict, map[string]apiError{"error": msg})
+		return
+	}
+	if errs, ok := errEdit.(FieldErrors); ok {
+		sendApiFieldErrors(w, errs)
+		return
+	}
+	if errEdit != nil {
+		sendApiInternalError(w, errEdit)
+		return
+	}
+
+	sendApiJson(w, http.StatusOK, newApiPage(page))
+}
+
+func apiV1Delete(store PageStore, w http.ResponseWriter, r *http.Request, name string) {
+	// the body is only needed by older clients which don't send the secret as the bearer token
+	req := apiPageRequest{}
+	if r.ContentLength != 0 && !decodeApiRequest(w, r, &req) {
+		return
+	}
+
+	page := getApiPage(store, w, name)
+	if page == nil {
+		return
+	}
+
+	if !secretMatches(page, requestSecret(w, r, req.Secret)) {
+		sendApiError(w, http.StatusForbidden, errCodeForbidden, "The secret does not match this page.")
+		return
+	}
+
+	if err := store.DeletePage(page.Name, clock()); err != nil {
+		sendApiInternalError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// callApiV1 makes a request to /api/v1 and decodes whatever comes back into `out`, if it isn't nil.
+func callApiV1(t *testing.T, store PageStore, method, path, body string, out interface{}) *httptest.ResponseRecorder {
+	return callApiV1WithSecret(t, store, method, path, "", body, out)
+}
+
+// callApiV1WithSecret is like callApiV1, but sends `secret` as the bearer token if it is set.
+func callApiV1WithSecret(t *testing.T, store PageStore, method, path, secret, body string, out interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if secret != "" {
+		r.Header.Set("Authorization", "Bearer "+secret)
+	}
+	apiV1Handler(store, rateLimits{})(w, r)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+type testApiError struct {
+	Error apiError `json:"error"`
+}
+
+func TestApiV1Pages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		created := apiPage{}
+		w := callApiV1(t, store, "POST", "/api/v1/pages", `{"title":"Hello","content":"World"}`, &created)
+		if w.Code != http.StatusCreated || created.Secret == "" || created.Version != 1 {
+			t.Fatalf("create: %d %s", w.Code, w.Body.String())
+		}
+		path := "/api/v1/pages/" + created.Name
+		if w.Header().Get("Location") != baseUrl+path {
+			t.Fatalf("create: unexpected Location %q", w.Header().Get("Location"))
+		}
+
+		fetched := apiPage{}
+		w = callApiV1(t, store, "GET", path, "", &fetched)
+		if w.Code != http.StatusOK || fetched.Content != "World" || fetched.Secret != "" {
+			t.Fatalf("get: %d %s", w.Code, w.Body.String())
+		}
+
+		apiErr := testApiError{}
+		w = callApiV1(t, store, "PUT", path, `{"secret":"wrong","title":"Hi","version":1}`, &apiErr)
+		if w.Code != http.StatusForbidden || apiErr.Error.Code != errCodeForbidden {
+			t.Fatalf("update with the wrong secret: %d %s", w.Code, w.Body.String())
+		}
+
+		update := `{"secret":"` + created.Secret + `","title":"Hi","content":"There","version":1}`
+		updated := apiPage{}
+		w = callApiV1(t, store, "PUT", path, update, &updated)
+		if w.Code != http.StatusOK || updated.Version != 2 || updated.Content != "There" {
+			t.Fatalf("update: %d %s", w.Code, w.Body.String())
+		}
+
+		// the same update again is now out of date
+		apiErr = testApiError{}
+		w = callApiV1(t, store, "PUT", path, update, &apiErr)
+		if w.Code != http.StatusConflict || apiErr.Error.Code != errCodeVersionConflict || apiErr.Error.Page == nil || apiErr.Error.Page.Version != 2 {
+			t.Fatalf("stale update: %d %s", w.Code, w.Body.String())
+		}
+
+		apiErr = testApiError{}
+		w = callApiV1(t, store, "PUT", path, `{"secret":"`+created.Secret+`","title":"","website":"javascript:alert(1)","version":2}`, &apiErr)
+		if w.Code != http.StatusBadRequest || apiErr.Error.Code != errCodeInvalidPage || apiErr.Error.Fields["title"] == "" || apiErr.Error.Fields["website"] == "" {
+			t.Fatalf("invalid update: %d %s", w.Code, w.Body.String())
+		}
+
+		w = callApiV1(t, store, "DELETE", path, `{"secret":"`+created.Secret+`"}`, nil)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+		}
+
+		apiErr = testApiError{}
+		w = callApiV1(t, store, "GET", path, "", &apiErr)
+		if w.Code != http.StatusGone || apiErr.Error.Code != errCodeGone {
+			t.Fatalf("get after delete: %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestApiV1BearerSecret(t *testing.T) {
+	store := NewMemoryStore()
+
+	created := apiPage{}
+	w := callApiV1(t, store, "POST", "/api/v1/pages", `{"title":"Draft","unpublished":true}`, &created)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body.String())
+	}
+	path := "/api/v1/pages/" + created.Name
+
+	// only the author can see an unpublished page
+	w = callApiV1(t, store, "GET", path, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("get without the secret: %d %s", w.Code, w.Body.String())
+	}
+	w = callApiV1WithSecret(t, store, "GET", path, "wrong", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("get with the wrong secret: %d %s", w.Code, w.Body.String())
+	}
+	fetched := apiPage{}
+	w = callApiV1WithSecret(t, store, "GET", path, created.Secret, "", &fetched)
+	if w.Code != http.StatusOK || fetched.Title != "Draft" || fetched.Secret != "" {
+		t.Fatalf("get with the secret: %d %s", w.Code, w.Body.String())
+	}
+
+	// the header wins over the body, which is only used if there's no header
+	w = callApiV1WithSecret(t, store, "PUT", path, "wrong", `{"secret":"`+created.Secret+`","title":"Draft","version":1}`, nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("update with the wrong bearer token: %d %s", w.Code, w.Body.String())
+	}
+	w = callApiV1WithSecret(t, store, "PUT", path, created.Secret, `{"title":"Draft","version":1}`, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "" {
+		t.Fatalf("update with the bearer token: %d %s", w.Code, w.Body.String())
+	}
+	w = callApiV1(t, store, "PUT", path, `{"secret":"`+created.Secret+`","title":"Draft","version":2}`, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" {
+		t.Fatalf("update with the secret in the body: %d %s (Deprecation %q)", w.Code, w.Body.String(), w.Header().Get("Deprecation"))
+	}
+
+	w = callApiV1WithSecret(t, store, "DELETE", path, created.Secret, "", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete with the bearer token: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiV1AcceptsEscapedContent(t *testing.T) {
+	// each quote doubles in size once it is escaped in the JSON
+	raw, err := json.Marshal(map[string]string{"title": "Quotes", "content": strings.Repeat(`"`, maxContentLength)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := apiPage{}
+	w := callApiV1(t, NewMemoryStore(), "POST", "/api/v1/pages", string(raw), &created)
+	if w.Code != http.StatusCreated || len(created.Content) != maxContentLength {
+		t.Fatalf("expected the page to be created, got %d", w.Code)
+	}
+}
+
+func TestApiV1Errors(t *testing.T) {
+	store := NewMemoryStore()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+		allow  string
+	}{
+		{"GET", "/api/v1/pages", "", http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "POST"},
+		{"PATCH", "/api/v1/pages/hello-abcdefgh", "", http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "GET, HEAD, PUT, DELETE"},
+		{"POST", "/api/v1/pages", "{", http.StatusBadRequest, errCodeInvalidJson, ""},
+		{"POST", "/api/v1/pages", `{"title":"   "}`, http.StatusBadRequest, errCodeInvalidPage, ""},
+		{"POST", "/api/v1/pages", `{"title":"Big","content":"` + strings.Repeat("x", maxRequestSize) + `"}`, http.StatusRequestEntityTooLarge, errCodeTooLarge, ""},
+		{"GET", "/api/v1/pages/hello-abcdefgh", "", http.StatusNotFound, errCodeNotFound, ""},
+		{"PUT", "/api/v1/pages/hello-abcdefgh", `{"title":"Hi"}`, http.StatusNotFound, errCodeNotFound, ""},
+	}
+
+	for _, test := range tests {
+		apiErr := testApiError{}
+		w := callApiV1(t, store, test.method, test.path, test.body, &apiErr)
+		if w.Code != test.status || apiErr.Error.Code != test.code || w.Header().Get("Allow") != test.allow {
+			t.Errorf("%s %s: got %d %q (Allow %q)", test.method, test.path, w.Code, w.Body.String(), w.Header().Get("Allow"))
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"time"
+)
+
+// An archive is a .tar.gz of 'manifest.json' plus 'pages/<name>.md' for every page, each in the same Markdown with
+// front matter format as the FileStore. The secret Ids, which are hashes, are in the manifest.
+const archiveFormat = 1
+const archiveManifest = "manifest.json"
+const archivePagesDir = "pages"
+
+// how to handle a page whose name is already taken when importing
+const (
+	ImportSkip      = "skip"
+	ImportOverwrite = "overwrite"
+	ImportRename    = "rename"
+)
+
+var ErrUnknownImportStrategy = errors.New("Unknown import strategy, use 'skip', 'overwrite' or 'rename'")
+
+// the random suffix we add to every page name
+var nameSuffixRegexp = regexp.MustCompile(`-[A-Za-z]{8}$`)
+
+type archiveManifestPage struct {
+	Name string `json:"name"`
+	Id   string `json:"id"`
+	File string `json:"file"`
+}
+
+type archiveManifestFile struct {
+	Format   int                   `json:"format"`
+	Exported time.Time             `json:"exported"`
+	KeyNonce string                `json:"keyNonce"`
+	KeyCheck string                `json:"keyCheck"` // i.e. keyCheck(KeyNonce), to tell if the secrets will still work
+	Pages    []archiveManifestPage `json:"pages"`
+}
+
+type ImportResult struct {
+	Created       []string          `json:"created"`
+	Overwritten   []string          `json:"overwritten"`
+	Renamed       map[string]string `json:"renamed"` // old name -> new name
+	Skipped       []string          `json:"skipped"`
+	WithoutSecret []string          `json:"withoutSecret"` // their Id belonged to another page, so they have none
+}
+
+// Importer is implemented by stores which can add many pages in a single transaction, see importPages().
+type Importer interface {
+	ImportPages(pages []Page, onConflict string) (*ImportResult, error)
+}
+
+// pageTx is what importPages needs from a store, from inside one of its transactions.
+type pageTx interface {
+	nameExists(name string) (bool, error)
+	idName(id string) (string, error) // the name of the page with this Id, or ""
+	putPage(page Page) error
+}
+
+// importPages saves all of the pages, handling any with a name which is already taken as `onConflict` says. A page
+// whose Id belongs to another page is skipped, or (if the page is being overwritten or renamed) saved without an Id.
+func importPages(t pageTx, pages []Page, onConflict string) (*ImportResult, error) {
+	if onConflict != ImportSkip && onConflict != ImportOverwrite && onConflict != ImportRename {
+		return nil, ErrUnknownImportStrategy
+	}
+
+	result := &ImportResult{Renamed: map[string]string{}}
+
+	for _, page := range pages {
+		exists, err := t.nameExists(page.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		origName := page.Name
+		if exists {
+			switch onConflict {
+			case ImportSkip:
+				result.Skipped = append(result.Skipped, origName)
+				continue
+			case ImportRename:
+				newName, err := unusedName(t, page.Name)
+				if err != nil {
+					return nil, err
+				}
+				page.Name = newName
+			}
+		}
+
+		if page.Id != "" {
+			owner, err := t.idName(page.Id)
+			if err != nil {
+				return nil, err
+			}
+			if owner != "" && owner != page.Name {
+				if onConflict == ImportSkip {
+					result.Skipped = append(result.Skipped, origName)
+					continue
+				}
+				page.Id = ""
+				result.WithoutSecret = append(result.WithoutSecret, page.Name)
+			}
+		}
+
+		if err := t.putPage(page); err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			result.Created = append(result.Created, page.Name)
+		} else if page.Name != origName {
+			result.Renamed[origName] = page.Name
+		} else {
+			result.Overwritten = append(result.Overwritten, page.Name)
+		}
+	}
+
+	return result, nil
+}
+
+// unusedName swaps the random suffix on the end of the name for a new one which isn't taken.
+func unusedName(t pageTx, name string) (string, error) {
+	base := nameSuffixRegexp.ReplaceAllString(name, "")
+	for i := 0; i < createAttempts; i++ {
+		newName := base + "-" + randStr(8)
+		exists, err := t.nameExists(newName)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return newName, nil
+		}
+	}
+	return "", fmt.Errorf("Could not find a free name for '%s'", name)
+}
+
+// exportArchive writes every page in the store to `w` as a .tar.gz, returning how many there were.
+func exportArchive(store PageStore, w io.Writer) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now().UTC()
+
+	nonce := cryptoRandStr(32)
+	manifest := archiveManifestFile{
+		Format:   archiveFormat,
+		Exported: now,
+		KeyNonce: nonce,
+		KeyCheck: keyCheck(nonce),
+		Pages:    []archiveManifestPage{},
+	}
+
+	err := store.IteratePages(func(page *Page) error {
+		raw, err := encodeMarkdown(page)
+		if err != nil {
+			return err
+		}
+
+		file := path.Join(archivePagesDir, page.Name+fileStoreExt)
+		if err := writeTarFile(tw, file, raw, page.Updated); err != nil {
+			return err
+		}
+
+		manifest.Pages = append(manifest.Pages, archiveManifestPage{page.Name, page.Id, file})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	raw, errMarshal := json.MarshalIndent(manifest, "", "  ")
+	if errMarshal != nil {
+		return 0, errMarshal
+	}
+	if err := writeTarFile(tw, archiveManifest, raw, now); err != nil {
+		return 0, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	return len(manifest.Pages), gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readArchive reads all of the pages in the .tar.gz. `keyMatches` is false if they were exported with a different
+// SECRET_KEY, in which case none of their secrets will work here.
+func readArchive(r io.Reader) (pages []Page, keyMatches bool, err error) {
+	gz, errGzip := gzip.NewReader(r)
+	if errGzip != nil {
+		return nil, false, errGzip
+	}
+	tr := tar.NewReader(gz)
+
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, false, err
+		}
+		files[hdr.Name] = data
+	}
+
+	rawManifest, ok := files[archiveManifest]
+	if !ok {
+		return nil, false, errors.New("Archive has no " + archiveManifest)
+	}
+
+	manifest := archiveManifestFile{}
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return nil, false, err
+	}
+	if manifest.Format != archiveFormat {
+		return nil, false, fmt.Errorf("Unknown archive format %d", manifest.Format)
+	}
+
+	for _, entry := range manifest.Pages {
+		raw, ok := files[entry.File]
+		if !ok {
+			return nil, false, fmt.Errorf("Archive is missing %s", entry.File)
+		}
+
+		page, err := decodeMarkdown(raw)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", entry.File, err)
+		}
+		if !validPageName(entry.Name) {
+			return nil, false, fmt.Errorf("%s: %v", entry.File, ErrInvalidPageName)
+		}
+
+		page.Name = entry.Name
+		page.Id = entry.Id
+		if !page.IsDeleted() {
+			renderPage(page)
+		}
+		pages = append(pages, *page)
+	}
+
+	// archives from before there was a nonce have hashSecret("") instead
+	if manifest.KeyNonce == "" {
+		return pages, hmac.Equal([]byte(manifest.KeyCheck), []byte(hashSecret(""))), nil
+	}
+	return pages, hmac.Equal([]byte(manifest.KeyCheck), []byte(keyCheck(manifest.KeyNonce))), nil
+}
@@ -0,0 +1,210 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// useSecretKey sets SECRET_KEY until the test is done.
+func useSecretKey(t *testing.T, key string) {
+	orig := secretKey
+	t.Cleanup(func() { secretKey = orig })
+
+	secretKey = []byte(key)
+}
+
+// readManifest returns the manifest from an exported archive.
+func readManifest(t *testing.T, archive []byte) archiveManifestFile {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != archiveManifest {
+			continue
+		}
+
+		raw, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := archiveManifestFile{}
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+}
+
+func TestArchiveKeyCheck(t *testing.T) {
+	useSecretKey(t, "key")
+	store := NewMemoryStore()
+
+	first := bytes.Buffer{}
+	if _, err := exportArchive(store, &first); err != nil {
+		t.Fatal(err)
+	}
+	second := bytes.Buffer{}
+	if _, err := exportArchive(store, &second); err != nil {
+		t.Fatal(err)
+	}
+
+	// it mustn't give away the hash of a known secret, nor be the same in every archive
+	a, b := readManifest(t, first.Bytes()), readManifest(t, second.Bytes())
+	if a.KeyNonce == "" || a.KeyCheck == hashSecret("") || a.KeyCheck == hashSecret(a.KeyNonce) {
+		t.Fatalf("the key check gives away a hashed secret: %#v", a)
+	}
+	if a.KeyNonce == b.KeyNonce || a.KeyCheck == b.KeyCheck {
+		t.Fatalf("expected each archive to have its own key check, got %#v and %#v", a, b)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	useSecretKey(t, "key")
+
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreatePage(testPage("second-bbbbbbbb", "secret-two", "Second")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.Buffer{}
+		count, err := exportArchive(store, &buf)
+		if err != nil || count != 2 {
+			t.Fatalf("expected 2 pages to be exported, got %d (%v)", count, err)
+		}
+
+		pages, keyMatches, err := readArchive(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !keyMatches {
+			t.Fatal("expected the SECRET_KEY to match")
+		}
+		sort.Slice(pages, func(i, j int) bool { return pages[i].Name < pages[j].Name })
+		if len(pages) != 2 || pages[0].Name != "first-aaaaaaaa" || pages[0].Id != "secret-one" ||
+			pages[0].Title != "First" || pages[0].Html == "" || pages[1].Name != "second-bbbbbbbb" {
+			t.Fatalf("unexpected pages: %#v", pages)
+		}
+
+		// the secrets in an archive from somewhere with another SECRET_KEY won't work here
+		useSecretKey(t, "another key")
+		if _, keyMatches, err := readArchive(bytes.NewReader(buf.Bytes())); err != nil || keyMatches {
+			t.Fatalf("expected the SECRET_KEY not to match (%v)", err)
+		}
+	})
+}
+
+func TestImportPages(t *testing.T) {
+	// the first page is already there, and the last one's secret belongs to it
+	imported := []Page{
+		testPage("first-aaaaaaaa", "secret-one", "Imported"),
+		testPage("new-bbbbbbbb", "secret-new", "New"),
+		testPage("thief-cccccccc", "secret-one", "Thief"),
+	}
+
+	tests := []struct {
+		onConflict string
+		expected   ImportResult
+		first      string
+	}{
+		{
+			ImportSkip,
+			ImportResult{Created: []string{"new-bbbbbbbb"}, Skipped: []string{"first-aaaaaaaa", "thief-cccccccc"}},
+			"Here",
+		},
+		{
+			ImportOverwrite,
+			ImportResult{
+				Created:       []string{"new-bbbbbbbb", "thief-cccccccc"},
+				Overwritten:   []string{"first-aaaaaaaa"},
+				WithoutSecret: []string{"thief-cccccccc"},
+			},
+			"Imported",
+		},
+		{
+			ImportRename,
+			ImportResult{
+				Created:       []string{"new-bbbbbbbb", "thief-cccccccc"},
+				Renamed:       map[string]string{"first-aaaaaaaa": "first-zzzzzzzz"},
+				WithoutSecret: []string{"first-zzzzzzzz", "thief-cccccccc"},
+			},
+			"Here",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.onConflict, func(t *testing.T) {
+			withEachStore(t, func(t *testing.T, store PageStore) {
+				importer, ok := store.(Importer)
+				if !ok {
+					t.Skip("this store can't import")
+				}
+				if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "Here")); err != nil {
+					t.Fatal(err)
+				}
+				if test.onConflict == ImportRename {
+					scriptRandStr(t, "zzzzzzzz")
+				}
+
+				result, err := importer.ImportPages(imported, test.onConflict)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.expected.Renamed == nil {
+					test.expected.Renamed = map[string]string{}
+				}
+				if !reflect.DeepEqual(*result, test.expected) {
+					t.Fatalf("expected %+v, got %+v", test.expected, *result)
+				}
+
+				// the secret still belongs to the page which had it
+				page, err := store.GetPageUsingId("secret-one")
+				if err != nil || page == nil || page.Name != "first-aaaaaaaa" || page.Title != test.first {
+					t.Fatalf("unexpected owner of the secret: %#v (%v)", page, err)
+				}
+			})
+		})
+	}
+
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		if importer, ok := store.(Importer); ok {
+			if _, err := importer.ImportPages(imported, "merge"); err != ErrUnknownImportStrategy {
+				t.Fatalf("expected ErrUnknownImportStrategy, got %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,432 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// errUsage is returned by a command when it has been given the wrong arguments.
+var errUsage = errors.New("Invalid arguments")
+
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup":         {"backup [-gzip] [-url <url>] <file>", "Save a snapshot from a running server, using ADMIN_TOKEN.", cmdBackup},
+	"compact":        {"compact", "Rewrite the BoltDB file without its unused space. Stop the server first.", cmdCompact},
+	"copy-bolt":      {"copy-bolt <file>", "Copy every page from a BoltDB file into the configured store.", cmdCopyBolt},
+	"export":         {"export <file>", "Write every page to a .tar.gz archive.", cmdExport},
+	"fsck":           {"fsck [-repair]", "Check that the BoltDB 'page' and 'id' buckets agree, fixing them with -repair.", cmdFsck},
+	"import":         {"import [-on-conflict skip|overwrite|rename] <file>", "Add every page in an archive to the store.", cmdImport},
+	"migrate":        {"migrate [-dry-run]", "Bring the store up to date, which the server also does when it starts.", cmdMigrate},
+	"rebuild-search": {"rebuild-search", "Index every page for searching again, from scratch.", cmdRebuildSearch},
+	"reencrypt":      {"reencrypt [-batch <n>]", "Re-encrypt every page with ENCRYPTION_KEY, which the server also does when it starts.", cmdReencrypt},
+	"rerender":       {"rerender [-batch <n>]", "Regenerate the HTML of every page made by an older renderer.", cmdRerender},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: publish [command]\n\n")
+	fmt.Fprintf(os.Stderr, "With no command, the server is started. Commands:\n\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-24s %s\n", commands[name].usage, commands[name].help)
+	}
+}
+
+func runCommand(name string, args []string) error {
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return nil
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		return fmt.Errorf("Unknown command '%s'", name)
+	}
+
+	err := cmd.run(args)
+	if err == errUsage {
+		return fmt.Errorf("Usage: publish %s", cmd.usage)
+	}
+	return err
+}
+
+// openConfiguredStore opens the store the server would use, as set by STORE and STORE_PATH.
+func openConfiguredStore() (PageStore, error) {
+	return openStore(os.Getenv("STORE"), os.Getenv("STORE_PATH"))
+}
+
+func cmdMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without changing it")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	store, errOpen := openConfiguredStore()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	return migrateStore(store, *dryRun)
+}
+
+func cmdBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	compress := flags.Bool("gzip", false, "compress the snapshot")
+	url := flags.String("url", os.Getenv("BASE_URL"), "the running server, which defaults to BASE_URL")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	filename := flags.Arg(0)
+
+	if adminToken == "" {
+		return errors.New("Set ADMIN_TOKEN to the same value as the server's")
+	}
+
+	endpoint := *url + "/admin/backup"
+	if *compress {
+		endpoint += "?gzip=1"
+	}
+
+	req, errReq := http.NewRequest("GET", endpoint, nil)
+	if errReq != nil {
+		return errReq
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, errGet := http.DefaultClient.Do(req)
+	if errGet != nil {
+		return errGet
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Backup failed: %s: %s", resp.Status, body)
+	}
+
+	// write to a temporary file, and only keep it if the checksum matches
+	tmp := filename + ".tmp"
+	f, errCreate := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if errCreate != nil {
+		return errCreate
+	}
+	defer os.Remove(tmp)
+
+	hash := sha256.New()
+	size, errCopy := io.Copy(io.MultiWriter(f, hash), resp.Body)
+	errClose := f.Close()
+	if errCopy != nil {
+		return errCopy
+	}
+	if errClose != nil {
+		return errClose
+	}
+
+	expected := resp.Header.Get(checksumHeader)
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if expected == "" {
+		return errors.New("Backup failed: the server did not send a checksum")
+	}
+	if expected != actual {
+		return fmt.Errorf("Backup failed: checksum mismatch, expected %s but got %s", expected, actual)
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	log.Printf("Backed up %d bytes to %s (sha256 %s)\n", size, filename, actual)
+	return nil
+}
+
+func cmdCopyBolt(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	if os.Getenv("STORE") == "" || os.Getenv("STORE") == "bolt" {
+		return errors.New("Set STORE to the store you want to copy the pages into")
+	}
+
+	to, errTo := openConfiguredStore()
+	if errTo != nil {
+		return errTo
+	}
+	defer to.Close()
+
+	count := 0
+	err := readBoltPages(args[0], func(page *Page) error {
+		if err := to.PutPage(*page); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Copied %d pages from %s\n", count, args[0])
+	return nil
+}
+
+func cmdExport(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	filename := args[0]
+
+	store, errOpen := openConfiguredStore()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	// write to a temporary file so we never leave half an archive behind
+	tmp := filename + ".tmp"
+	f, errCreate := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if errCreate != nil {
+		return errCreate
+	}
+	defer os.Remove(tmp)
+
+	count, errExport := exportArchive(store, f)
+	errClose := f.Close()
+	if errExport != nil {
+		return errExport
+	}
+	if errClose != nil {
+		return errClose
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d pages to %s\n", count, filename)
+	return nil
+}
+
+func cmdImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	onConflict := flags.String("on-conflict", ImportSkip, "what to do when a page name is taken: skip, overwrite or rename")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	filename := flags.Arg(0)
+
+	f, errOpenFile := os.Open(filename)
+	if errOpenFile != nil {
+		return errOpenFile
+	}
+	defer f.Close()
+
+	pages, keyMatches, errRead := readArchive(f)
+	if errRead != nil {
+		return errRead
+	}
+	if !keyMatches {
+		log.Printf("Warning: %s was exported with a different SECRET_KEY, so its page secrets will not work\n", filename)
+	}
+
+	store, errOpen := openConfiguredStore()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	importer, ok := store.(Importer)
+	if !ok {
+		return errors.New("This store can't import pages, use 'bolt', 'sqlite' or 'memory'")
+	}
+
+	result, errImport := importer.ImportPages(pages, *onConflict)
+	if errImport != nil {
+		return errImport
+	}
+
+	for oldName, newName := range result.Renamed {
+		log.Printf("Renamed %s to %s\n", oldName, newName)
+	}
+	for _, name := range result.WithoutSecret {
+		log.Printf("Warning: %s's secret is used by another page, so it was imported without one\n", name)
+	}
+	log.Printf(
+		"Read %d pages from %s: %d created, %d overwritten, %d renamed, %d skipped\n",
+		len(pages),
+		filename,
+		len(result.Created),
+		len(result.Overwritten),
+		len(result.Renamed),
+		len(result.Skipped),
+	)
+	return nil
+}
+
+func cmdRebuildSearch(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	store, errOpen := openConfiguredStore()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	rebuilder, ok := store.(interface {
+		RebuildSearchIndex() (int, error)
+	})
+	if !ok {
+		log.Printf("This store has no search index to rebuild, it reads every page when searching\n")
+		return nil
+	}
+
+	count, err := rebuilder.RebuildSearchIndex()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Indexed %d pages for searching\n", count)
+	return nil
+}
+
+// boltStorePath is the BoltDB file the server would use, or an error if it is configured to use another store.
+func boltStorePath() (string, error) {
+	if os.Getenv("STORE") != "" && os.Getenv("STORE") != "bolt" {
+		return "", errors.New("This command only works on the 'bolt' store")
+	}
+	if os.Getenv("STORE_PATH") == "" {
+		return "publish.db", nil
+	}
+	return os.Getenv("STORE_PATH"), nil
+}
+
+func cmdCompact(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	path, errPath := boltStorePath()
+	if errPath != nil {
+		return errPath
+	}
+
+	before, after, err := compactBolt(path)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %s from %d to %d bytes\n", path, before, after)
+	return nil
+}
+
+func cmdFsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix whatever can be fixed")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errUsage
+	}
+
+	path, errPath := boltStorePath()
+	if errPath != nil {
+		return errPath
+	}
+
+	store, errOpen := NewBoltStore(path)
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	problems, repaired, err := store.Fsck(*repair)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) == 0 {
+		log.Printf("No problems found in %s\n", path)
+		return nil
+	}
+	if repaired < len(problems) {
+		if !*repair {
+			return fmt.Errorf("Found %d problems, run 'publish fsck -repair' to fix them", len(problems))
+		}
+		return fmt.Errorf("Repaired %d of %d problems", repaired, len(problems))
+	}
+
+	log.Printf("Repaired %d problems\n", repaired)
+	return nil
+}
+
+func cmdReencrypt(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	batch := flags.Int("batch", defaultReencryptBatch, "how many pages to rewrite in each transaction")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *batch < 1 {
+		return errUsage
+	}
+
+	store, errOpen := openConfiguredStore()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	reencrypter, ok := store.(Reencrypter)
+	if !ok {
+		return errors.New("Only the 'bolt' store encrypts its pages")
+	}
+
+	count, err := reencrypter.Reencrypt(*batch, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Re-encrypted %d pages and revisions\n", count)
+	return nil
+}
@@ -0,0 +1,100 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// compactBolt copies everything in the BoltDB file into a fresh one, packed as tightly as it can be, then swaps it in
+// for the original. It returns the sizes before and after. Nothing else may have the file open.
+func compactBolt(path string) (int64, int64, error) {
+	// we open it for writing too, so that nothing else can while we copy it
+	src, errOpen := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if errOpen != nil {
+		return 0, 0, errOpen
+	}
+	defer src.Close()
+
+	info, errStat := os.Stat(path)
+	if errStat != nil {
+		return 0, 0, errStat
+	}
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	dst, errCreate := bolt.Open(tmp, info.Mode(), &bolt.Options{Timeout: 1 * time.Second})
+	if errCreate != nil {
+		return 0, 0, errCreate
+	}
+	defer os.Remove(tmp)
+
+	errCopy := src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				dstBucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, dstBucket)
+			})
+		})
+	})
+	errClose := dst.Close()
+	if errCopy != nil {
+		return 0, 0, errCopy
+	}
+	if errClose != nil {
+		return 0, 0, errClose
+	}
+
+	compacted, errStatTmp := os.Stat(tmp)
+	if errStatTmp != nil {
+		return 0, 0, errStatTmp
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, 0, err
+	}
+
+	return info.Size(), compacted.Size(), nil
+}
+
+// copyBucket copies every key, and every nested bucket, from `src` to `dst`.
+func copyBucket(src, dst *bolt.Bucket) error {
+	// the keys arrive in order, so every page can be filled
+	dst.FillPercent = 1.0
+
+	return src.ForEach(func(k, v []byte) error {
+		// a nil value is a nested bucket
+		if v == nil {
+			dstChild, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(src.Bucket(k), dstChild)
+		}
+
+		return dst.Put(k, v)
+	})
+}
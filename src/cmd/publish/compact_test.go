@@ -0,0 +1,79 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompactBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "publish.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lots of pages, most of which are then deleted, leaves plenty of free space
+	for i := 0; i < 200; i++ {
+		name := strings.Repeat(string(rune('a'+i%26)), i/26+1) + "-aaaaaaaa"
+		page := testPage(name, "secret-"+name, "Page")
+		page.Content = strings.Repeat("words ", 500)
+		if err := store.CreatePage(page); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if err := store.DeletePage(name, page.Updated); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	store.Close()
+
+	before, after, err := compactBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("expected the file to shrink, it went from %d to %d bytes", before, after)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != after {
+		t.Fatalf("expected the compacted file to be %d bytes: %v", after, err)
+	}
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Fatal("the temporary file was left behind")
+	}
+
+	// and everything is still there
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	page, err := store.GetPageUsingId("secret-a-aaaaaaaa")
+	if err != nil || page == nil || page.Title != "Page" {
+		t.Fatalf("unexpected page after compacting: %#v (%v)", page, err)
+	}
+	if page, err := store.GetPage("b-aaaaaaaa"); err != nil || page == nil || !page.IsDeleted() {
+		t.Fatalf("expected a tombstone after compacting: %#v (%v)", page, err)
+	}
+}
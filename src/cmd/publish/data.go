@@ -20,23 +20,33 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
-	"math/rand"
 	"net/http"
-	"time"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const lenLetters = len(letterBytes)
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
+// any random byte at or above this would make some letters more likely than others, so we throw it away
+const maxLetterByte = 256 - 256%lenLetters
+
+// randStr is a variable so that tests can make it return whatever they need.
+var randStr = cryptoRandStr
 
-func randStr(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+// cryptoRandStr returns `n` letters from crypto/rand, each equally likely.
+func cryptoRandStr(n int) string {
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(b) < n {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, c := range buf {
+			if int(c) < maxLetterByte && len(b) < n {
+				b = append(b, letterBytes[int(c)%lenLetters])
+			}
+		}
 	}
 	return string(b)
 }
@@ -49,6 +59,54 @@ func sendOk(w http.ResponseWriter, data interface{}) {
 	json.NewEncoder(w).Encode(data)
 }
 
+func sendPayload(w http.ResponseWriter, msg string, payload interface{}) {
+	data := struct {
+		Ok      bool        `json:"ok"`
+		Msg     string      `json:"msg"`
+		Payload interface{} `json:"payload"`
+	}{
+		Ok:      true,
+		Msg:     msg,
+		Payload: payload,
+	}
+
+	sendJson(w, data)
+}
+
+// sendConflict is a failure with a 409 status, along with the current state of whatever the client was trying to
+// change.
+func sendConflict(w http.ResponseWriter, msg string, payload interface{}) {
+	data := struct {
+		Ok      bool        `json:"ok"`
+		Msg     string      `json:"msg"`
+		Payload interface{} `json:"payload"`
+	}{
+		Ok:      false,
+		Msg:     msg,
+		Payload: payload,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	sendJson(w, data)
+}
+
+// sendFieldErrors is a failure along with what is wrong with each field, so that the editor can show it next to the
+// field.
+func sendFieldErrors(w http.ResponseWriter, errs FieldErrors) {
+	data := struct {
+		Ok      bool                   `json:"ok"`
+		Msg     string                 `json:"msg"`
+		Payload map[string]interface{} `json:"payload"`
+	}{
+		Ok:      false,
+		Msg:     errs.Error(),
+		Payload: map[string]interface{}{"fields": errs},
+	}
+
+	sendJson(w, data)
+}
+
 func sendError(w http.ResponseWriter, msg string) {
 	data := struct {
 		Ok  bool   `json:"ok"`
@@ -0,0 +1,166 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+)
+
+// diffs bigger than this many cells (lines in one times lines in the other) are shown as a complete replacement, so
+// that a huge page can't take up all our time. The memory needed only grows with the number of lines, see lcsMatches().
+const maxDiffCells = 4 * 1024 * 1024
+
+type DiffLine struct {
+	Op   string `json:"op"`   // one of " " (unchanged), "-" (removed) or "+" (added)
+	Text string `json:"text"` // the line itself, without the newline
+}
+
+// diffLines returns the line-by-line changes needed to turn `a` into `b`, using the longest common subsequence.
+func diffLines(a, b string) []DiffLine {
+	as := strings.Split(a, "\n")
+	bs := strings.Split(b, "\n")
+
+	// skip over the lines common to the start and end, since they're often most of the page
+	prefix := 0
+	for prefix < len(as) && prefix < len(bs) && as[prefix] == bs[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(as)-prefix && suffix < len(bs)-prefix && as[len(as)-1-suffix] == bs[len(bs)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]DiffLine, 0, len(as)+len(bs))
+	for _, text := range as[:prefix] {
+		lines = append(lines, DiffLine{" ", text})
+	}
+	lines = append(lines, diffMiddle(as[prefix:len(as)-suffix], bs[prefix:len(bs)-suffix])...)
+	for _, text := range as[len(as)-suffix:] {
+		lines = append(lines, DiffLine{" ", text})
+	}
+
+	return lines
+}
+
+func diffMiddle(as, bs []string) []DiffLine {
+	lines := []DiffLine{}
+
+	if len(as)*len(bs) > maxDiffCells {
+		for _, text := range as {
+			lines = append(lines, DiffLine{"-", text})
+		}
+		for _, text := range bs {
+			lines = append(lines, DiffLine{"+", text})
+		}
+		return lines
+	}
+
+	// between each pair of lines in the longest common subsequence, removals come before additions
+	i, j := 0, 0
+	gap := func(toI, toJ int) {
+		for ; i < toI; i++ {
+			lines = append(lines, DiffLine{"-", as[i]})
+		}
+		for ; j < toJ; j++ {
+			lines = append(lines, DiffLine{"+", bs[j]})
+		}
+	}
+	lcsMatches(as, bs, 0, 0, func(matchI, matchJ int) {
+		gap(matchI, matchJ)
+		lines = append(lines, DiffLine{" ", as[i]})
+		i++
+		j++
+	})
+	gap(len(as), len(bs))
+
+	return lines
+}
+
+// lcsMatches calls `match` with the position of every line in a longest common subsequence of `as` and `bs`, in order,
+// where `i` and `j` are where they start in the whole of each. It is Hirschberg's algorithm: split `as` in half, find
+// where the subsequence crosses that line using just two rows of lengths from each end, then do each side the same
+// way. That's twice the work of filling in the whole table, but needs memory for only a few rows of it.
+func lcsMatches(as, bs []string, i, j int, match func(i, j int)) {
+	if len(as) == 0 || len(bs) == 0 {
+		return
+	}
+
+	if len(as) == 1 {
+		for k, text := range bs {
+			if text == as[0] {
+				match(i, j+k)
+				return
+			}
+		}
+		return
+	}
+
+	mid := len(as) / 2
+	before := lcsBefore(as[:mid], bs)
+	after := lcsAfter(as[mid:], bs)
+
+	split := 0
+	for k := range before {
+		if before[k]+after[k] > before[split]+after[split] {
+			split = k
+		}
+	}
+
+	lcsMatches(as[:mid], bs[:split], i, j, match)
+	lcsMatches(as[mid:], bs[split:], i+mid, j+split, match)
+}
+
+// lcsBefore returns the length of the longest common subsequence of `as` and bs[:k], for every k.
+func lcsBefore(as, bs []string) []int {
+	prev := make([]int, len(bs)+1)
+	cur := make([]int, len(bs)+1)
+	for _, a := range as {
+		for k, b := range bs {
+			if a == b {
+				cur[k+1] = prev[k] + 1
+			} else if prev[k+1] >= cur[k] {
+				cur[k+1] = prev[k+1]
+			} else {
+				cur[k+1] = cur[k]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
+
+// lcsAfter returns the length of the longest common subsequence of `as` and bs[k:], for every k.
+func lcsAfter(as, bs []string) []int {
+	prev := make([]int, len(bs)+1)
+	cur := make([]int, len(bs)+1)
+	for n := len(as) - 1; n >= 0; n-- {
+		for k := len(bs) - 1; k >= 0; k-- {
+			if as[n] == bs[k] {
+				cur[k] = prev[k+1] + 1
+			} else if prev[k] >= cur[k+1] {
+				cur[k] = prev[k]
+			} else {
+				cur[k] = cur[k+1]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev
+}
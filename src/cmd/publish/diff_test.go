@@ -0,0 +1,105 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lcsLength is the longest common subsequence the slow way, with the whole table.
+func lcsLength(as, bs []string) int {
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return lcs[0][0]
+}
+
+func TestDiffLines(t *testing.T) {
+	lines := diffLines("a\nb\nc\nd", "a\nx\nc\nd\ne")
+	expected := []DiffLine{{" ", "a"}, {"-", "b"}, {"+", "x"}, {" ", "c"}, {" ", "d"}, {"+", "e"}}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected %v, got %v", expected, lines)
+	}
+}
+
+func TestDiffLinesIsShortest(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rnd.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rnd.Intn(4)))
+		}
+		return lines
+	}
+
+	for n := 0; n < 500; n++ {
+		as, bs := randomLines(), randomLines()
+		lines := diffLines(strings.Join(as, "\n"), strings.Join(bs, "\n"))
+
+		// it must turn one into the other, keeping as many lines as it can
+		from, to, kept := []string{}, []string{}, 0
+		for _, line := range lines {
+			if line.Op != "+" {
+				from = append(from, line.Text)
+			}
+			if line.Op != "-" {
+				to = append(to, line.Text)
+			}
+			if line.Op == " " {
+				kept++
+			}
+		}
+		if strings.Join(from, "\n") != strings.Join(as, "\n") || strings.Join(to, "\n") != strings.Join(bs, "\n") {
+			t.Fatalf("%q to %q: the diff doesn't match: %v", as, bs, lines)
+		}
+		if expected := lcsLength(strings.Split(strings.Join(as, "\n"), "\n"), strings.Split(strings.Join(bs, "\n"), "\n")); kept != expected {
+			t.Fatalf("%q to %q: expected to keep %d lines, kept %d: %v", as, bs, expected, kept, lines)
+		}
+	}
+}
+
+func TestDiffLinesTooBig(t *testing.T) {
+	// the same lines apart from the first and last, so there's nothing to skip at either end
+	as, bs := make([]string, 2049), make([]string, 2049)
+	for i := range as {
+		as[i], bs[i] = strconv.Itoa(i), strconv.Itoa(i)
+	}
+	as[0], as[len(as)-1] = "first", "last"
+
+	lines := diffLines(strings.Join(as, "\n"), strings.Join(bs, "\n"))
+	if len(lines) != len(as)+len(bs) || lines[0].Op != "-" || lines[len(as)].Op != "+" {
+		t.Fatalf("expected everything to be replaced, got %d lines", len(lines))
+	}
+}
@@ -0,0 +1,271 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrUnknownEncryptionKey = errors.New("Page is encrypted with a key which isn't in ENCRYPTION_KEY or ENCRYPTION_OLD_KEYS")
+var ErrPageDecrypt = errors.New("Page could not be decrypted, it may be corrupt")
+
+// encryptedMarker is the first byte of every encrypted value, which is never the first byte of JSON, of an upload we
+// allow, or of an expiry time since 1975. It is followed by the key's Id, the nonce and then the sealed value.
+const encryptedMarker = 0x01
+const encryptionKeyIdSize = 8
+
+// how many values `publish reencrypt` (and the server) rewrite in each transaction
+const defaultReencryptBatch = 100
+
+// encryptionKey encrypts every page the 'bolt' store writes, and comes from ENCRYPTION_KEY. When it is nil pages are
+// written as plain JSON. Pages can be read with it or any of the keys in decryptionKeys, which also has the
+// ENCRYPTION_OLD_KEYS in it, so that the key can be changed while the old one is still in use.
+var encryptionKey *pageKey
+var decryptionKeys = map[string]*pageKey{}
+
+// Reencrypter is implemented by stores which encrypt their pages with encryptionKey.
+type Reencrypter interface {
+	Reencrypt(batch int, stop <-chan struct{}) (int, error)
+}
+
+type pageKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// newPageKey makes an AES-256-GCM key from 64 hex characters. Its Id is the start of its SHA-256, so that we can tell
+// which key encrypted a value without giving the key away.
+func newPageKey(hexKey string) (*pageKey, error) {
+	key, errDecode := hex.DecodeString(hexKey)
+	if errDecode != nil || len(key) != 32 {
+		return nil, errors.New("An encryption key must be 64 hex characters, e.g. from 'openssl rand -hex 32'")
+	}
+
+	block, errCipher := aes.NewCipher(key)
+	if errCipher != nil {
+		return nil, errCipher
+	}
+
+	aead, errGCM := cipher.NewGCM(block)
+	if errGCM != nil {
+		return nil, errGCM
+	}
+
+	sum := sha256.Sum256(key)
+	return &pageKey{id: sum[:encryptionKeyIdSize], aead: aead}, nil
+}
+
+// setEncryptionKeys sets encryptionKey from `current`, which may be empty, and the keys which can decrypt from it and
+// the comma separated `old`.
+func setEncryptionKeys(current, old string) error {
+	encryptionKey = nil
+	decryptionKeys = map[string]*pageKey{}
+
+	for _, hexKey := range strings.Split(old, ",") {
+		hexKey = strings.TrimSpace(hexKey)
+		if hexKey == "" {
+			continue
+		}
+		key, err := newPageKey(hexKey)
+		if err != nil {
+			return fmt.Errorf("ENCRYPTION_OLD_KEYS: %v", err)
+		}
+		decryptionKeys[string(key.id)] = key
+	}
+
+	if current == "" {
+		return nil
+	}
+
+	key, err := newPageKey(current)
+	if err != nil {
+		return fmt.Errorf("ENCRYPTION_KEY: %v", err)
+	}
+	encryptionKey = key
+	decryptionKeys[string(key.id)] = key
+	return nil
+}
+
+// encryptionConfigured is true if any key has been set, in which case there may be values to re-encrypt.
+func encryptionConfigured() bool {
+	return len(decryptionKeys) > 0
+}
+
+func isEncrypted(raw []byte) bool {
+	return len(raw) > 0 && raw[0] == encryptedMarker
+}
+
+// encryptValue seals `plain` with encryptionKey, or returns it as it is if there is no key. The header is used as the
+// additional data, so that it can't be changed either.
+func encryptValue(plain []byte) ([]byte, error) {
+	if encryptionKey == nil {
+		return plain, nil
+	}
+
+	aead := encryptionKey.aead
+	header := make([]byte, 1+encryptionKeyIdSize+aead.NonceSize())
+	header[0] = encryptedMarker
+	copy(header[1:], encryptionKey.id)
+	if _, err := rand.Read(header[1+encryptionKeyIdSize:]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, header[1+encryptionKeyIdSize:], plain, header), nil
+}
+
+// decryptValue opens a value written by encryptValue(), with whichever key sealed it. Plain values are returned as they
+// are.
+func decryptValue(raw []byte) ([]byte, error) {
+	if !isEncrypted(raw) {
+		return raw, nil
+	}
+
+	if len(raw) < 1+encryptionKeyIdSize {
+		return nil, ErrPageDecrypt
+	}
+	key, ok := decryptionKeys[string(raw[1:1+encryptionKeyIdSize])]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+
+	headerSize := 1 + encryptionKeyIdSize + key.aead.NonceSize()
+	if len(raw) < headerSize {
+		return nil, ErrPageDecrypt
+	}
+
+	plain, err := key.aead.Open(nil, raw[1+encryptionKeyIdSize:headerSize], raw[headerSize:], raw[:headerSize])
+	if err != nil {
+		return nil, ErrPageDecrypt
+	}
+	return plain, nil
+}
+
+// needsReencrypting is true if the value isn't stored the way encryptionKey says it should be.
+func needsReencrypting(raw []byte) bool {
+	if encryptionKey == nil {
+		return isEncrypted(raw)
+	}
+	return !isEncrypted(raw) || !bytes.Equal(raw[1:1+encryptionKeyIdSize], encryptionKey.id)
+}
+
+// encodePage is how every page (and revision) is serialised for the 'bolt' store.
+func encodePage(page Page) ([]byte, error) {
+	raw, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+	return encryptValue(raw)
+}
+
+// decodePage reads a page written by encodePage(), or by a version of the program from before pages were encrypted.
+func decodePage(raw []byte, page *Page) error {
+	plain, err := decryptValue(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, page)
+}
+
+// Reencrypt rewrites every page, revision, search index entry and upload which isn't encrypted with the current key,
+// `batch` at a time so that other writers don't have to wait long. It stops early if `stop` is closed, and returns how
+// many values it rewrote.
+func (s *BoltStore) Reencrypt(batch int, stop <-chan struct{}) (int, error) {
+	count := 0
+	for _, bucketName := range [][]byte{pageBucketName, revisionBucketName, searchBucketName, uploadBucketName} {
+		from := []byte{}
+		for from != nil {
+			select {
+			case <-stop:
+				return count, nil
+			default:
+			}
+
+			n, next, err := s.reencryptBatch(bucketName, from, batch)
+			count += n
+			if err != nil {
+				return count, err
+			}
+			from = next
+		}
+	}
+	return count, nil
+}
+
+// reencryptBatch looks at up to `batch` values from the key `from` onwards, and returns how many it rewrote and the key
+// to carry on from, or nil once it reaches the end of the bucket.
+func (s *BoltStore) reencryptBatch(bucketName, from []byte, batch int) (int, []byte, error) {
+	count := 0
+	var next []byte
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		if b == nil {
+			return fmt.Errorf("Bucket '%s' does not exist", bucketName)
+		}
+
+		// collect them first, since we can't write to the bucket while iterating it
+		rewrite := map[string][]byte{}
+		c := b.Cursor()
+		k, v := c.Seek(from)
+		for seen := 0; k != nil && seen < batch; k, v = c.Next() {
+			seen++
+			if !needsReencrypting(v) {
+				continue
+			}
+
+			plain, errDecrypt := decryptValue(v)
+			if errDecrypt != nil {
+				return fmt.Errorf("%s: %v", k, errDecrypt)
+			}
+			raw, errEncrypt := encryptValue(plain)
+			if errEncrypt != nil {
+				return errEncrypt
+			}
+			rewrite[string(k)] = raw
+		}
+		if k != nil {
+			next = append([]byte{}, k...)
+		}
+
+		for key, raw := range rewrite {
+			if err := b.Put([]byte(key), raw); err != nil {
+				return err
+			}
+		}
+		count = len(rewrite)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return count, next, nil
+}
@@ -0,0 +1,242 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var testKeyA = strings.Repeat("a", 64)
+var testKeyB = strings.Repeat("b", 64)
+
+// useEncryptionKeys sets the keys as if they came from ENCRYPTION_KEY and ENCRYPTION_OLD_KEYS, until the test is done.
+func useEncryptionKeys(t *testing.T, current, old string) {
+	origKey, origKeys := encryptionKey, decryptionKeys
+	t.Cleanup(func() { encryptionKey, decryptionKeys = origKey, origKeys })
+
+	if err := setEncryptionKeys(current, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openEncryptedStore returns a BoltStore holding `n` pages, all encrypted with `key`.
+func openEncryptedStore(t *testing.T, key string, n int) *BoltStore {
+	useEncryptionKeys(t, key, "")
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "publish.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	for i := 0; i < n; i++ {
+		name := string(rune('a'+i)) + "-aaaaaaaa"
+		if err := store.CreatePage(testPage(name, "secret-"+name, "Secret Title")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestEncodePage(t *testing.T) {
+	page := testPage("first-aaaaaaaa", "secret", "Secret Title")
+
+	// without a key, pages are plain JSON as they always were
+	useEncryptionKeys(t, "", "")
+	raw, err := encodePage(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEncrypted(raw) || !bytes.Contains(raw, []byte("Secret Title")) {
+		t.Fatalf("expected plain JSON, got %q", raw)
+	}
+
+	useEncryptionKeys(t, testKeyA, "")
+	raw, err = encodePage(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(raw) || bytes.Contains(raw, []byte("Secret Title")) {
+		t.Fatalf("expected the page to be encrypted, got %q", raw)
+	}
+
+	decoded := Page{}
+	if err := decodePage(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != page.Name || decoded.Title != page.Title || !decoded.Inserted.Equal(page.Inserted) {
+		t.Fatalf("expected %#v, got %#v", page, decoded)
+	}
+
+	// and the plain JSON from before can still be read
+	plain, _ := json.Marshal(page)
+	if err := decodePage(plain, &decoded); err != nil || decoded.Title != page.Title {
+		t.Fatalf("reading a plain page: %v", err)
+	}
+}
+
+func TestDecodePageWithUnknownKey(t *testing.T) {
+	useEncryptionKeys(t, testKeyA, "")
+	raw, err := encodePage(testPage("first-aaaaaaaa", "secret", "First"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useEncryptionKeys(t, testKeyB, "")
+	if err := decodePage(raw, &Page{}); err != ErrUnknownEncryptionKey {
+		t.Fatalf("expected ErrUnknownEncryptionKey, got %v", err)
+	}
+}
+
+func TestDecodePageTampered(t *testing.T) {
+	useEncryptionKeys(t, testKeyA, "")
+	raw, err := encodePage(testPage("first-aaaaaaaa", "secret", "First"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the nonce is part of the header, then the ciphertext and its tag follow it
+	for _, i := range []int{1 + encryptionKeyIdSize, len(raw) - 20, len(raw) - 1} {
+		tampered := append([]byte{}, raw...)
+		tampered[i] ^= 0xff
+		if err := decodePage(tampered, &Page{}); err != ErrPageDecrypt {
+			t.Fatalf("byte %d: expected ErrPageDecrypt, got %v", i, err)
+		}
+	}
+
+	if err := decodePage(raw[:1+encryptionKeyIdSize+4], &Page{}); err != ErrPageDecrypt {
+		t.Fatalf("truncated: expected ErrPageDecrypt, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	store := openEncryptedStore(t, testKeyA, 3)
+
+	// with the new key, pages under the old one can still be read
+	useEncryptionKeys(t, testKeyB, testKeyA)
+	page, err := store.GetPage("a-aaaaaaaa")
+	if err != nil || page == nil || page.Title != "Secret Title" {
+		t.Fatalf("reading with the old key: %#v %v", page, err)
+	}
+
+	// and once they're re-encrypted, the old key isn't needed any more, which is the 3 pages plus the 'secret' and
+	// 'title' terms of each in the search index
+	count, err := store.Reencrypt(defaultReencryptBatch, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3+3*2 {
+		t.Fatalf("expected 3 pages and their 6 search entries to be re-encrypted, got %d", count)
+	}
+
+	useEncryptionKeys(t, testKeyB, "")
+	page, err = store.GetPage("c-aaaaaaaa")
+	if err != nil || page == nil || page.Title != "Secret Title" {
+		t.Fatalf("reading with the new key: %#v %v", page, err)
+	}
+}
+
+func TestReencryptStopsAndResumes(t *testing.T) {
+	store := openEncryptedStore(t, testKeyA, 5)
+	useEncryptionKeys(t, testKeyB, testKeyA)
+
+	// nothing happens once we've been told to stop
+	stop := make(chan struct{})
+	close(stop)
+	count, err := store.Reencrypt(2, stop)
+	if err != nil || count != 0 {
+		t.Fatalf("expected nothing to be re-encrypted, got %d (%v)", count, err)
+	}
+
+	// as if we'd stopped after the first batch
+	count, next, err := store.reencryptBatch(pageBucketName, []byte{}, 2)
+	if err != nil || count != 2 || next == nil {
+		t.Fatalf("first batch: %d %q %v", count, next, err)
+	}
+
+	// then starting again only rewrites the rest, along with the 2 search entries of each page
+	count, err = store.Reencrypt(2, nil)
+	if err != nil || count != 3+5*2 {
+		t.Fatalf("expected the other 3 pages and 10 search entries to be re-encrypted, got %d (%v)", count, err)
+	}
+	count, err = store.Reencrypt(2, nil)
+	if err != nil || count != 0 {
+		t.Fatalf("expected nothing left to re-encrypt, got %d (%v)", count, err)
+	}
+}
+
+func TestSearchIndexAndUploadsAreEncrypted(t *testing.T) {
+	store := openEncryptedStore(t, testKeyA, 0)
+
+	page := testPage("a-aaaaaaaa", "secret-a", "Secret Title")
+	page.Expires = time.Now().Add(time.Hour)
+	if err := store.CreatePage(page); err != nil {
+		t.Fatal(err)
+	}
+	png := testPng(10)
+	if err := store.PutUpload(uploadKey(png), png, page.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	// the terms and names are in the keys, but none of the values can be read without the key
+	err := store.db.View(func(tx *bolt.Tx) error {
+		for _, bucketName := range [][]byte{searchBucketName, uploadBucketName} {
+			err := tx.Bucket(bucketName).ForEach(func(k, v []byte) error {
+				if !isEncrypted(v) {
+					t.Errorf("'%s' %q isn't encrypted: %q", bucketName, k, v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and they can still be read with it, including after it has changed
+	useEncryptionKeys(t, testKeyB, testKeyA)
+	if _, err := store.Reencrypt(defaultReencryptBatch, nil); err != nil {
+		t.Fatal(err)
+	}
+	useEncryptionKeys(t, testKeyB, "")
+
+	found, _, err := store.LookupTerms([]string{"secret"}, time.Now())
+	if err != nil || found["secret"][page.Name] == nil {
+		t.Fatalf("expected to find the page, got %v (%v)", found, err)
+	}
+	found, _, err = store.LookupTerms([]string{"secret"}, time.Now().Add(2*time.Hour))
+	if err != nil || len(found["secret"]) != 0 {
+		t.Fatalf("expected the page to have expired, got %v (%v)", found, err)
+	}
+	if data, err := store.GetUpload(uploadKey(png)); err != nil || !bytes.Equal(data, png) {
+		t.Fatalf("expected the upload back, got %q (%v)", data, err)
+	}
+}
@@ -0,0 +1,130 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var ErrNoFrontMatter = errors.New("File does not start with '---' front matter")
+
+var frontMatterDelim = []byte("---\n")
+
+// frontMatter is the YAML header written at the top of a page's Markdown. The secret Id is never part of it.
+type frontMatter struct {
+	Title       string    `yaml:"title"`
+	Author      string    `yaml:"author,omitempty"`
+	Website     string    `yaml:"website,omitempty"`
+	Twitter     string    `yaml:"twitter,omitempty"`
+	Facebook    string    `yaml:"facebook,omitempty"`
+	GitHub      string    `yaml:"github,omitempty"`
+	Instagram   string    `yaml:"instagram,omitempty"`
+	Unpublished bool      `yaml:"unpublished,omitempty"`
+	Quarantined bool      `yaml:"quarantined,omitempty"`
+	Inserted    time.Time `yaml:"inserted"`
+	Updated     time.Time `yaml:"updated"`
+	Deleted     time.Time `yaml:"deleted,omitempty"`
+	Version     int64     `yaml:"version,omitempty"`
+	Expires     time.Time `yaml:"expires,omitempty"`
+}
+
+// encodeMarkdown writes out the page as YAML front matter followed by the Markdown content.
+func encodeMarkdown(page *Page) ([]byte, error) {
+	fm := frontMatter{
+		Title:       page.Title,
+		Author:      page.Author,
+		Website:     page.Website,
+		Twitter:     page.Twitter,
+		Facebook:    page.Facebook,
+		GitHub:      page.GitHub,
+		Instagram:   page.Instagram,
+		Unpublished: page.Unpublished,
+		Quarantined: page.Quarantined,
+		Inserted:    page.Inserted,
+		Updated:     page.Updated,
+		Deleted:     page.Deleted,
+		Version:     page.Version,
+		Expires:     page.Expires,
+	}
+
+	header, err := yaml.Marshal(fm)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	buf.Write(frontMatterDelim)
+	buf.Write(header)
+	buf.Write(frontMatterDelim)
+	buf.WriteString(page.Content)
+	return buf.Bytes(), nil
+}
+
+// decodeMarkdown reads the front matter and content back into a page. Neither the Name, Id nor Html are set.
+func decodeMarkdown(raw []byte) (*Page, error) {
+	// normalise line endings in case the file was edited somewhere which uses CRLF
+	raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+
+	if !bytes.HasPrefix(raw, frontMatterDelim) {
+		return nil, ErrNoFrontMatter
+	}
+	raw = raw[len(frontMatterDelim):]
+
+	// find the closing delimiter, which may be right at the start if the front matter is empty
+	var header, content []byte
+	if bytes.HasPrefix(raw, frontMatterDelim) {
+		content = raw[len(frontMatterDelim):]
+	} else {
+		end := bytes.Index(raw, append([]byte("\n"), frontMatterDelim...))
+		if end == -1 {
+			return nil, ErrNoFrontMatter
+		}
+		header = raw[:end+1]
+		content = raw[end+1+len(frontMatterDelim):]
+	}
+
+	fm := frontMatter{}
+	if err := yaml.Unmarshal(header, &fm); err != nil {
+		return nil, err
+	}
+
+	page := Page{
+		Title:       fm.Title,
+		Author:      fm.Author,
+		Website:     fm.Website,
+		Twitter:     fm.Twitter,
+		Facebook:    fm.Facebook,
+		GitHub:      fm.GitHub,
+		Instagram:   fm.Instagram,
+		Content:     string(content),
+		Unpublished: fm.Unpublished,
+		Quarantined: fm.Quarantined,
+		Inserted:    fm.Inserted,
+		Updated:     fm.Updated,
+		Deleted:     fm.Deleted,
+		Version:     fm.Version,
+		Expires:     fm.Expires,
+	}
+	return &page, nil
+}
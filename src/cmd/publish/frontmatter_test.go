@@ -0,0 +1,121 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMarkdownRoundTrip(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 6, time.UTC)
+	page := Page{
+		Title:       "Front: Matter",
+		Author:      "Someone",
+		Website:     "https://example.com",
+		Twitter:     "someone",
+		Facebook:    "someone",
+		GitHub:      "someone",
+		Instagram:   "someone",
+		Content:     "# Hello\n\n---\n\nA rule above, which isn't the end of the front matter.\n",
+		Unpublished: true,
+		Quarantined: true,
+		Inserted:    now,
+		Updated:     now.Add(time.Hour),
+		Version:     3,
+		Expires:     now.Add(24 * time.Hour),
+	}
+
+	raw, err := encodeMarkdown(&page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(raw), "---\ntitle: 'Front: Matter'\n") {
+		t.Fatalf("unexpected front matter:\n%s", raw)
+	}
+
+	decoded, err := decodeMarkdown(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Title != page.Title || decoded.Author != page.Author || decoded.Website != page.Website ||
+		decoded.Twitter != page.Twitter || decoded.Facebook != page.Facebook || decoded.GitHub != page.GitHub ||
+		decoded.Instagram != page.Instagram || decoded.Content != page.Content ||
+		decoded.Unpublished != page.Unpublished || decoded.Quarantined != page.Quarantined ||
+		!decoded.Inserted.Equal(page.Inserted) || !decoded.Updated.Equal(page.Updated) ||
+		!decoded.Deleted.IsZero() || decoded.Version != page.Version || !decoded.Expires.Equal(page.Expires) {
+		t.Fatalf("expected %#v, got %#v", page, decoded)
+	}
+
+	// files edited on Windows come back the same
+	decoded, err = decodeMarkdown([]byte(strings.Replace(string(raw), "\n", "\r\n", -1)))
+	if err != nil || decoded.Title != page.Title || decoded.Content != page.Content {
+		t.Fatalf("reading CRLF: %#v (%v)", decoded, err)
+	}
+}
+
+func TestDecodeMarkdown(t *testing.T) {
+	page, err := decodeMarkdown([]byte("---\n---\nJust content"))
+	if err != nil || page.Title != "" || page.Content != "Just content" {
+		t.Fatalf("empty front matter: %#v (%v)", page, err)
+	}
+
+	for _, raw := range []string{"", "# No front matter", "---\ntitle: Never closed\n"} {
+		if _, err := decodeMarkdown([]byte(raw)); err != ErrNoFrontMatter {
+			t.Errorf("%q: expected ErrNoFrontMatter, got %v", raw, err)
+		}
+	}
+}
+
+func TestFileStoreIsMarkdown(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pages")
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// the page is a Markdown file anyone can read, without its secret
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "first-aaaaaaaa.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(raw), "---\ntitle: First\n") || strings.Contains(string(raw), "secret-one") {
+		t.Fatalf("unexpected file:\n%s", raw)
+	}
+
+	// and everything is still there when it's opened again
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	page, err := store.GetPageUsingId("secret-one")
+	if err != nil || page == nil || page.Name != "first-aaaaaaaa" || page.Title != "First" || page.Html == "" {
+		t.Fatalf("unexpected page after reopening: %#v (%v)", page, err)
+	}
+}
@@ -0,0 +1,233 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// pages which can't be decoded are moved here by `publish fsck -repair`, rather than thrown away
+var lostBucketName = []byte("lost+found")
+
+type fsckProblem struct {
+	desc   string
+	repair func(tx *bolt.Tx) error // nil if it has to be fixed by hand
+}
+
+// shortId is enough of an Id to tell which one we mean, without filling the screen.
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[:12] + "..."
+	}
+	return id
+}
+
+// boltFsck checks that the 'page' and 'id' buckets agree with each other. The repairs are in the order they need to be
+// made, with Ids being removed before any are added.
+func boltFsck(tx *bolt.Tx) ([]fsckProblem, error) {
+	pageBucket := tx.Bucket(pageBucketName)
+	if pageBucket == nil {
+		panic(ErrFatalNoPageBucket)
+	}
+
+	idBucket := tx.Bucket(idBucketName)
+	if idBucket == nil {
+		panic(ErrFatalNoIdBucket)
+	}
+
+	problems := []fsckProblem{}
+	pages := map[string]Page{} // every page we could decode, by its key
+
+	err := pageBucket.ForEach(func(k, v []byte) error {
+		name := string(k)
+
+		page := Page{}
+		err := decodePage(v, &page)
+		if err == ErrUnknownEncryptionKey {
+			// it's not broken, we just can't read it, so don't "fix" it
+			return fmt.Errorf("page '%s': %v", name, err)
+		}
+		if err != nil {
+			raw := append([]byte{}, v...)
+			problems = append(problems, fsckProblem{
+				fmt.Sprintf("page '%s' can't be decoded: %v", name, err),
+				func(tx *bolt.Tx) error {
+					lostBucket, err := tx.CreateBucketIfNotExists(lostBucketName)
+					if err != nil {
+						return err
+					}
+					if err := lostBucket.Put([]byte(name), raw); err != nil {
+						return err
+					}
+					return tx.Bucket(pageBucketName).Delete([]byte(name))
+				},
+			})
+			return nil
+		}
+
+		// the key is what everything else uses, so it wins, and the indexes are moved over to it too
+		if page.Name != name {
+			misnamed := page
+			fixed := page
+			fixed.Name = name
+			problems = append(problems, fsckProblem{
+				fmt.Sprintf("page '%s' has the name '%s'", name, page.Name),
+				func(tx *bolt.Tx) error {
+					pageBucket := tx.Bucket(pageBucketName)
+
+					// unless another page has that name, in which case the entries are its own
+					if pageBucket.Get([]byte(misnamed.Name)) == nil {
+						if err := boltIndexPage(tx, &misnamed, false); err != nil {
+							return err
+						}
+						if err := boltSearchIndexPage(tx, &misnamed, false); err != nil {
+							return err
+						}
+					}
+
+					raw, err := encodePage(fixed)
+					if err != nil {
+						return err
+					}
+					if err := pageBucket.Put([]byte(name), raw); err != nil {
+						return err
+					}
+
+					if err := boltIndexPage(tx, &fixed, true); err != nil {
+						return err
+					}
+					return boltSearchIndexPage(tx, &fixed, true)
+				},
+			})
+			page = fixed
+		}
+
+		pages[name] = page
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// every Id must point at a page which has that Id
+	err = idBucket.ForEach(func(k, v []byte) error {
+		id := string(k)
+		name := string(v)
+
+		removeId := func(tx *bolt.Tx) error {
+			return tx.Bucket(idBucketName).Delete([]byte(id))
+		}
+
+		page, ok := pages[name]
+		if !ok {
+			problems = append(problems, fsckProblem{
+				fmt.Sprintf("Id '%s' points at page '%s', which doesn't exist", shortId(id), name),
+				removeId,
+			})
+		} else if page.Id != id {
+			problems = append(problems, fsckProblem{
+				fmt.Sprintf("Id '%s' points at page '%s', which has a different Id", shortId(id), name),
+				removeId,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// and every page with an Id must be pointed at by it
+	names := make([]string, 0, len(pages))
+	for name := range pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		page := pages[name]
+		if page.Id == "" {
+			continue
+		}
+
+		owner := idBucket.Get([]byte(page.Id))
+		if owner != nil && string(owner) != name && pages[string(owner)].Id == page.Id {
+			problems = append(problems, fsckProblem{
+				fmt.Sprintf("page '%s' has the same Id as page '%s'", name, string(owner)),
+				nil,
+			})
+			continue
+		}
+
+		if owner == nil || string(owner) != name {
+			problems = append(problems, fsckProblem{
+				fmt.Sprintf("page '%s' has an Id which doesn't point at it", name),
+				func(tx *bolt.Tx) error {
+					return tx.Bucket(idBucketName).Put([]byte(page.Id), []byte(name))
+				},
+			})
+		}
+	}
+
+	return problems, nil
+}
+
+// Fsck returns a description of every problem boltFsck() finds, and with `repair` fixes those it can (all in one
+// transaction), returning how many it fixed.
+func (s *BoltStore) Fsck(repair bool) ([]string, int, error) {
+	descs := []string{}
+	repaired := 0
+
+	check := func(tx *bolt.Tx) error {
+		problems, err := boltFsck(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, problem := range problems {
+			desc := problem.desc
+			if repair && problem.repair != nil {
+				if err := problem.repair(tx); err != nil {
+					return err
+				}
+				repaired++
+				desc += " (repaired)"
+			} else if repair {
+				desc += " (this needs fixing by hand)"
+			}
+			descs = append(descs, desc)
+		}
+		return nil
+	}
+
+	var err error
+	if repair {
+		err = s.db.Update(check)
+	} else {
+		err = s.db.View(check)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return descs, repaired, nil
+}
@@ -0,0 +1,163 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestFsck(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "publish.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+		t.Fatal(err)
+	}
+
+	other := testPage("other-aaaaaaaa", "secret-two", "Other")
+	other.Author = "Chilly"
+	if err := store.CreatePage(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// break it in every way we know about
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		pageBucket := tx.Bucket(pageBucketName)
+		idBucket := tx.Bucket(idBucketName)
+
+		// a page under the wrong key, whose Id isn't in the 'id' bucket
+		raw := pageBucket.Get([]byte("other-aaaaaaaa"))
+		if err := pageBucket.Put([]byte("moved-aaaaaaaa"), raw); err != nil {
+			return err
+		}
+		if err := pageBucket.Delete([]byte("other-aaaaaaaa")); err != nil {
+			return err
+		}
+		if err := idBucket.Delete([]byte("secret-two")); err != nil {
+			return err
+		}
+
+		// a page sharing another's Id, which only a person can sort out
+		raw, err := json.Marshal(testPage("copy-aaaaaaaa", "secret-one", "Copy"))
+		if err != nil {
+			return err
+		}
+		if err := pageBucket.Put([]byte("copy-aaaaaaaa"), raw); err != nil {
+			return err
+		}
+
+		if err := pageBucket.Put([]byte("broken-aaaaaaaa"), []byte("{not json")); err != nil {
+			return err
+		}
+		return idBucket.Put([]byte("secret-ghost"), []byte("ghost-aaaaaaaa"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, repaired, err := store.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 5 || repaired != 0 {
+		t.Fatalf("expected 5 problems and no repairs, got %d:\n%s", repaired, strings.Join(problems, "\n"))
+	}
+
+	problems, repaired, err = store.Fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 5 || repaired != 4 {
+		t.Fatalf("expected 4 of 5 problems to be repaired, got %d:\n%s", repaired, strings.Join(problems, "\n"))
+	}
+
+	// which leaves just the one for a person
+	problems, _, err = store.Fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "the same Id") {
+		t.Fatalf("expected only the shared Id to be left, got:\n%s", strings.Join(problems, "\n"))
+	}
+
+	page, err := store.GetPageUsingId("secret-two")
+	if err != nil || page == nil || page.Name != "moved-aaaaaaaa" {
+		t.Fatalf("the moved page wasn't repaired: %#v (%v)", page, err)
+	}
+	if page, err := store.GetPageUsingId("secret-ghost"); err != nil || page != nil {
+		t.Fatalf("the dangling Id is still there: %#v (%v)", page, err)
+	}
+
+	// the indexes have followed the moved page to its new name
+	moved := *page
+	other.Name = "other-aaaaaaaa"
+	err = store.db.View(func(tx *bolt.Tx) error {
+		inserted := tx.Bucket(insertedBucketName)
+		if inserted.Get(listPosition(&moved)) == nil || inserted.Get(listPosition(&other)) != nil {
+			t.Error("the 'inserted' index still has the old name")
+		}
+
+		author := tx.Bucket(authorBucketName)
+		prefix := authorIndexPrefix(normaliseAuthor(other.Author))
+		if author.Get(append(prefix, listPosition(&moved)...)) == nil || author.Get(append(prefix, listPosition(&other)...)) != nil {
+			t.Error("the 'author' index still has the old name")
+		}
+
+		search := tx.Bucket(searchBucketName)
+		if search.Get(searchKey("other", "moved-aaaaaaaa")) == nil || search.Get(searchKey("other", "other-aaaaaaaa")) != nil {
+			t.Error("the 'search' index still has the old name")
+		}
+
+		count, err := getIndexedCount(tx)
+		if err != nil {
+			return err
+		}
+		if count != 2 {
+			t.Errorf("expected 2 indexed pages, got %d", count)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and the broken page is kept out of the way, rather than thrown away
+	err = store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(pageBucketName).Get([]byte("broken-aaaaaaaa")) != nil {
+			t.Error("the broken page is still in the 'page' bucket")
+		}
+		lost := tx.Bucket(lostBucketName)
+		if lost == nil || string(lost.Get([]byte("broken-aaaaaaaa"))) != "{not json" {
+			t.Error("the broken page isn't in 'lost+found'")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
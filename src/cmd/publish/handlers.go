@@ -20,31 +20,37 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"time"
 
 	"github.com/Machiel/slugify"
-	"github.com/boltdb/bolt"
 	"github.com/russross/blackfriday"
 )
 
+// how many times createPage tries to find an unused name and Id before giving up
+const createAttempts = 5
+
+var ErrNoFreeName = errors.New("Could not find a free page name")
+
 var baseUrl string
 var tmpl *template.Template
 
 func init() {
 	baseUrl = os.Getenv("BASE_URL")
+}
 
+func loadTemplates() error {
 	tmpl1, err := template.New("").Delims("[[", "]]").ParseGlob("./templates/*.html")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	tmpl = tmpl1
+	return nil
 }
 
 func render(w http.ResponseWriter, templateName string, data interface{}) {
@@ -54,78 +60,184 @@ func render(w http.ResponseWriter, templateName string, data interface{}) {
 	}
 }
 
-func apiPut(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+// rendererVersion must go up whenever renderHtml() changes what it produces, so that `publish rerender` (or the page
+// being viewed) brings the stored HTML up to date.
+const rendererVersion = 1
+
+// renderHtml turns the page's Markdown into the HTML we serve.
+func renderHtml(content string) template.HTML {
+	return template.HTML(blackfriday.MarkdownCommon([]byte(content)))
+}
+
+// renderPage sets the page's Html from its Content, and records which version of the renderer did it.
+func renderPage(page *Page) {
+	page.Html = renderHtml(page.Content)
+	page.Renderer = rendererVersion
+}
+
+// createPage checks the fields the author chose and fills in everything else about a new page, then saves it under an
+// unused name and secret. Only the author gets the secret, which is returned, since we just keep its hash. Invalid
+// fields are returned as FieldErrors, while a page which looks like spam is saved but quarantined. The `honeypot` is
+// whatever was in the editor's hidden field.
+func createPage(store PageStore, page *Page, honeypot string) (string, error) {
+	// only keep what the author chooses, and check it
+	fields := *page
+	*page = Page{}
+	copyAuthorFields(page, fields)
+
+	now := clock()
+	if errs := validatePage(page, now); errs != nil {
+		return "", errs
+	}
+	slug := slugify.Slugify(page.Title)
+
+	sub := SpamSubmission{Page: page, Honeypot: honeypot}
+	checkSpam(sub)
+
+	// fill in the other fields to save this page
+	page.Inserted = now
+	page.Updated = now
+	page.Version = 1
+
+	// and create the HTML
+	renderPage(page)
+
+	// finally, pick a name and secret, trying again if either is already taken
+	var secret string
+	var errIns error
+	for i := 0; i < createAttempts; i++ {
+		secret = randStr(16)
+		page.Id = hashSecret(secret)
+		page.Name = slug + "-" + randStr(8)
+
+		errIns = store.CreatePage(*page)
+		if errIns != ErrPageNameExists && errIns != ErrPageIdExists {
+			break
+		}
+		log.Printf("Collision : %v\n", errIns)
+	}
+
+	if errIns == ErrPageNameExists || errIns == ErrPageIdExists {
+		return "", ErrNoFreeName
+	}
+	if errIns != nil {
+		return "", errIns
+	}
+
+	recordSpam(sub)
+	return secret, nil
+}
+
+// editPage copies the fields an author may change from `edit` to `page` once they're valid, and saves it as long as
+// nobody else has since the author loaded it at `edit.Version`, otherwise returning ErrVersionConflict. The caller
+// checks the secret. Just like createPage, the page is quarantined if it now looks like spam.
+func editPage(store PageStore, page *Page, edit Page, honeypot string) error {
+	// the editor must have started from the latest version, otherwise we'd lose whatever changed since
+	if edit.Version != page.Version {
+		return ErrVersionConflict
+	}
+
+	now := clock()
+	if errs := validatePage(&edit, now); errs != nil {
+		return errs
+	}
+
+	// we don't trust what else is in `edit`, but we know `page` is fine, so just update the author's fields and re-save
+	previous := *page
+	copyAuthorFields(page, edit)
+	sub := SpamSubmission{Page: page, Previous: &previous, Honeypot: honeypot}
+	checkSpam(sub)
+	page.Updated = now
+	page.Version = edit.Version + 1
+
+	// and finally, create the HTML
+	renderPage(page)
+
+	// someone else may have saved since we read it, in which case the store refuses
+	if err := store.UpdatePage(*page, edit.Version); err != nil {
+		return err
+	}
+
+	recordSpam(sub)
+	return nil
+}
+
+// editorRequest is what the editor sends to create or update a page, which is the page along with the honeypot.
+type editorRequest struct {
+	Page
+	Honeypot string `json:"email"`
+}
+
+func apiPut(store PageStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		page := Page{}
+		req := editorRequest{}
 
 		// parse the incoming JSON request
-		decoder := json.NewDecoder(r.Body)
-		errDecode := decoder.Decode(&page)
+		errDecode := decodePageRequest(r, &req)
+		if errDecode == ErrRequestTooLarge {
+			sendError(w, fmt.Sprintf("The page is too big, the content can be at most %d KB.", maxContentLength/1000))
+			return
+		}
 		if errDecode != nil {
 			log.Printf("Error: %v\n", errDecode)
 			sendError(w, "Invalid JSON")
 			return
 		}
-		defer r.Body.Close()
 
-		// check that the title has something in it (other than whitespace)
-		slug := slugify.Slugify(page.Title)
-		if slug == "" {
-			sendError(w, "Provide a title")
+		page := req.Page
+		secret, errCreate := createPage(store, &page, req.Honeypot)
+		if errs, ok := errCreate.(FieldErrors); ok {
+			sendFieldErrors(w, errs)
 			return
 		}
 
-		// fill in the other fields to save this page
-		now := time.Now()
-		page.Id = randStr(16)
-		page.Name = slug + "-" + randStr(8)
-		page.Inserted = now
-		page.Updated = now
-
-		// and finally, create the HTML
-		html := blackfriday.MarkdownCommon([]byte(page.Content))
-		page.Html = template.HTML(html)
+		if errCreate == ErrNoFreeName {
+			sendError(w, "Could not find a free page name. Please try again.")
+			return
+		}
 
-		errIns := storePutPage(db, page)
-		if errIns != nil {
-			http.Error(w, errIns.Error(), http.StatusInternalServerError)
+		if errCreate != nil {
+			http.Error(w, errCreate.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		data := struct {
-			Ok      bool              `json:"ok"`
-			Msg     string            `json:"msg"`
-			Payload map[string]string `json:"payload"`
+			Ok      bool                   `json:"ok"`
+			Msg     string                 `json:"msg"`
+			Payload map[string]interface{} `json:"payload"`
 		}{
 			Ok:      true,
 			Msg:     "Saved",
-			Payload: make(map[string]string),
+			Payload: make(map[string]interface{}),
 		}
-		data.Payload["id"] = page.Id
+		data.Payload["id"] = secret
 		data.Payload["name"] = page.Name
-
-		fmt.Printf("data=%#v\n", data)
+		data.Payload["version"] = page.Version
+		data.Payload["quarantined"] = page.Quarantined
 
 		sendJson(w, data)
 	}
 }
 
-func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func apiPost(store PageStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		page := Page{}
+		req := editorRequest{}
 
 		// parse the incoming JSON request
-		decoder := json.NewDecoder(r.Body)
-		errDecode := decoder.Decode(&page)
+		errDecode := decodePageRequest(r, &req)
+		if errDecode == ErrRequestTooLarge {
+			sendError(w, fmt.Sprintf("The page is too big, the content can be at most %d KB.", maxContentLength/1000))
+			return
+		}
 		if errDecode != nil {
 			log.Printf("Error: %v\n", errDecode)
 			sendError(w, "Invalid JSON")
 			return
 		}
-		defer r.Body.Close()
+		page := req.Page
 
 		// using the page.Name, retrieve this page then check it's Id is correct
-		existPage, errGet := storeGetPage(db, page.Name)
+		existPage, errGet := store.GetPage(page.Name)
 		if errGet != nil {
 			log.Printf("Error: %v\n", errGet)
 			sendError(w, "Internal Error. Please try again later.")
@@ -137,68 +249,76 @@ func apiPost(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// check that this page has this Id
-		if existPage.Id != page.Id {
+		if existPage.IsDeleted() {
+			sendError(w, "This page has been deleted.")
+			return
+		}
+
+		if existPage.IsExpired(clock()) {
+			sendError(w, "This page has expired.")
+			return
+		}
+
+		// check that this page has this secret
+		secret := requestSecret(w, r, page.Id)
+		if !secretMatches(existPage, secret) {
 			sendError(w, "Permission denied.")
 			return
 		}
 
-		// check that the title has something in it (other than whitespace)
-		slug := slugify.Slugify(page.Title)
-		if slug == "" {
-			sendError(w, "Provide a title")
+		errEdit := editPage(store, existPage, page, req.Honeypot)
+		if errEdit == ErrVersionConflict {
+			current, errCurrent := store.GetPage(page.Name)
+			if errCurrent != nil || current == nil || current.IsDeleted() {
+				sendError(w, "This page has been deleted.")
+				return
+			}
+			sendPageConflict(w, current, secret)
 			return
 		}
 
-		// We don't trust what is in `page`, but we know `existPage` is fine, so we'll just update a couple of fields
-		// there, then re-save.
-		now := time.Now()
-		existPage.Title = page.Title
-		existPage.Author = page.Author
-		existPage.Website = page.Website
-		existPage.Twitter = page.Twitter
-		existPage.Facebook = page.Facebook
-		existPage.GitHub = page.GitHub
-		existPage.Instagram = page.Instagram
-		existPage.Content = page.Content
-		existPage.Updated = now
-
-		// and finally, create the HTML
-		html := blackfriday.MarkdownCommon([]byte(page.Content))
-		existPage.Html = template.HTML(html)
-
-		errIns := storePutPage(db, *existPage)
-		if errIns != nil {
-			http.Error(w, errIns.Error(), http.StatusInternalServerError)
+		if errs, ok := errEdit.(FieldErrors); ok {
+			sendFieldErrors(w, errs)
+			return
+		}
+
+		if errEdit != nil {
+			http.Error(w, errEdit.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		data := struct {
-			Ok      bool              `json:"ok"`
-			Msg     string            `json:"msg"`
-			Payload map[string]string `json:"payload"`
+			Ok      bool                   `json:"ok"`
+			Msg     string                 `json:"msg"`
+			Payload map[string]interface{} `json:"payload"`
 		}{
 			Ok:      true,
 			Msg:     "Saved",
-			Payload: make(map[string]string),
+			Payload: make(map[string]interface{}),
 		}
-		data.Payload["id"] = page.Id
+		data.Payload["id"] = secret
 		data.Payload["name"] = page.Name
-
-		fmt.Printf("data=%#v\n", data)
+		data.Payload["version"] = existPage.Version
+		data.Payload["quarantined"] = existPage.Quarantined
 
 		sendJson(w, data)
 	}
 }
 
-func apiGet(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+// sendPageConflict tells the editor that the page has changed since they loaded it, giving them the current version
+// (with their secret rather than its hash) so that they can merge their changes into it.
+func sendPageConflict(w http.ResponseWriter, current *Page, secret string) {
+	current.Id = secret
+	sendConflict(w, "This page has been changed since you loaded it.", current)
+}
+
+func apiGet(store PageStore) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// get this Id from the incoming params
-		id := r.FormValue("id")
-		log.Printf("looking up id=%s\n", id)
+		// get the secret from the headers, or the incoming params
+		id := requestSecret(w, r, r.FormValue("id"))
 
 		// retrieve this page
-		page, errGet := storeGetPageUsingId(db, id)
+		page, errGet := getPageUsingSecret(store, id)
 		if errGet != nil {
 			log.Printf("Error: %v\n", errGet)
 			sendError(w, "Internal Error. Please try again later.")
@@ -210,6 +330,9 @@ func apiGet(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// give back the secret they gave us, rather than the hash we store
+		page.Id = id
+
 		data := struct {
 			Ok      bool   `json:"ok"`
 			Msg     string `json:"msg"`
@@ -224,10 +347,41 @@ func apiGet(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func apiHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
-	insPost := apiPut(db)
-	savePost := apiPost(db)
-	getPost := apiGet(db)
+func apiDelete(store PageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// get the secret from the headers, or the incoming params
+		id := requestSecret(w, r, r.FormValue("id"))
+
+		page, errGet := getPageUsingSecret(store, id)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		if page == nil {
+			sendError(w, "This page Id does not exist.")
+			return
+		}
+
+		errDel := store.DeletePage(page.Name, clock())
+		if errDel != nil {
+			http.Error(w, errDel.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		payload := map[string]string{
+			"name": page.Name,
+		}
+		sendPayload(w, "Deleted", payload)
+	}
+}
+
+func apiHandler(store PageStore, limits rateLimits) func(w http.ResponseWriter, r *http.Request) {
+	insPost := rateLimited(limits.create, apiPut(store))
+	savePost := rateLimited(limits.update, apiPost(store))
+	getPost := rateLimited(limits.fetch, apiGet(store))
+	delPost := rateLimited(limits.update, apiDelete(store))
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
@@ -251,26 +405,46 @@ func apiHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			getPost(w, r)
 			return
 		}
+
+		if r.Method == "DELETE" {
+			delPost(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func servePage(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
+func servePage(w http.ResponseWriter, r *http.Request, store PageStore, views *viewCounter) {
 	// everything else
 	name := r.URL.Path[1:]
 	log.Printf("Page=%q\n", html.EscapeString(name))
 
-	page, errPage := storeGetPage(db, name)
+	page, errPage := store.GetPage(name)
 	if errPage != nil {
 		http.Error(w, errPage.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if page == nil {
+	if page == nil || page.Unpublished || page.Quarantined {
 		log.Printf("Not Found : %s\n", name)
 		http.NotFoundHandler().ServeHTTP(w, r)
 		return
 	}
 
+	if page.IsDeleted() || page.IsExpired(clock()) {
+		log.Printf("Gone : %s\n", name)
+		http.Error(w, "410 page gone", http.StatusGone)
+		return
+	}
+
+	upgradeHtml(store, page)
+
+	if views != nil {
+		views.Record(r, page.Name)
+	}
+
 	// serve the page
 	data := struct {
 		Layout string
@@ -282,13 +456,17 @@ func servePage(w http.ResponseWriter, r *http.Request, db *bolt.DB) {
 	render(w, "page.html", data)
 }
 
-func sitemap(w http.ResponseWriter, r *http.Request, baseUrl string, db *bolt.DB) {
+func sitemap(w http.ResponseWriter, r *http.Request, baseUrl string, store PageStore) {
 	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprintf(w, baseUrl+"/\n")
+	fmt.Fprintf(w, "%s/\n", baseUrl)
 
 	// loop through all the pages
-	err := storeIteratePages(db, func(k, v []byte) error {
-		fmt.Fprintf(w, "%s/%s\n", baseUrl, string(k))
+	now := clock()
+	err := store.IteratePages(func(page *Page) error {
+		if !page.IsVisible() || page.IsExpired(now) {
+			return nil
+		}
+		fmt.Fprintf(w, "%s/%s\n", baseUrl, page.Name)
 		return nil
 	})
 
@@ -297,7 +475,7 @@ func sitemap(w http.ResponseWriter, r *http.Request, baseUrl string, db *bolt.DB
 	}
 }
 
-func homeHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
+func homeHandler(store PageStore, views *viewCounter) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		log.Printf("path=%s\n", path)
@@ -319,10 +497,10 @@ func homeHandler(db *bolt.DB) func(w http.ResponseWriter, r *http.Request) {
 			http.ServeFile(w, r, "static/robots.txt")
 
 		} else if path == "/sitemap.txt" {
-			sitemap(w, r, baseUrl, db)
+			sitemap(w, r, baseUrl, store)
 
 		} else {
-			servePage(w, r, db)
+			servePage(w, r, store, views)
 		}
 	}
 }
@@ -0,0 +1,205 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptRandStr makes randStr return each of `values` in turn, then restores it when the test is done.
+func scriptRandStr(t *testing.T, values ...string) {
+	orig := randStr
+	t.Cleanup(func() { randStr = orig })
+
+	randStr = func(n int) string {
+		if len(values) == 0 {
+			t.Fatal("randStr called too many times")
+		}
+		value := values[0]
+		values = values[1:]
+		return value
+	}
+}
+
+type testResponse struct {
+	Ok      bool                   `json:"ok"`
+	Msg     string                 `json:"msg"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+func putTestPage(t *testing.T, store PageStore, title string) testResponse {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/api", strings.NewReader(`{"title":"`+title+`"}`))
+	apiPut(store)(w, r)
+
+	resp := testResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+func TestCryptoRandStr(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		str := cryptoRandStr(16)
+		if len(str) != 16 {
+			t.Fatalf("expected 16 letters, got %q", str)
+		}
+		if strings.Trim(str, letterBytes) != "" {
+			t.Fatalf("expected only letters, got %q", str)
+		}
+		if seen[str] {
+			t.Fatalf("got %q twice", str)
+		}
+		seen[str] = true
+	}
+}
+
+func TestApiPutRetriesOnCollision(t *testing.T) {
+	store := NewMemoryStore()
+
+	// randStr is called for the secret, then the name suffix
+	scriptRandStr(t,
+		"secretAAAAAAAAAA", "nameAAAA", // the first page
+		"secretBBBBBBBBBB", "nameAAAA", // the name collides
+		"secretAAAAAAAAAA", "nameBBBB", // the secret collides
+		"secretCCCCCCCCCC", "nameCCCC", // all good
+	)
+
+	first := putTestPage(t, store, "Hello")
+	if !first.Ok || first.Payload["name"] != "hello-nameAAAA" || first.Payload["id"] != "secretAAAAAAAAAA" {
+		t.Fatalf("unexpected first response: %#v", first)
+	}
+
+	second := putTestPage(t, store, "Hello")
+	if !second.Ok || second.Payload["name"] != "hello-nameCCCC" || second.Payload["id"] != "secretCCCCCCCCCC" {
+		t.Fatalf("unexpected second response: %#v", second)
+	}
+
+	// and the first page still belongs to the first secret
+	page, err := getPageUsingSecret(store, "secretAAAAAAAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page == nil || page.Name != "hello-nameAAAA" {
+		t.Fatalf("first page was hijacked: %#v", page)
+	}
+}
+
+func TestApiPutGivesUpOnCollisions(t *testing.T) {
+	store := NewMemoryStore()
+
+	values := []string{"secretAAAAAAAAAA", "nameAAAA"}
+	for i := 0; i < createAttempts; i++ {
+		values = append(values, "secretBBBBBBBBBB", "nameAAAA")
+	}
+	scriptRandStr(t, values...)
+
+	putTestPage(t, store, "Hello")
+
+	resp := putTestPage(t, store, "Hello")
+	if resp.Ok {
+		t.Fatalf("expected the create to fail, got %#v", resp)
+	}
+
+	page, err := store.GetPage("hello-nameAAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page == nil || !secretMatches(page, "secretAAAAAAAAAA") {
+		t.Fatalf("first page was overwritten: %#v", page)
+	}
+}
+
+func TestApiPostStaleVersion(t *testing.T) {
+	store := NewMemoryStore()
+	put := putTestPage(t, store, "Hello")
+	name := put.Payload["name"].(string)
+	secret := put.Payload["id"].(string)
+
+	save := func(title string, version int) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"name":%q,"id":%q,"title":%q,"content":"Hi","version":%d}`, name, secret, title, version)
+		w := httptest.NewRecorder()
+		apiPost(store)(w, httptest.NewRequest("POST", "/api", strings.NewReader(body)))
+		return w
+	}
+
+	if w := save("First Edit", 1); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ok":true`) {
+		t.Fatalf("first edit: %d %s", w.Code, w.Body.String())
+	}
+
+	// a second editor who also loaded version 1 gets the page as it is now, with the secret they sent
+	w := save("Second Edit", 1)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d %s", w.Code, w.Body.String())
+	}
+	resp := struct {
+		Ok      bool
+		Payload Page
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Ok || resp.Payload.Title != "First Edit" || resp.Payload.Version != 2 || resp.Payload.Id != secret {
+		t.Fatalf("unexpected conflict %s", w.Body.String())
+	}
+
+	if page, _ := store.GetPage(name); page.Title != "First Edit" {
+		t.Fatalf("the stale edit was saved: %q", page.Title)
+	}
+}
+
+func TestApiDelete(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		put := putTestPage(t, store, "Deleted")
+		name := put.Payload["name"].(string)
+		if err := store.(ViewStore).AddViews(map[string]int64{name: 3}); err != nil {
+			t.Fatal(err)
+		}
+
+		deleted := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		fakeClock(t, deleted)
+		w := httptest.NewRecorder()
+		apiDelete(store)(w, httptest.NewRequest("DELETE", "/api?id="+put.Payload["id"].(string), nil))
+		if !strings.Contains(w.Body.String(), `"msg":"Deleted"`) {
+			t.Fatalf("unexpected response %s", w.Body.String())
+		}
+
+		page, err := store.GetPage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !page.Deleted.Equal(deleted) {
+			t.Fatalf("expected the page to be deleted at %v, got %v", deleted, page.Deleted)
+		}
+
+		// and its views go with it
+		if views, err := store.(ViewStore).GetViews(name); err != nil || views != 0 {
+			t.Fatalf("expected no views after deleting, got %d (%v)", views, err)
+		}
+	})
+}
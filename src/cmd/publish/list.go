@@ -0,0 +1,238 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+const defaultListLimit = 20
+const maxListLimit = 100
+
+// PageLister is implemented by stores which keep indexes of the visible pages by inserted time and by normalised
+// author, so that they can be listed newest first without reading every page. A cursor is the position of the last page
+// returned, and the next cursor is "" once there are no more pages. The `author` has been through normaliseAuthor().
+type PageLister interface {
+	ListNewestPages(cursor string, limit int) ([]*Page, string, error)
+	ListAuthorPages(author string, cursor string, limit int) ([]*Page, string, error)
+}
+
+// normaliseAuthor is the key authors are indexed under, so that "Andrew  Chilton" and "andrew chilton" are the same.
+// Control characters (including the zero byte we use as a separator) are dropped.
+func normaliseAuthor(author string) string {
+	author = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return unicode.ToLower(r)
+	}, author)
+	return strings.Join(strings.Fields(author), " ")
+}
+
+// listPosition is the inserted time (in nanoseconds) followed by the name, so that positions sort the same way as
+// pages do when listed, apart from being oldest first. It's also the tail of each key in the Bolt indexes.
+func listPosition(page *Page) []byte {
+	pos := make([]byte, 8+len(page.Name))
+	binary.BigEndian.PutUint64(pos, uint64(page.Inserted.UnixNano()))
+	copy(pos[8:], page.Name)
+	return pos
+}
+
+func encodeCursor(pos []byte) string {
+	return base64.RawURLEncoding.EncodeToString(pos)
+}
+
+// decodeCursor returns nil for the empty cursor, i.e. start from the newest page.
+func decodeCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	pos, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(pos) < 8 {
+		return nil, ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+func clampListLimit(limit int) int {
+	if limit <= 0 {
+		return defaultListLimit
+	}
+	if limit > maxListLimit {
+		return maxListLimit
+	}
+	return limit
+}
+
+// isListed is whether the page should be listed at `now`. Pages stay in the indexes until they are reaped, so expired
+// ones are left out here instead, which means a call can return fewer than `limit` pages even when there are more.
+func isListed(page *Page, now time.Time) bool {
+	return page.IsVisible() && !page.IsExpired(now)
+}
+
+// listedPages drops the pages which shouldn't be listed, keeping the cursor as it was.
+func listedPages(pages []*Page, next string, err error) ([]*Page, string, error) {
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := clock()
+	listed := []*Page{}
+	for _, page := range pages {
+		if isListed(page, now) {
+			listed = append(listed, page)
+		}
+	}
+	return listed, next, nil
+}
+
+// listNewestPages lists the visible pages, newest first, starting after `cursor`.
+func listNewestPages(store PageStore, cursor string, limit int) ([]*Page, string, error) {
+	if lister, ok := store.(PageLister); ok {
+		return listedPages(lister.ListNewestPages(cursor, clampListLimit(limit)))
+	}
+	return scanPages(store, "", cursor, clampListLimit(limit))
+}
+
+// listAuthorPages lists the visible pages by this author, newest first, starting after `cursor`.
+func listAuthorPages(store PageStore, author string, cursor string, limit int) ([]*Page, string, error) {
+	author = normaliseAuthor(author)
+	if author == "" {
+		return []*Page{}, "", nil
+	}
+
+	if lister, ok := store.(PageLister); ok {
+		return listedPages(lister.ListAuthorPages(author, cursor, clampListLimit(limit)))
+	}
+	return scanPages(store, author, cursor, clampListLimit(limit))
+}
+
+// scanPages is for stores without indexes, and reads every page to find the ones it wants.
+func scanPages(store PageStore, author string, cursor string, limit int) ([]*Page, string, error) {
+	before, errCursor := decodeCursor(cursor)
+	if errCursor != nil {
+		return nil, "", errCursor
+	}
+
+	now := clock()
+	pages := []*Page{}
+	err := store.IteratePages(func(page *Page) error {
+		if !isListed(page, now) {
+			return nil
+		}
+		if author != "" && normaliseAuthor(page.Author) != author {
+			return nil
+		}
+		if before != nil && string(listPosition(page)) >= string(before) {
+			return nil
+		}
+		pages = append(pages, page)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	sort.Slice(pages, func(i, j int) bool {
+		return string(listPosition(pages[i])) > string(listPosition(pages[j]))
+	})
+
+	return pageOfPages(pages, limit)
+}
+
+// pageOfPages takes the first `limit` pages, plus the cursor for the next lot if there are any more.
+func pageOfPages(pages []*Page, limit int) ([]*Page, string, error) {
+	if len(pages) <= limit {
+		return pages, "", nil
+	}
+	pages = pages[:limit]
+	return pages, encodeCursor(listPosition(pages[limit-1])), nil
+}
+
+type listedPageInfo struct {
+	Name     string    `json:"name"`
+	Title    string    `json:"title"`
+	Author   string    `json:"author"`
+	Url      string    `json:"url"`
+	Inserted time.Time `json:"inserted"`
+}
+
+// apiPages is GET /api/pages?cursor=...&limit=20, the newest pages first, or with `author=...` just theirs. The next
+// cursor is "" once there are no more.
+func apiPages(store PageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cursor := r.FormValue("cursor")
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+
+		var pages []*Page
+		var next string
+		var err error
+		if author := r.FormValue("author"); author != "" {
+			pages, next, err = listAuthorPages(store, author, cursor, limit)
+		} else {
+			pages, next, err = listNewestPages(store, cursor, limit)
+		}
+		if err == ErrInvalidCursor {
+			sendError(w, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		infos := make([]listedPageInfo, len(pages))
+		for i, page := range pages {
+			infos[i] = listedPageInfo{
+				Name:     page.Name,
+				Title:    page.Title,
+				Author:   page.Author,
+				Url:      baseUrl + "/" + page.Name,
+				Inserted: page.Inserted,
+			}
+		}
+
+		payload := struct {
+			Pages []listedPageInfo `json:"pages"`
+			Next  string           `json:"next"`
+		}{infos, next}
+
+		sendPayload(w, "", payload)
+	}
+}
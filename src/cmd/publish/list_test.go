@@ -0,0 +1,202 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// collectPages follows the cursors from the start, `limit` at a time, returning every name in order and how many calls
+// it took.
+func collectPages(t *testing.T, list func(cursor string) ([]*Page, string, error)) ([]string, int) {
+	names := []string{}
+	calls := 0
+	cursor := ""
+	for {
+		pages, next, err := list(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls++
+		for _, page := range pages {
+			names = append(names, page.Name)
+		}
+		if next == "" {
+			return names, calls
+		}
+		if calls > 10 {
+			t.Fatalf("too many calls, got %v so far", names)
+		}
+		cursor = next
+	}
+}
+
+func TestListPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		start := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		pages := []struct {
+			name    string
+			author  string
+			minutes int
+		}{
+			{"one-aaaaaaaa", "Andrew  Chilton", 1},
+			{"two-aaaaaaaa", "someone", 2},
+			{"three-aaaaaaaa", "andrew chilton", 3},
+			{"four-aaaaaaaa", "Andrew Chilton", 4},
+			{"four-bbbbbbbb", "someone", 4}, // at the same time, so the name decides
+			{"hidden-aaaaaaaa", "Andrew Chilton", 5},
+			{"deleted-aaaaaaaa", "Andrew Chilton", 6},
+		}
+		for _, p := range pages {
+			page := testPage(p.name, "secret-"+p.name, p.name)
+			page.Author = p.author
+			page.Inserted = start.Add(time.Duration(p.minutes) * time.Minute)
+			page.Updated = page.Inserted
+			page.Unpublished = p.name == "hidden-aaaaaaaa"
+			if err := store.CreatePage(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.DeletePage("deleted-aaaaaaaa", start.Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		// two at a time, so the cursor has to cross from one call to the next, including between the two at minute 4
+		names, calls := collectPages(t, func(cursor string) ([]*Page, string, error) {
+			return listNewestPages(store, cursor, 2)
+		})
+		expected := []string{"four-bbbbbbbb", "four-aaaaaaaa", "three-aaaaaaaa", "two-aaaaaaaa", "one-aaaaaaaa"}
+		if !reflect.DeepEqual(names, expected) || calls != 3 {
+			t.Fatalf("expected %v in 3 calls, got %v in %d", expected, names, calls)
+		}
+
+		names, calls = collectPages(t, func(cursor string) ([]*Page, string, error) {
+			return listAuthorPages(store, "ANDREW chilton ", cursor, 1)
+		})
+		expected = []string{"four-aaaaaaaa", "three-aaaaaaaa", "one-aaaaaaaa"}
+		if !reflect.DeepEqual(names, expected) || calls != 3 {
+			t.Fatalf("expected %v in 3 calls, got %v in %d", expected, names, calls)
+		}
+
+		if _, _, err := listNewestPages(store, "not a cursor!", 2); err != ErrInvalidCursor {
+			t.Fatalf("expected ErrInvalidCursor, got %v", err)
+		}
+	})
+}
+
+func TestListLeavesOutExpiredPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		start := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		pages := []Page{
+			testPage("kept-aaaaaaaa", "secret-kept", "Kept"),
+			expiringPage("gone-aaaaaaaa", "secret-gone", start.Add(time.Hour)),
+		}
+		for i := range pages {
+			pages[i].Author = "Andrew Chilton"
+			pages[i].Inserted = start.Add(time.Duration(i) * time.Minute)
+			if err := store.CreatePage(pages[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// it has expired, but hasn't been reaped yet
+		fakeClock(t, start.Add(2*time.Hour))
+
+		names, _ := collectPages(t, func(cursor string) ([]*Page, string, error) {
+			return listNewestPages(store, cursor, 10)
+		})
+		if !reflect.DeepEqual(names, []string{"kept-aaaaaaaa"}) {
+			t.Fatalf("expected just the page which hasn't expired, got %v", names)
+		}
+
+		names, _ = collectPages(t, func(cursor string) ([]*Page, string, error) {
+			return listAuthorPages(store, "andrew chilton", cursor, 10)
+		})
+		if !reflect.DeepEqual(names, []string{"kept-aaaaaaaa"}) {
+			t.Fatalf("expected just the page which hasn't expired, got %v", names)
+		}
+	})
+}
+
+func TestApiPages(t *testing.T) {
+	store := NewMemoryStore()
+	start := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, name := range []string{"one-aaaaaaaa", "two-aaaaaaaa", "three-aaaaaaaa"} {
+		page := testPage(name, "secret-"+name, name)
+		page.Author = "someone"
+		if name == "two-aaaaaaaa" {
+			page.Author = "Andrew Chilton"
+		}
+		page.Inserted = start.Add(time.Duration(i) * time.Minute)
+		if err := store.CreatePage(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type response struct {
+		Ok      bool   `json:"ok"`
+		Msg     string `json:"msg"`
+		Payload struct {
+			Pages []listedPageInfo `json:"pages"`
+			Next  string           `json:"next"`
+		} `json:"payload"`
+	}
+	get := func(query string) response {
+		t.Helper()
+		w := httptest.NewRecorder()
+		apiPages(store)(w, httptest.NewRequest("GET", "/api/pages"+query, nil))
+		out := response{}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	out := get("?limit=2")
+	if !out.Ok || len(out.Payload.Pages) != 2 || out.Payload.Pages[0].Name != "three-aaaaaaaa" || out.Payload.Next == "" {
+		t.Fatalf("expected the two newest pages and a cursor, got %#v", out)
+	}
+
+	out = get("?limit=2&cursor=" + out.Payload.Next)
+	if !out.Ok || len(out.Payload.Pages) != 1 || out.Payload.Pages[0].Name != "one-aaaaaaaa" || out.Payload.Next != "" {
+		t.Fatalf("expected the oldest page and no cursor, got %#v", out)
+	}
+
+	out = get("?author=andrew+chilton")
+	if !out.Ok || len(out.Payload.Pages) != 1 || out.Payload.Pages[0].Name != "two-aaaaaaaa" {
+		t.Fatalf("expected just the author's page, got %#v", out)
+	}
+
+	out = get("?cursor=not+a+cursor!")
+	if out.Ok || out.Msg != ErrInvalidCursor.Error() {
+		t.Fatalf("expected the cursor to be rejected, got %#v", out)
+	}
+
+	w := httptest.NewRecorder()
+	apiPages(store)(w, httptest.NewRequest("POST", "/api/pages", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Fatalf("expected 405 allowing GET, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,264 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrFatalNoMetaBucket = errors.New("Bucket 'meta' does not exist")
+
+// errDryRun rolls back the transaction once a dry run has seen what would change.
+var errDryRun = errors.New("Dry run")
+
+var metaBucketName = []byte("meta")
+var schemaVersionKey = []byte("schema-version")
+var indexedCountKey = []byte("indexed-count")
+
+// A migration brings the data in a BoltStore from `version - 1` up to `version`, returning how many records it changed.
+// Each one runs in its own transaction along with the bump of the schema version, so it either happens or it doesn't.
+type migration struct {
+	version int
+	desc    string
+	run     func(tx *bolt.Tx) (int, error)
+}
+
+// migrations must stay in order, and once released must never change what they do to the data. Add new ones to the end.
+// They read pages with decodePage(), which gives them the same JSON they were written for whether or not the page has
+// since been encrypted, and write them with encodePage() like everything else, so that doesn't count as a change.
+var migrations = []migration{
+	{1, "hash the secret Ids of pages and revisions", migrateHashSecrets},
+	{2, "index pages by inserted time and author", migrateIndexPages},
+	{3, "build the search index", boltRebuildSearchIndex},
+	{4, "count the indexed pages", migrateCountIndexedPages},
+	{5, "add expiry times to the search index", boltRebuildSearchIndex},
+}
+
+// latestSchemaVersion is the version a BoltStore is in once every migration has run.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func getSchemaVersion(tx *bolt.Tx) (int, error) {
+	metaBucket := tx.Bucket(metaBucketName)
+	if metaBucket == nil {
+		panic(ErrFatalNoMetaBucket)
+	}
+
+	raw := metaBucket.Get(schemaVersionKey)
+	if raw == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(raw))
+}
+
+func putSchemaVersion(tx *bolt.Tx, version int) error {
+	metaBucket := tx.Bucket(metaBucketName)
+	if metaBucket == nil {
+		panic(ErrFatalNoMetaBucket)
+	}
+
+	return metaBucket.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// Migrate runs every migration newer than the store's schema version. With `dryRun` each one is rolled back after
+// reporting what it would have changed.
+func (s *BoltStore) Migrate(dryRun bool) error {
+	var current int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		current, err = getSchemaVersion(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("Schema version %d is newer than this program knows about (%d)", current, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		var changed int
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			var err error
+			changed, err = m.run(tx)
+			if err != nil {
+				return err
+			}
+
+			if dryRun {
+				return errDryRun
+			}
+			return putSchemaVersion(tx, m.version)
+		})
+
+		if dryRun && err == errDryRun {
+			log.Printf("Migration %d (%s) would change %d records\n", m.version, m.desc, changed)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("Migration %d (%s) failed: %v", m.version, m.desc, err)
+		}
+		log.Printf("Migration %d (%s) changed %d records\n", m.version, m.desc, changed)
+	}
+
+	return nil
+}
+
+// migrateStore brings any store up to date. The BoltStore has versioned migrations, and the rest only ever need their
+// secrets hashed.
+func migrateStore(store PageStore, dryRun bool) error {
+	if boltStore, ok := store.(*BoltStore); ok {
+		return boltStore.Migrate(dryRun)
+	}
+
+	_, err := hashSecrets(store, dryRun)
+	return err
+}
+
+// hashBucketSecrets rewrites every JSON Page in the bucket which still has a raw secret Id, returning the raw and
+// hashed Ids of the ones it changed, and how many records it rewrote (which is more than the Ids for revisions, since
+// every revision of a page shares its Id).
+func hashBucketSecrets(b *bolt.Bucket) (map[string]string, int, error) {
+	// collect them first, since we can't write to the bucket while iterating it
+	pages := map[string]Page{}
+	err := b.ForEach(func(k, v []byte) error {
+		page := Page{}
+		if err := decodePage(v, &page); err != nil {
+			return err
+		}
+		if page.Id != "" && !isHashedSecret(page.Id) {
+			pages[string(k)] = page
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	hashed := map[string]string{}
+	count := 0
+	for k, page := range pages {
+		hash := hashSecret(page.Id)
+		hashed[page.Id] = hash
+		page.Id = hash
+
+		raw, errMarshal := encodePage(page)
+		if errMarshal != nil {
+			return nil, 0, errMarshal
+		}
+		if err := b.Put([]byte(k), raw); err != nil {
+			return nil, 0, err
+		}
+		count++
+	}
+
+	return hashed, count, nil
+}
+
+func migrateHashSecrets(tx *bolt.Tx) (int, error) {
+	if len(secretKey) == 0 {
+		return 0, ErrNoSecretKey
+	}
+
+	pageBucket := tx.Bucket(pageBucketName)
+	if pageBucket == nil {
+		panic(ErrFatalNoPageBucket)
+	}
+
+	idBucket := tx.Bucket(idBucketName)
+	if idBucket == nil {
+		panic(ErrFatalNoIdBucket)
+	}
+
+	revisionBucket := tx.Bucket(revisionBucketName)
+	if revisionBucket == nil {
+		panic(ErrFatalNoRevisionBucket)
+	}
+
+	hashed, pageCount, err := hashBucketSecrets(pageBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	// move each Id over to its hash
+	for id, hash := range hashed {
+		name := idBucket.Get([]byte(id))
+		if name == nil {
+			continue
+		}
+		if err := idBucket.Put([]byte(hash), name); err != nil {
+			return 0, err
+		}
+		if err := idBucket.Delete([]byte(id)); err != nil {
+			return 0, err
+		}
+	}
+
+	_, revisionCount, err := hashBucketSecrets(revisionBucket)
+	if err != nil {
+		return 0, err
+	}
+
+	return pageCount + revisionCount, nil
+}
+
+func migrateIndexPages(tx *bolt.Tx) (int, error) {
+	pageBucket := tx.Bucket(pageBucketName)
+	if pageBucket == nil {
+		panic(ErrFatalNoPageBucket)
+	}
+
+	count := 0
+	err := pageBucket.ForEach(func(k, v []byte) error {
+		page := Page{}
+		if err := decodePage(v, &page); err != nil {
+			return err
+		}
+		if !page.IsVisible() {
+			return nil
+		}
+
+		count++
+		return boltIndexPage(tx, &page, true)
+	})
+
+	return count, err
+}
+
+func migrateCountIndexedPages(tx *bolt.Tx) (int, error) {
+	insertedBucket := tx.Bucket(insertedBucketName)
+	if insertedBucket == nil {
+		panic(ErrFatalNoInsertedBucket)
+	}
+
+	return 1, putIndexedCount(tx, insertedBucket.Stats().KeyN)
+}
@@ -18,14 +18,19 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
+// how long to let requests finish once we've been asked to stop
+const shutdownTimeout = 10 * time.Second
+
 func check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -33,37 +38,144 @@ func check(err error) {
 }
 
 func main() {
-	// open the db
-	db, errOpen := bolt.Open("publish.db", 0600, &bolt.Options{Timeout: 1 * time.Second})
+	// the key for hashing secrets, which must never change
+	secretKey = []byte(os.Getenv("SECRET_KEY"))
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	trustedProxies = parseTrustProxy(os.Getenv("TRUST_PROXY"))
+	check(setEncryptionKeys(os.Getenv("ENCRYPTION_KEY"), os.Getenv("ENCRYPTION_OLD_KEYS")))
+
+	// if we've been given a command, run that instead of the server
+	if len(os.Args) > 1 {
+		check(runCommand(os.Args[1], os.Args[2:]))
+		return
+	}
+
+	if len(secretKey) == 0 {
+		check(ErrNoSecretKey)
+	}
+
+	check(loadTemplates())
+
+	// open the store, which is the BoltDB file 'publish.db' unless told otherwise
+	store, errOpen := openConfiguredStore()
 	check(errOpen)
-	defer db.Close()
+	defer store.Close()
 
-	errUpdate := db.Update(func(tx *bolt.Tx) error {
-		_, err1 := tx.CreateBucketIfNotExists(pageBucketName)
-		if err1 != nil {
-			return err1
-		}
+	// bring the data up to date before we serve anything
+	check(migrateStore(store, false))
+
+	// the background workers run until `stop` is closed
+	stop := make(chan struct{})
+	var workers sync.WaitGroup
+
+	// bring every page over to the current encryption key, while we carry on serving
+	if reencrypter, ok := store.(Reencrypter); ok && encryptionConfigured() {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			count, err := reencrypter.Reencrypt(defaultReencryptBatch, stop)
+			if err != nil {
+				log.Printf("Error: re-encrypting pages: %v\n", err)
+				return
+			}
+			if count > 0 {
+				log.Printf("Re-encrypted %d pages and revisions\n", count)
+			}
+		}()
+	} else if encryptionConfigured() {
+		log.Printf("Warning: only the 'bolt' store encrypts pages, so ENCRYPTION_KEY is ignored\n")
+	}
 
-		_, err2 := tx.CreateBucketIfNotExists(idBucketName)
-		if err2 != nil {
-			return err2
+	// count views, if the store can keep them
+	var views *viewCounter
+	if viewStore, ok := store.(ViewStore); ok {
+		views = newViewCounter(viewStore)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			views.Run(viewFlushInterval, stop)
+		}()
+	}
+
+	// throttle each client's use of the API, forgetting them once they've stopped
+	limits, errLimits := newRateLimits(os.Getenv("RATE_LIMIT_CREATE"), os.Getenv("RATE_LIMIT_UPDATE"), os.Getenv("RATE_LIMIT_FETCH"))
+	check(errLimits)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		limits.Run(rateLimitSweepInterval, stop)
+	}()
+
+	// and hold back anything which looks like spam until an operator has looked at it
+	filters, errFilters := newSpamFilters(os.Getenv("SPAM_BLOCKLIST"))
+	check(errFilters)
+	spamFilters = filters
+
+	// uploads go into the store if it can keep them, otherwise into a directory
+	uploads, ok := store.(UploadStore)
+	if !ok {
+		uploadPath := os.Getenv("UPLOAD_PATH")
+		if uploadPath == "" {
+			uploadPath = "uploads"
 		}
+		dirUploads, errUploads := NewDirUploadStore(uploadPath)
+		check(errUploads)
+		uploads = dirUploads
+	}
 
-		return nil
-	})
-	check(errUpdate)
+	// and delete pages once they expire, along with the uploads of any deleted page
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		newReaper(store, uploads).Run(reaperInterval, stop)
+	}()
 
 	// set up the static file server
 	static := http.FileServer(http.Dir("static"))
 
 	// use the default mux
-	http.HandleFunc("/api", apiHandler(db))
+	http.HandleFunc("/api", apiHandler(store, limits))
+	http.HandleFunc("/api/pages", rateLimited(limits.fetch, apiPages(store)))
+	http.HandleFunc("/api/revisions", revisionsHandler(store, limits))
+	http.HandleFunc("/api/search", rateLimited(limits.fetch, apiSearch(store)))
+	http.HandleFunc("/api/uploads", rateLimited(limits.update, apiUpload(store, uploads)))
+	http.HandleFunc(apiV1PagesPath, apiV1Handler(store, limits))
+	http.HandleFunc(apiV1OpenApiPath, apiV1OpenApi)
+	http.HandleFunc(apiV1PagesPath+"/", apiV1Handler(store, limits))
+	http.HandleFunc("/api/views", rateLimited(limits.fetch, apiViews(store, views)))
+	http.HandleFunc("/admin/backup", adminOnly(adminBackup(store)))
+	http.HandleFunc("/admin/quarantine", adminOnly(adminQuarantine(store)))
+	http.HandleFunc("/admin/ratelimits", adminOnly(adminRateLimits(limits)))
 	http.Handle("/s/", static)
-	http.HandleFunc("/", homeHandler(db))
+	http.HandleFunc("/search", rateLimited(limits.fetch, searchHandler(store)))
+	http.HandleFunc("/u/", serveUpload(uploads))
+	http.HandleFunc("/", homeHandler(store, views))
 
 	// the server
 	port := os.Getenv("PORT")
+	server := &http.Server{Addr: ":" + port}
+
+	// on SIGINT or SIGTERM, finish the requests we have then write out everything still in memory
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down ...\n", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error: %v\n", err)
+		}
+	}()
+
 	log.Printf("Listening on port %s ...\n", port)
-	errListen := http.ListenAndServe(":"+port, nil)
-	log.Fatal(errListen)
+	errListen := server.ListenAndServe()
+	if errListen != http.ErrServerClosed {
+		log.Fatal(errListen)
+	}
+
+	close(stop)
+	workers.Wait()
+	log.Printf("Stopped\n")
 }
@@ -0,0 +1,351 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the limits used unless RATE_LIMIT_CREATE, RATE_LIMIT_UPDATE or RATE_LIMIT_FETCH say otherwise
+const defaultCreateLimit = "20/h"
+const defaultUpdateLimit = "120/h"
+const defaultFetchLimit = "600/h"
+
+// each limiter stops remembering a client once it is back to a full bucket, and checks for them this often
+const rateLimitSweepInterval = time.Minute
+
+// each limiter remembers at most this many clients, forgetting one at random to make room for another
+const maxRateLimitClients = 100000
+
+// how many of the clients who have been turned away most are listed by /admin/ratelimits
+const rateLimitTopClients = 10
+
+var rateLimitPeriods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+}
+
+// tokenBucket is how many requests one client can make straight away, and when it last made one.
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	rejected int64
+}
+
+// rateLimiter gives each client address a bucket of `burst` tokens, which refills at `rate` tokens a second. Every
+// request takes a token, and is turned away if there aren't any left. A nil *rateLimiter lets everything through.
+type rateLimiter struct {
+	name  string
+	limit string
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	allowed  int64
+	rejected int64
+}
+
+// parseRateLimit reads a limit such as "20/h", which allows a burst of 20 requests and then one every 3 minutes. The
+// burst can be given separately, as in "20/h,5". The period is one of s, m, h or d, and "off" means there is no
+// limit, in which case it returns nil.
+func parseRateLimit(name, limit string) (*rateLimiter, error) {
+	if limit == "off" {
+		return nil, nil
+	}
+
+	spec, burstStr := limit, ""
+	hasBurst := false
+	if i := strings.Index(limit, ","); i >= 0 {
+		spec, burstStr, hasBurst = limit[:i], limit[i+1:], true
+	}
+
+	parts := strings.Split(spec, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid rate limit '%s' for %s, it should look like 20/h", limit, name)
+	}
+	count, errCount := strconv.Atoi(parts[0])
+	period, ok := rateLimitPeriods[parts[1]]
+	if errCount != nil || count < 1 || !ok {
+		return nil, fmt.Errorf("Invalid rate limit '%s' for %s, it should look like 20/h", limit, name)
+	}
+
+	burst := count
+	if hasBurst {
+		var errBurst error
+		burst, errBurst = strconv.Atoi(burstStr)
+		if errBurst != nil || burst < 1 {
+			return nil, fmt.Errorf("Invalid burst in rate limit '%s' for %s", limit, name)
+		}
+	}
+
+	return &rateLimiter{
+		name:    name,
+		limit:   limit,
+		rate:    float64(count) / period.Seconds(),
+		burst:   float64(burst),
+		now:     clock,
+		buckets: make(map[string]*tokenBucket),
+	}, nil
+}
+
+// Allow takes a token from the client's bucket, or says how long it will be until there is one.
+func (rl *rateLimiter) Allow(client string) (bool, time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	bucket, ok := rl.buckets[client]
+	if !ok {
+		if len(rl.buckets) >= maxRateLimitClients {
+			for other := range rl.buckets {
+				delete(rl.buckets, other)
+				break
+			}
+		}
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = bucket
+	}
+
+	bucket.tokens = rl.refill(bucket, now)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		rl.allowed++
+		return true, 0
+	}
+
+	// only log the first time, so that a client hammering away doesn't fill the log too
+	if bucket.rejected == 0 {
+		log.Printf("Rate Limited : %s from %s\n", rl.name, client)
+	}
+	bucket.rejected++
+	rl.rejected++
+
+	wait := time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// refill is how many tokens the bucket has by `now`, which must be called with the lock held.
+func (rl *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(rl.burst, bucket.tokens+elapsed*rl.rate)
+}
+
+// Sweep forgets every client whose bucket has filled up again, since a new one would be just the same.
+func (rl *rateLimiter) Sweep() {
+	if rl == nil {
+		return
+	}
+
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for client, bucket := range rl.buckets {
+		if rl.refill(bucket, now) >= rl.burst {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// allowRequest checks the request against the limit, and when it is over sets the Retry-After header and returns
+// false, leaving the caller to send the 429.
+func (rl *rateLimiter) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	ok, wait := rl.Allow(rateLimitKey(r))
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	return ok
+}
+
+// rateLimitKey is who the request is counted against. IPv6 clients are usually given a whole /64, so every address in
+// it counts as one.
+func rateLimitKey(r *http.Request) string {
+	addr := clientIP(r)
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return ip.String()
+}
+
+// rateLimitClient is one client which has had requests turned away, for /admin/ratelimits.
+type rateLimitClient struct {
+	Client   string `json:"client"`
+	Rejected int64  `json:"rejected"`
+}
+
+// rateLimitStats is what /admin/ratelimits reports for each limiter. Allowed and Rejected are counted since the server
+// started, while Top only covers the clients the limiter still remembers.
+type rateLimitStats struct {
+	Limit    string            `json:"limit"`
+	Clients  int               `json:"clients"`
+	Allowed  int64             `json:"allowed"`
+	Rejected int64             `json:"rejected"`
+	Top      []rateLimitClient `json:"top"`
+}
+
+// Stats reports how busy the limiter is, and who it has been turning away.
+func (rl *rateLimiter) Stats() rateLimitStats {
+	if rl == nil {
+		return rateLimitStats{Limit: "off", Top: []rateLimitClient{}}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	top := []rateLimitClient{}
+	for client, bucket := range rl.buckets {
+		if bucket.rejected > 0 {
+			top = append(top, rateLimitClient{client, bucket.rejected})
+		}
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Rejected != top[j].Rejected {
+			return top[i].Rejected > top[j].Rejected
+		}
+		return top[i].Client < top[j].Client
+	})
+	if len(top) > rateLimitTopClients {
+		top = top[:rateLimitTopClients]
+	}
+
+	return rateLimitStats{
+		Limit:    rl.limit,
+		Clients:  len(rl.buckets),
+		Allowed:  rl.allowed,
+		Rejected: rl.rejected,
+		Top:      top,
+	}
+}
+
+// rateLimits are the limits on creating, updating and fetching pages through the API. The zero value has no limits.
+type rateLimits struct {
+	create *rateLimiter
+	update *rateLimiter
+	fetch  *rateLimiter
+}
+
+// newRateLimits parses each of the limits, using the default for any which are empty.
+func newRateLimits(create, update, fetch string) (rateLimits, error) {
+	limits := rateLimits{}
+	specs := []struct {
+		limiter **rateLimiter
+		name    string
+		limit   string
+		def     string
+	}{
+		{&limits.create, "create", create, defaultCreateLimit},
+		{&limits.update, "update", update, defaultUpdateLimit},
+		{&limits.fetch, "fetch", fetch, defaultFetchLimit},
+	}
+
+	for _, spec := range specs {
+		if spec.limit == "" {
+			spec.limit = spec.def
+		}
+		limiter, err := parseRateLimit(spec.name, spec.limit)
+		if err != nil {
+			return rateLimits{}, err
+		}
+		*spec.limiter = limiter
+	}
+
+	return limits, nil
+}
+
+// Run sweeps every `interval` until `stop` is closed.
+func (limits rateLimits) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			limits.create.Sweep()
+			limits.update.Sweep()
+			limits.fetch.Sweep()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rateLimited turns the request away with a 429 if the client is over `limiter`'s limit, and otherwise calls `fn`.
+func rateLimited(limiter *rateLimiter, fn func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	if limiter == nil {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allowRequest(w, r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			sendError(w, "Too many requests. Please try again later.")
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// adminRateLimits reports on each of the limits, including the clients which have been turned away most.
+func adminRateLimits(limits rateLimits) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		sendJson(w, map[string]rateLimitStats{
+			"create": limits.create.Stats(),
+			"update": limits.update.Stats(),
+			"fetch":  limits.fetch.Stats(),
+		})
+	}
+}
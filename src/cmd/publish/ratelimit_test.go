@@ -0,0 +1,174 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		limit string
+		rate  float64
+		burst float64
+	}{
+		{"20/h", 20.0 / 3600, 20},
+		{"3/s", 3, 3},
+		{"120/m,10", 2, 10},
+		{"1/d", 1.0 / 86400, 1},
+	}
+	for _, test := range tests {
+		rl, err := parseRateLimit("test", test.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", test.limit, err)
+		}
+		if rl.rate != test.rate || rl.burst != test.burst {
+			t.Errorf("%s: got rate %v and burst %v", test.limit, rl.rate, rl.burst)
+		}
+	}
+
+	if rl, err := parseRateLimit("test", "off"); rl != nil || err != nil {
+		t.Errorf("off: got %v, %v", rl, err)
+	}
+
+	for _, limit := range []string{"20", "20/w", "0/h", "x/h", "20/h,0", "20/h,", "-1/s"} {
+		if _, err := parseRateLimit("test", limit); err == nil {
+			t.Errorf("%s: expected an error", limit)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := fakeClock(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	rl, _ := parseRateLimit("test", "6/m,3")
+
+	// the whole burst straight away, and then nothing
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	ok, wait := rl.Allow("a")
+	if ok || wait.Round(time.Millisecond) != 10*time.Second {
+		t.Fatalf("expected to wait 10s, got %v %v", ok, wait)
+	}
+
+	// other clients have their own bucket
+	if ok, _ := rl.Allow("b"); !ok {
+		t.Fatal("another client should be allowed")
+	}
+
+	// one token comes back every 10 seconds
+	*now = now.Add(4 * time.Second)
+	if ok, wait := rl.Allow("a"); ok || wait.Round(time.Millisecond) != 6*time.Second {
+		t.Fatalf("expected to wait 6s, got %v %v", ok, wait)
+	}
+	*now = now.Add(6 * time.Second)
+	if ok, _ := rl.Allow("a"); !ok {
+		t.Fatal("a token should have come back")
+	}
+
+	stats := rl.Stats()
+	if stats.Allowed != 5 || stats.Rejected != 2 || stats.Clients != 2 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if len(stats.Top) != 1 || stats.Top[0].Client != "a" || stats.Top[0].Rejected != 2 {
+		t.Fatalf("unexpected top clients: %#v", stats.Top)
+	}
+
+	// once a bucket is full again the client is forgotten, but the totals are kept
+	*now = now.Add(20 * time.Second)
+	rl.Sweep()
+	stats = rl.Stats()
+	if stats.Clients != 1 || stats.Rejected != 2 {
+		t.Fatalf("unexpected stats after sweeping: %#v", stats)
+	}
+	*now = now.Add(10 * time.Second)
+	rl.Sweep()
+	if stats := rl.Stats(); stats.Clients != 0 || len(stats.Top) != 0 {
+		t.Fatalf("unexpected stats after sweeping again: %#v", stats)
+	}
+
+	// a nil limiter lets everything through
+	var none *rateLimiter
+	if ok, _ := none.Allow("a"); !ok {
+		t.Fatal("a nil limiter should allow everything")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api", nil)
+	r.RemoteAddr = "[2001:db8:1:2:3:4:5:6]:1234"
+	if key := rateLimitKey(r); key != "2001:db8:1:2::/64" {
+		t.Errorf("unexpected key for an IPv6 client: %s", key)
+	}
+}
+
+func TestApiRateLimited(t *testing.T) {
+	fakeClock(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	limits, err := newRateLimits("2/h", "off", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	handler := apiHandler(store, limits)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("PUT", "/api", strings.NewReader(`{"title":"Hello"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("create %d: %d %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/api", strings.NewReader(`{"title":"Hello"}`)))
+	resp := testResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusTooManyRequests || resp.Ok || w.Header().Get("Retry-After") != "1800" {
+		t.Fatalf("expected a 429, got %d %s (Retry-After %q)", w.Code, w.Body.String(), w.Header().Get("Retry-After"))
+	}
+
+	// /api/v1 shares the same limits
+	apiErr := testApiError{}
+	w = httptest.NewRecorder()
+	apiV1Handler(store, limits)(w, httptest.NewRequest("POST", "/api/v1/pages", strings.NewReader(`{"title":"Hello"}`)))
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusTooManyRequests || apiErr.Error.Code != errCodeRateLimited || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a 429, got %d %s", w.Code, w.Body.String())
+	}
+
+	stats := limits.create.Stats()
+	if stats.Allowed != 2 || stats.Rejected != 2 {
+		t.Fatalf("unexpected stats: %#v", stats)
+	}
+	if limits.update != nil || limits.fetch.limit != defaultFetchLimit {
+		t.Fatalf("unexpected limits: %#v", limits)
+	}
+}
@@ -0,0 +1,138 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// how often the reaper looks for expired pages
+const reaperInterval = time.Minute
+
+// reaper deletes pages once their expiry time has passed, which removes their Id and leaves a tombstone just like an
+// author deleting it would. It also deletes the uploads of every deleted page, however it was deleted, unless they are
+// in another page too.
+type reaper struct {
+	store   PageStore
+	uploads UploadStore // nil if there's nothing to clear up
+	now     func() time.Time
+}
+
+func newReaper(store PageStore, uploads UploadStore) *reaper {
+	return &reaper{
+		store:   store,
+		uploads: uploads,
+		now:     clock,
+	}
+}
+
+// Reap deletes every page which has expired, returning how many there were.
+func (rp *reaper) Reap() (int, error) {
+	now := rp.now()
+
+	// find them first, since we can't write while iterating
+	names := []string{}
+	err := rp.store.IteratePages(func(page *Page) error {
+		if !page.IsDeleted() && page.IsExpired(now) {
+			names = append(names, page.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range names {
+		// the author may have moved the expiry time since we looked, which the store checks as it deletes
+		deleted, err := rp.store.DeletePageIfExpired(name, now)
+		if err != nil {
+			return count, err
+		}
+		if deleted {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// DeleteUploads deletes the uploads which were only in pages which have since been deleted, returning how many.
+func (rp *reaper) DeleteUploads() (int, error) {
+	if rp.uploads == nil {
+		return 0, nil
+	}
+
+	names, err := rp.uploads.UploadPages()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, name := range names {
+		page, err := rp.store.GetPage(name)
+		if err != nil {
+			return count, err
+		}
+		if page != nil && !page.IsDeleted() {
+			continue
+		}
+
+		deleted, err := rp.uploads.DeleteUploads(name)
+		if err != nil {
+			return count, err
+		}
+		count += deleted
+	}
+
+	return count, nil
+}
+
+// Run reaps straight away and then every `interval` until `stop` is closed. A reap which has started is always
+// finished before it returns.
+func (rp *reaper) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		count, err := rp.Reap()
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+		}
+		if count > 0 {
+			log.Printf("Reaped %d expired pages\n", count)
+		}
+
+		deleted, err := rp.DeleteUploads()
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d uploads of deleted pages\n", deleted)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
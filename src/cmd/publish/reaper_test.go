@@ -0,0 +1,238 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock makes clock() return whatever `now` is set to, until the test is done.
+func fakeClock(t *testing.T, start time.Time) *time.Time {
+	now := start
+	orig := clock
+	t.Cleanup(func() { clock = orig })
+
+	clock = func() time.Time { return now }
+	return &now
+}
+
+func expiringPage(name, id string, expires time.Time) Page {
+	page := testPage(name, id, "Notice")
+	page.Expires = expires
+	return page
+}
+
+func TestReaperDeletesExpiredPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		now := fakeClock(t, start)
+		rp := newReaper(store, nil)
+
+		pages := []Page{
+			testPage("forever-aaaaaaaa", "secret-forever", "Forever"),
+			expiringPage("soon-bbbbbbbb", "secret-soon", start.Add(time.Hour)),
+			expiringPage("later-cccccccc", "secret-later", start.Add(2*time.Hour)),
+		}
+		for _, page := range pages {
+			if err := store.PutPage(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reap := func(expected int) {
+			t.Helper()
+			count, err := rp.Reap()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != expected {
+				t.Fatalf("at %s expected to reap %d pages, reaped %d", (*now).Format(time.Kitchen), expected, count)
+			}
+		}
+
+		// nothing has expired yet
+		reap(0)
+
+		// exactly on the expiry time counts as expired
+		*now = start.Add(time.Hour)
+		reap(1)
+
+		page, err := store.GetPage("soon-bbbbbbbb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page == nil || !page.IsDeleted() || !page.Deleted.Equal(start.Add(time.Hour)) {
+			t.Fatalf("expected a tombstone deleted at the expiry time, got %#v", page)
+		}
+
+		page, err = store.GetPageUsingId("secret-soon")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page != nil {
+			t.Fatalf("the Id of an expired page should be gone: %#v", page)
+		}
+
+		// tombstones aren't reaped again
+		reap(0)
+
+		*now = start.Add(3 * time.Hour)
+		reap(1)
+
+		page, err = store.GetPage("forever-aaaaaaaa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page == nil || page.IsDeleted() {
+			t.Fatalf("a page without an expiry time should never be reaped: %#v", page)
+		}
+	})
+}
+
+// editedAfterScan runs `edit` once the reaper has finished scanning, just before it deletes anything.
+type editedAfterScan struct {
+	PageStore
+	edit func()
+}
+
+func (s editedAfterScan) IteratePages(fn func(page *Page) error) error {
+	if err := s.PageStore.IteratePages(fn); err != nil {
+		return err
+	}
+	s.edit()
+	return nil
+}
+
+func TestReaperKeepsPagesExtendedAfterTheScan(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+		fakeClock(t, start.Add(time.Hour))
+
+		page := expiringPage("soon-bbbbbbbb", "secret-soon", start.Add(time.Hour))
+		if err := store.PutPage(page); err != nil {
+			t.Fatal(err)
+		}
+
+		rp := newReaper(editedAfterScan{store, func() {
+			page.Expires = start.Add(2 * time.Hour)
+			if err := store.PutPage(page); err != nil {
+				t.Fatal(err)
+			}
+		}}, nil)
+
+		count, err := rp.Reap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Fatalf("expected to reap nothing, reaped %d", count)
+		}
+
+		got, err := store.GetPage("soon-bbbbbbbb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == nil || got.IsDeleted() || !got.Expires.Equal(start.Add(2*time.Hour)) {
+			t.Fatalf("a page extended after the scan should be kept: %#v", got)
+		}
+	})
+}
+
+func TestReaperRunStops(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeClock(t, start.Add(time.Hour))
+
+	store := NewMemoryStore()
+	if err := store.PutPage(expiringPage("soon-bbbbbbbb", "secret-soon", start)); err != nil {
+		t.Fatal(err)
+	}
+
+	// it reaps as soon as it starts, and still returns once stopped however long the interval
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		newReaper(store, nil).Run(time.Hour, stop)
+		close(done)
+	}()
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after stop was closed")
+	}
+
+	page, err := store.GetPage("soon-bbbbbbbb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page == nil || !page.IsDeleted() {
+		t.Fatalf("expected the page to have been reaped before Run returned: %#v", page)
+	}
+}
+
+func TestExpiredPagesAreGone(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := fakeClock(t, start)
+
+	store := NewMemoryStore()
+	if err := store.PutPage(expiringPage("soon-bbbbbbbb", "secret-soon", start.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	inSitemap := func() bool {
+		w := httptest.NewRecorder()
+		sitemap(w, httptest.NewRequest("GET", "/sitemap.txt", nil), "", store)
+		return strings.Contains(w.Body.String(), "/soon-bbbbbbbb\n")
+	}
+
+	if !inSitemap() {
+		t.Fatal("a page which hasn't expired yet should be in the sitemap")
+	}
+
+	// once it has expired it's gone, even before the reaper gets to it
+	*now = start.Add(time.Hour)
+	if inSitemap() {
+		t.Fatal("an expired page should not be in the sitemap")
+	}
+
+	w := httptest.NewRecorder()
+	servePage(w, httptest.NewRequest("GET", "/soon-bbbbbbbb", nil), store, nil)
+	if w.Code != http.StatusGone {
+		t.Fatalf("expected %d for an expired page, got %d", http.StatusGone, w.Code)
+	}
+}
+
+func TestApiPutRejectsPastExpiry(t *testing.T) {
+	fakeClock(t, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	store := NewMemoryStore()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/api", strings.NewReader(`{"title":"Notice","expires":"2020-01-01T11:00:00Z"}`))
+	apiPut(store)(w, r)
+
+	if !strings.Contains(w.Body.String(), "The expiry time must be in the future") {
+		t.Fatalf("expected an error for an expiry time in the past, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,134 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+const defaultRerenderBatch = 100
+
+// needsRerender is true if the page has HTML which an older renderer made. Tombstones have no HTML to redo.
+func needsRerender(page *Page) bool {
+	return !page.IsDeleted() && page.Renderer < rendererVersion
+}
+
+// rerenderPages regenerates the Html of every page which needs it, `batch` pages to a transaction, calling `progress`
+// after each batch. It returns how many pages it changed.
+func rerenderPages(store PageStore, batch int, progress func(done, total int)) (int, error) {
+	// find them first, since we can't write while iterating
+	names := []string{}
+	err := store.IteratePages(func(page *Page) error {
+		if needsRerender(page) {
+			names = append(names, page.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for start := 0; start < len(names); start += batch {
+		end := start + batch
+		if end > len(names) {
+			end = len(names)
+		}
+
+		// check again inside the transaction, since the page may have been saved since
+		err := updatePages(store, names[start:end], func(page *Page) bool {
+			if !needsRerender(page) {
+				return false
+			}
+			renderPage(page)
+			count++
+			return true
+		})
+		if err != nil {
+			return count, err
+		}
+
+		progress(end, len(names))
+	}
+
+	return count, nil
+}
+
+// updatePages uses the store's BatchUpdater if it has one, otherwise saving each page on its own with UpdatePage() so
+// that we never overwrite a newer version.
+func updatePages(store PageStore, names []string, fn func(page *Page) bool) error {
+	if updater, ok := store.(BatchUpdater); ok {
+		return updater.UpdatePages(names, fn)
+	}
+
+	for _, name := range names {
+		page, err := store.GetPage(name)
+		if err != nil {
+			return err
+		}
+		if page == nil || !fn(page) {
+			continue
+		}
+
+		err = store.UpdatePage(*page, page.Version)
+		if err != nil && err != ErrVersionConflict {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upgradeHtml re-renders a page being viewed if an older renderer made its HTML, saving it for next time.
+func upgradeHtml(store PageStore, page *Page) {
+	if !needsRerender(page) {
+		return
+	}
+
+	renderPage(page)
+	if err := store.UpdatePage(*page, page.Version); err != nil && err != ErrVersionConflict {
+		log.Printf("Error: %v\n", err)
+	}
+}
+
+func cmdRerender(args []string) error {
+	flags := flag.NewFlagSet("rerender", flag.ContinueOnError)
+	batch := flags.Int("batch", defaultRerenderBatch, "how many pages to save in each transaction")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *batch < 1 {
+		return errUsage
+	}
+
+	store, errOpen := openConfiguredStore()
+	if errOpen != nil {
+		return errOpen
+	}
+	defer store.Close()
+
+	count, err := rerenderPages(store, *batch, func(done, total int) {
+		log.Printf("Rerendered %d of %d pages\n", done, total)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Rerendered %d pages with renderer version %d\n", count, rendererVersion)
+	return nil
+}
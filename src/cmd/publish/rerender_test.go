@@ -0,0 +1,97 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRerenderPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		// pages rendered by an older renderer, which the fs store never keeps since it renders as it reads
+		for _, name := range []string{"one-aaaaaaaa", "two-aaaaaaaa", "three-aaaaaaaa", "deleted-aaaaaaaa"} {
+			page := testPage(name, "secret-"+name, "Fresh")
+			page.Html = "<p>Stale</p>"
+			page.Renderer = rendererVersion - 1
+			if err := store.CreatePage(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.DeletePage("deleted-aaaaaaaa", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		expected := 3
+		if _, ok := store.(*FileStore); ok {
+			expected = 0
+		}
+
+		progress := [][2]int{}
+		count, err := rerenderPages(store, 2, func(done, total int) {
+			progress = append(progress, [2]int{done, total})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Fatalf("expected %d pages to be rerendered, got %d", expected, count)
+		}
+		if expected > 0 && !reflect.DeepEqual(progress, [][2]int{{2, 3}, {3, 3}}) {
+			t.Fatalf("unexpected progress %v", progress)
+		}
+
+		for _, name := range []string{"one-aaaaaaaa", "two-aaaaaaaa", "three-aaaaaaaa"} {
+			page, err := store.GetPage(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Html != renderHtml("Fresh") || page.Renderer != rendererVersion {
+				t.Fatalf("%s wasn't rerendered: %q (%d)", name, page.Html, page.Renderer)
+			}
+		}
+
+		// and there's nothing left to do
+		if count, err := rerenderPages(store, 2, func(done, total int) {}); err != nil || count != 0 {
+			t.Fatalf("expected nothing more to rerender, got %d (%v)", count, err)
+		}
+	})
+}
+
+func TestUpgradeHtml(t *testing.T) {
+	store := NewMemoryStore()
+	page := testPage("first-aaaaaaaa", "secret-one", "Fresh")
+	page.Html = "<p>Stale</p>"
+	if err := store.CreatePage(page); err != nil {
+		t.Fatal(err)
+	}
+
+	// viewing the page brings it up to date, and saves it without changing its version
+	viewed, _ := store.GetPage("first-aaaaaaaa")
+	upgradeHtml(store, viewed)
+	if viewed.Html != renderHtml("Fresh") {
+		t.Fatalf("the page being viewed wasn't rerendered: %q", viewed.Html)
+	}
+
+	saved, _ := store.GetPage("first-aaaaaaaa")
+	if saved.Html != renderHtml("Fresh") || saved.Renderer != rendererVersion || saved.Version != page.Version {
+		t.Fatalf("the rerendered page wasn't saved: %#v", saved)
+	}
+}
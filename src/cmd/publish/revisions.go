@@ -0,0 +1,239 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type revisionInfo struct {
+	Rev     int64     `json:"rev,string"` // a string, since JavaScript can't hold nanoseconds in a number
+	Title   string    `json:"title"`
+	Updated time.Time `json:"updated"`
+	Current bool      `json:"current"`
+}
+
+// findRevision returns the current page if `rev` is empty or matches it, otherwise the old revision (or nil).
+func findRevision(revStore RevisionStore, current *Page, rev string) (*Page, error) {
+	if rev == "" {
+		return current, nil
+	}
+
+	n, errParse := strconv.ParseInt(rev, 10, 64)
+	if errParse != nil {
+		return nil, nil
+	}
+
+	if n == revisionOf(current) {
+		return current, nil
+	}
+
+	return revStore.GetRevision(current.Name, n)
+}
+
+func apiRevisionsGet(store PageStore, revStore RevisionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, errGet := getPageUsingSecret(store, requestSecret(w, r, r.FormValue("id")))
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		if page == nil {
+			sendError(w, "This page Id does not exist.")
+			return
+		}
+
+		// a diff between two revisions, where 'to' defaults to the current page
+		if r.FormValue("from") != "" {
+			from, errFrom := findRevision(revStore, page, r.FormValue("from"))
+			to, errTo := findRevision(revStore, page, r.FormValue("to"))
+			if errFrom != nil || errTo != nil {
+				log.Printf("Error: %v %v\n", errFrom, errTo)
+				sendError(w, "Internal Error. Please try again later.")
+				return
+			}
+			if from == nil || to == nil {
+				sendError(w, "This revision does not exist.")
+				return
+			}
+
+			diff := struct {
+				From  int64      `json:"from,string"`
+				To    int64      `json:"to,string"`
+				Lines []DiffLine `json:"lines"`
+			}{
+				From:  revisionOf(from),
+				To:    revisionOf(to),
+				Lines: diffLines(from.Content, to.Content),
+			}
+			sendPayload(w, "Diff", diff)
+			return
+		}
+
+		// just the one revision
+		if r.FormValue("rev") != "" {
+			rev, errRev := findRevision(revStore, page, r.FormValue("rev"))
+			if errRev != nil {
+				log.Printf("Error: %v\n", errRev)
+				sendError(w, "Internal Error. Please try again later.")
+				return
+			}
+			if rev == nil {
+				sendError(w, "This revision does not exist.")
+				return
+			}
+
+			rev.Id = ""
+			sendPayload(w, "Revision", rev)
+			return
+		}
+
+		// otherwise, list them all
+		revisions, errList := revStore.ListRevisions(page.Name)
+		if errList != nil {
+			log.Printf("Error: %v\n", errList)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		infos := []revisionInfo{{revisionOf(page), page.Title, page.Updated, true}}
+		for _, rev := range revisions {
+			infos = append(infos, revisionInfo{revisionOf(rev), rev.Title, rev.Updated, false})
+		}
+
+		sendPayload(w, "Revisions", infos)
+	}
+}
+
+func apiRevisionsRestore(store PageStore, revStore RevisionStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Id  string `json:"id"`
+			Rev string `json:"rev"`
+		}{}
+
+		// parse the incoming JSON request
+		decoder := json.NewDecoder(r.Body)
+		errDecode := decoder.Decode(&req)
+		if errDecode != nil {
+			log.Printf("Error: %v\n", errDecode)
+			sendError(w, "Invalid JSON")
+			return
+		}
+		defer r.Body.Close()
+
+		secret := requestSecret(w, r, req.Id)
+		page, errGet := getPageUsingSecret(store, secret)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		if page == nil {
+			sendError(w, "This page Id does not exist.")
+			return
+		}
+
+		rev, errRev := findRevision(revStore, page, req.Rev)
+		if errRev != nil {
+			log.Printf("Error: %v\n", errRev)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		if rev == nil || req.Rev == "" {
+			sendError(w, "This revision does not exist.")
+			return
+		}
+
+		// copy the old content over the current page, which itself becomes a revision when we save, then save it as an
+		// edit, since the limits and spam filters may have changed since it was written
+		edit := *page
+		edit.Title = rev.Title
+		edit.Author = rev.Author
+		edit.Website = rev.Website
+		edit.Twitter = rev.Twitter
+		edit.Facebook = rev.Facebook
+		edit.GitHub = rev.GitHub
+		edit.Instagram = rev.Instagram
+		edit.Content = rev.Content
+
+		errEdit := editPage(store, page, edit, "")
+		if errEdit == ErrVersionConflict {
+			sendError(w, "This page has been changed while restoring. Please try again.")
+			return
+		}
+		if errs, ok := errEdit.(FieldErrors); ok {
+			sendFieldErrors(w, errs)
+			return
+		}
+		if errEdit != nil {
+			log.Printf("Error: %v\n", errEdit)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		payload := map[string]interface{}{
+			"id":          secret,
+			"name":        page.Name,
+			"rev":         strconv.FormatInt(revisionOf(page), 10),
+			"version":     page.Version,
+			"quarantined": page.Quarantined,
+		}
+		sendPayload(w, "Restored", payload)
+	}
+}
+
+// revisionsHandler serves /api/revisions, or just says there is no history for stores which don't keep it (sqlite and
+// fs).
+func revisionsHandler(store PageStore, limits rateLimits) func(w http.ResponseWriter, r *http.Request) {
+	getRevisions := noRevisions
+	restoreRevision := noRevisions
+	if revStore, ok := store.(RevisionStore); ok {
+		getRevisions = rateLimited(limits.fetch, apiRevisionsGet(store, revStore))
+		restoreRevision = rateLimited(limits.update, apiRevisionsRestore(store, revStore))
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			getRevisions(w, r)
+			return
+		}
+
+		if r.Method == "POST" {
+			restoreRevision(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func noRevisions(w http.ResponseWriter, r *http.Request) {
+	sendError(w, "This server does not keep page history.")
+}
@@ -0,0 +1,121 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func callRevisions(t *testing.T, store PageStore, method, path, body string, out interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	revisionsHandler(store, rateLimits{})(w, r)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("decoding %q: %v", w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestRevisionsHandler(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		w := callRevisions(t, store, "DELETE", "/api/revisions", "", nil)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected 405, got %d", w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, POST" {
+			t.Fatalf("expected Allow: GET, POST, got %q", allow)
+		}
+
+		put := putTestPage(t, store, "Revisions")
+		id := put.Payload["id"].(string)
+
+		resp := struct {
+			Ok      bool           `json:"ok"`
+			Msg     string         `json:"msg"`
+			Payload []revisionInfo `json:"payload"`
+		}{}
+		callRevisions(t, store, "GET", "/api/revisions?id="+id, "", &resp)
+		if _, ok := store.(RevisionStore); !ok {
+			if resp.Ok || resp.Msg != "This server does not keep page history." {
+				t.Fatalf("expected no history, got %+v", resp)
+			}
+			return
+		}
+		if !resp.Ok || len(resp.Payload) != 1 || !resp.Payload[0].Current {
+			t.Fatalf("expected the revisions, got %+v", resp)
+		}
+	})
+}
+
+// saveTestEdit changes a page directly in the store, skipping the checks the handlers make, so that it becomes a
+// revision once it's edited again.
+func saveTestEdit(t *testing.T, store PageStore, name string, edit func(page *Page)) {
+	page, err := store.GetPage(name)
+	if err != nil || page == nil {
+		t.Fatalf("getting %s: %v", name, err)
+	}
+
+	edit(page)
+	page.Updated = page.Updated.Add(time.Second)
+	page.Version++
+	if err := store.UpdatePage(*page, page.Version-1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevisionsRestoreIsValidated(t *testing.T) {
+	store := NewMemoryStore()
+	put := putTestPage(t, store, "Restored")
+	id := put.Payload["id"].(string)
+	name := put.Payload["name"].(string)
+
+	// an old revision which no longer passes, followed by a good one
+	saveTestEdit(t, store, name, func(page *Page) { page.Title = strings.Repeat("x", maxTitleLength+1) })
+	saveTestEdit(t, store, name, func(page *Page) { page.Title = "Fixed" })
+
+	revisions, err := store.ListRevisions(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev := revisionOf(revisions[0])
+
+	resp := testResponse{}
+	callRevisions(t, store, "POST", "/api/revisions", fmt.Sprintf(`{"id":%q,"rev":"%d"}`, id, rev), &resp)
+	if resp.Ok {
+		t.Fatalf("expected the restore to fail, got %+v", resp)
+	}
+	if fields, _ := resp.Payload["fields"].(map[string]interface{}); fields["title"] == nil {
+		t.Fatalf("expected an error for the title, got %+v", resp)
+	}
+
+	page, _ := store.GetPage(name)
+	if page.Title != "Fixed" {
+		t.Fatalf("expected the page to be left alone, got %q", page.Title)
+	}
+}
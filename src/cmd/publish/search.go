@@ -0,0 +1,542 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// the fields we search, and how much a match in each one counts for
+const (
+	searchTitle = iota
+	searchAuthor
+	searchContent
+	numSearchFields
+)
+
+var searchWeights = [numSearchFields]float64{3, 2, 1}
+
+// terms longer than this are cut short, both when indexing and searching
+const maxTermLength = 64
+
+// only this many words or phrases of a query are used
+const maxQueryPhrases = 8
+
+// how many words of the content go into a snippet
+const snippetTerms = 30
+
+// Postings are the positions of a term in each of the fields of a page.
+type Postings [numSearchFields][]int
+
+// SearchIndex is implemented by stores which keep an inverted index of the visible pages. LookupTerms returns, for each
+// term, the postings of every page it appears in (by name) except those which have expired by `now`, plus how many
+// pages there are in the index.
+type SearchIndex interface {
+	LookupTerms(terms []string, now time.Time) (map[string]map[string]*Postings, int, error)
+}
+
+// a searchQuery is a list of phrases, each one a list of terms, and a page must match every one of them
+type searchQuery [][]string
+
+type searchResult struct {
+	Page    *Page
+	Score   float64
+	Snippet template.HTML
+}
+
+type termSpan struct {
+	term  string
+	start int // the byte offsets of the term in the text
+	end   int
+}
+
+// tokenize splits the text into lowercase terms of letters and digits.
+func tokenize(text string) []termSpan {
+	spans := []termSpan{}
+	start := -1
+	for i, r := range text {
+		isTermRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isTermRune && start < 0 {
+			start = i
+		}
+		if !isTermRune && start >= 0 {
+			spans = append(spans, newTermSpan(text, start, i))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, newTermSpan(text, start, len(text)))
+	}
+	return spans
+}
+
+func newTermSpan(text string, start, end int) termSpan {
+	term := strings.ToLower(text[start:end])
+	if len(term) > maxTermLength {
+		// don't cut a rune in half
+		cut := maxTermLength
+		for cut > 0 && !isRuneStart(term[cut]) {
+			cut--
+		}
+		term = term[:cut]
+	}
+	return termSpan{term, start, end}
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func terms(text string) []string {
+	spans := tokenize(text)
+	terms := make([]string, len(spans))
+	for i, span := range spans {
+		terms[i] = span.term
+	}
+	return terms
+}
+
+// pagePostings is every term in the page, with where it appears.
+func pagePostings(page *Page) map[string]*Postings {
+	all := map[string]*Postings{}
+	fields := [numSearchFields]string{page.Title, page.Author, page.Content}
+	for field, text := range fields {
+		for pos, term := range terms(text) {
+			if all[term] == nil {
+				all[term] = &Postings{}
+			}
+			all[term][field] = append(all[term][field], pos)
+		}
+	}
+	return all
+}
+
+// parseQuery makes a phrase from anything in double quotes, and a phrase of one term from every other word.
+func parseQuery(q string) searchQuery {
+	query := searchQuery{}
+	seen := map[string]bool{}
+
+	for i, part := range strings.Split(q, `"`) {
+		var phrases [][]string
+		if i%2 == 1 {
+			phrases = [][]string{terms(part)}
+		} else {
+			for _, term := range terms(part) {
+				phrases = append(phrases, []string{term})
+			}
+		}
+
+		for _, phrase := range phrases {
+			key := strings.Join(phrase, " ")
+			if len(phrase) == 0 || seen[key] || len(query) == maxQueryPhrases {
+				continue
+			}
+			seen[key] = true
+			query = append(query, phrase)
+		}
+	}
+
+	return query
+}
+
+// lookupTerms uses the store's SearchIndex if it has one, and otherwise reads every visible page.
+func lookupTerms(store PageStore, terms []string, now time.Time) (map[string]map[string]*Postings, int, error) {
+	if index, ok := store.(SearchIndex); ok {
+		return index.LookupTerms(terms, now)
+	}
+
+	found := map[string]map[string]*Postings{}
+	for _, term := range terms {
+		found[term] = map[string]*Postings{}
+	}
+
+	count := 0
+	err := store.IteratePages(func(page *Page) error {
+		if !page.IsVisible() || page.IsExpired(now) {
+			return nil
+		}
+		count++
+
+		all := pagePostings(page)
+		for _, term := range terms {
+			if postings, ok := all[term]; ok {
+				found[term][page.Name] = postings
+			}
+		}
+		return nil
+	})
+
+	return found, count, err
+}
+
+// getPages uses the store's BatchGetter if it has one, and otherwise gets each page on its own.
+func getPages(store PageStore, names []string) ([]*Page, error) {
+	if getter, ok := store.(BatchGetter); ok {
+		return getter.GetPages(names)
+	}
+
+	pages := make([]*Page, len(names))
+	for i, name := range names {
+		page, err := store.GetPage(name)
+		if err != nil {
+			return nil, err
+		}
+		pages[i] = page
+	}
+	return pages, nil
+}
+
+// searchPages returns the pages matching every phrase in the query, best first, skipping `offset` of them. It also
+// returns how many there are altogether. Everything is scored from the postings, so only the pages being shown are
+// read.
+func searchPages(store PageStore, query searchQuery, offset, limit int) ([]searchResult, int, error) {
+	if len(query) == 0 {
+		return []searchResult{}, 0, nil
+	}
+
+	// look up each term just once
+	uniq := []string{}
+	seen := map[string]bool{}
+	for _, phrase := range query {
+		for _, term := range phrase {
+			if !seen[term] {
+				seen[term] = true
+				uniq = append(uniq, term)
+			}
+		}
+	}
+
+	now := clock()
+	found, count, err := lookupTerms(store, uniq, now)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// rarer terms are worth more
+	idf := map[string]float64{}
+	for _, term := range uniq {
+		idf[term] = math.Log(1 + float64(count)/float64(1+len(found[term])))
+	}
+
+	// the candidates are the pages which contain every term, which we find from the rarest
+	sort.Slice(uniq, func(i, j int) bool {
+		return len(found[uniq[i]]) < len(found[uniq[j]])
+	})
+
+	results := []searchResult{}
+	for name := range found[uniq[0]] {
+		score := scorePage(found, query, idf, name)
+		if score > 0 {
+			results = append(results, searchResult{Page: &Page{Name: name}, Score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Page.Name < results[j].Page.Name
+	})
+
+	total := len(results)
+	if offset > total {
+		offset = total
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	// and only load the ones we're showing
+	names := make([]string, len(results))
+	for i, result := range results {
+		names[i] = result.Page.Name
+	}
+	loaded, err := getPages(store, names)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pages := make([]searchResult, 0, len(results))
+	for i, result := range results {
+		page := loaded[i]
+		if page == nil || !page.IsVisible() || page.IsExpired(now) {
+			continue
+		}
+
+		result.Page = page
+		result.Snippet = snippet(page.Content, query)
+		pages = append(pages, result)
+	}
+
+	return pages, total, nil
+}
+
+// scorePage is 0 unless every phrase appears in the page. Otherwise each phrase adds the idf of its terms, times the
+// weight of each field it appears in, times a little more for appearing more often.
+func scorePage(found map[string]map[string]*Postings, query searchQuery, idf map[string]float64, name string) float64 {
+	score := 0.0
+	for _, phrase := range query {
+		postings := make([]*Postings, len(phrase))
+		phraseIdf := 0.0
+		for i, term := range phrase {
+			postings[i] = found[term][name]
+			if postings[i] == nil {
+				return 0
+			}
+			phraseIdf += idf[term]
+		}
+
+		phraseScore := 0.0
+		for field := 0; field < numSearchFields; field++ {
+			matches := phraseMatches(postings, field)
+			if matches > 0 {
+				phraseScore += searchWeights[field] * (1 + math.Log(float64(matches)))
+			}
+		}
+		if phraseScore == 0 {
+			return 0
+		}
+
+		score += phraseIdf * phraseScore
+	}
+	return score
+}
+
+// phraseMatches counts the places in the field where each term follows the one before.
+func phraseMatches(postings []*Postings, field int) int {
+	matches := 0
+	for _, start := range postings[0][field] {
+		if followedBy(postings, field, start) {
+			matches++
+		}
+	}
+	return matches
+}
+
+func followedBy(postings []*Postings, field int, start int) bool {
+	for i := 1; i < len(postings); i++ {
+		positions := postings[i][field]
+		j := sort.SearchInts(positions, start+i)
+		if j == len(positions) || positions[j] != start+i {
+			return false
+		}
+	}
+	return true
+}
+
+// snippet is the part of the content around the first match, with every match marked.
+func snippet(content string, query searchQuery) template.HTML {
+	spans := tokenize(content)
+	if len(spans) == 0 {
+		return ""
+	}
+
+	marked := make([]bool, len(spans))
+	first := -1
+	for _, phrase := range query {
+		for i := 0; i+len(phrase) <= len(spans); i++ {
+			if !spansMatch(spans[i:i+len(phrase)], phrase) {
+				continue
+			}
+			for j := range phrase {
+				marked[i+j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	// start a few terms before the first match
+	from := 0
+	if first > snippetTerms/3 {
+		from = first - snippetTerms/3
+	}
+	to := from + snippetTerms
+	if to > len(spans) {
+		to = len(spans)
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("&hellip; ")
+	}
+	for i := from; i < to; i++ {
+		if i > from {
+			b.WriteString(html.EscapeString(snippetGap(content[spans[i-1].end:spans[i].start])))
+		}
+
+		text := html.EscapeString(content[spans[i].start:spans[i].end])
+		if marked[i] {
+			text = "<mark>" + text + "</mark>"
+		}
+		b.WriteString(text)
+	}
+	if to < len(spans) {
+		b.WriteString(" &hellip;")
+	}
+
+	return template.HTML(b.String())
+}
+
+func spansMatch(spans []termSpan, phrase []string) bool {
+	for i, term := range phrase {
+		if spans[i].term != term {
+			return false
+		}
+	}
+	return true
+}
+
+// snippetGap is the text between two terms, without the Markdown and line breaks.
+func snippetGap(gap string) string {
+	gap = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("*_#>`[]()|", r) {
+			return -1
+		}
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		return r
+	}, gap)
+
+	if strings.TrimSpace(gap) == "" {
+		return " "
+	}
+	return gap
+}
+
+type searchResultInfo struct {
+	Name    string        `json:"name"`
+	Title   string        `json:"title"`
+	Author  string        `json:"author"`
+	Url     string        `json:"url"`
+	Score   float64       `json:"score"`
+	Snippet template.HTML `json:"snippet"` // HTML, with each match in a <mark>
+}
+
+// searchParams reads 'q', 'offset' and 'limit' from the request and runs the search.
+func searchParams(store PageStore, r *http.Request) (string, int, int, []searchResult, int, error) {
+	q := r.FormValue("q")
+	offset, _ := strconv.Atoi(r.FormValue("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	limit = clampListLimit(limit)
+
+	results, total, err := searchPages(store, parseQuery(q), offset, limit)
+	return q, offset, limit, results, total, err
+}
+
+// apiSearch is GET /api/search?q=...
+func apiSearch(store PageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q, offset, _, results, total, err := searchParams(store, r)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		infos := make([]searchResultInfo, len(results))
+		for i, result := range results {
+			infos[i] = searchResultInfo{
+				Name:    result.Page.Name,
+				Title:   result.Page.Title,
+				Author:  result.Page.Author,
+				Url:     baseUrl + "/" + result.Page.Name,
+				Score:   result.Score,
+				Snippet: result.Snippet,
+			}
+		}
+
+		payload := struct {
+			Query   string             `json:"query"`
+			Total   int                `json:"total"`
+			Offset  int                `json:"offset"`
+			Results []searchResultInfo `json:"results"`
+		}{q, total, offset, infos}
+
+		sendPayload(w, "", payload)
+	}
+}
+
+// searchPageLinks is the offset of the previous and next lot of results, or -1 if there aren't any.
+func searchPageLinks(offset, limit, total int) (int, int) {
+	prev, next := -1, -1
+	if offset > 0 {
+		prev = offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+	}
+	if offset+limit < total {
+		next = offset + limit
+	}
+	return prev, next
+}
+
+// searchHandler is the /search?q=... page.
+func searchHandler(store PageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, offset, limit, results, total, err := searchParams(store, r)
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			http.Error(w, "Internal Error. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+		prev, next := searchPageLinks(offset, limit, total)
+
+		data := struct {
+			Layout  string
+			Query   string
+			Results []searchResult
+			Total   int
+			Prev    int
+			Next    int
+		}{
+			"search",
+			q,
+			results,
+			total,
+			prev,
+			next,
+		}
+		render(w, "search.html", data)
+	}
+}
@@ -0,0 +1,290 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want searchQuery
+	}{
+		{"", searchQuery{}},
+		{"  ", searchQuery{}},
+		{"Fox", searchQuery{{"fox"}}},
+		{"quick, brown fox!", searchQuery{{"quick"}, {"brown"}, {"fox"}}},
+		{`"quick brown" fox`, searchQuery{{"quick", "brown"}, {"fox"}}},
+		{`fox "Quick  Brown"`, searchQuery{{"fox"}, {"quick", "brown"}}},
+		// an unclosed quote runs to the end
+		{`fox "quick brown`, searchQuery{{"fox"}, {"quick", "brown"}}},
+		// empty quotes, and the same word or phrase twice, don't count
+		{`fox "" fox "a b" "a b"`, searchQuery{{"fox"}, {"a", "b"}}},
+		{"a b c d e f g h i j", searchQuery{{"a"}, {"b"}, {"c"}, {"d"}, {"e"}, {"f"}, {"g"}, {"h"}}},
+	}
+
+	for _, test := range tests {
+		if got := parseQuery(test.q); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.q, got, test.want)
+		}
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		pages := []struct {
+			name    string
+			content string
+		}{
+			{"alpha-aaaaaaaa", "the quick brown fox jumps"},
+			{"bravo-aaaaaaaa", "the brown quick fox"},
+			{"charlie-aaaaaaaa", "the fox"},
+			{"echo-aaaaaaaa", "fox fox fox quick"},
+			{"foxtrot-aaaaaaaa", "fox quick quick quick"},
+			// none of which may be found
+			{"hidden-aaaaaaaa", "fox quick"},
+			{"spam-aaaaaaaa", "fox quick"},
+			{"deleted-aaaaaaaa", "fox quick"},
+		}
+		for _, p := range pages {
+			page := testPage(p.name, "secret-"+p.name, strings.Split(p.name, "-")[0])
+			page.Content = p.content
+			page.Unpublished = p.name == "hidden-aaaaaaaa"
+			page.Quarantined = p.name == "spam-aaaaaaaa"
+			if err := store.CreatePage(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.DeletePage("deleted-aaaaaaaa", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			q      string
+			offset int
+			limit  int
+			names  []string
+			total  int
+		}{
+			{"nothing", 0, 10, []string{}, 0},
+			{"fox", 0, 10, []string{"echo-aaaaaaaa", "alpha-aaaaaaaa", "bravo-aaaaaaaa", "charlie-aaaaaaaa", "foxtrot-aaaaaaaa"}, 5},
+			// a title counts for more than the content
+			{"charlie", 0, 10, []string{"charlie-aaaaaaaa"}, 1},
+			// "quick" is in fewer pages than "fox", so three of those beat three of "fox"
+			{"fox quick", 0, 10, []string{"foxtrot-aaaaaaaa", "echo-aaaaaaaa", "alpha-aaaaaaaa", "bravo-aaaaaaaa"}, 4},
+			{"quick FOX", 0, 10, []string{"foxtrot-aaaaaaaa", "echo-aaaaaaaa", "alpha-aaaaaaaa", "bravo-aaaaaaaa"}, 4},
+			// phrases must appear in that order
+			{`"quick brown"`, 0, 10, []string{"alpha-aaaaaaaa"}, 1},
+			{`"brown quick" fox`, 0, 10, []string{"bravo-aaaaaaaa"}, 1},
+			{`"quick fox"`, 0, 10, []string{"bravo-aaaaaaaa"}, 1},
+			{`"fox jumps" charlie`, 0, 10, []string{}, 0},
+			// a page at a time
+			{"fox quick", 0, 2, []string{"foxtrot-aaaaaaaa", "echo-aaaaaaaa"}, 4},
+			{"fox quick", 2, 2, []string{"alpha-aaaaaaaa", "bravo-aaaaaaaa"}, 4},
+			{"fox quick", 3, 2, []string{"bravo-aaaaaaaa"}, 4},
+			{"fox quick", 10, 2, []string{}, 4},
+		}
+
+		for _, test := range tests {
+			results, total, err := searchPages(store, parseQuery(test.q), test.offset, test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, result := range results {
+				names = append(names, result.Page.Name)
+				if result.Page.Content == "" || result.Snippet == "" {
+					t.Errorf("%q: %s wasn't loaded: %#v", test.q, result.Page.Name, result)
+				}
+			}
+			if !reflect.DeepEqual(names, test.names) || total != test.total {
+				t.Errorf("%q at %d: expected %v of %d, got %v of %d", test.q, test.offset, test.names, test.total, names, total)
+			}
+		}
+	})
+}
+
+func TestSnippet(t *testing.T) {
+	words := []string{}
+	for i := 1; i <= 50; i++ {
+		words = append(words, fmt.Sprintf("w%d", i))
+	}
+	long := strings.Join(words, " ")
+
+	tests := []struct {
+		content string
+		q       string
+		want    string
+	}{
+		{"", "fox", ""},
+		{"One two three", "two", "One <mark>two</mark> three"},
+		{"the quick brown fox", `"quick brown"`, "the <mark>quick</mark> <mark>brown</mark> fox"},
+		{"the brown quick fox", `"quick brown"`, "the brown quick fox"},
+		// the Markdown goes, and so does anything which could be HTML
+		{"# Title\n\n**bold** text", "bold", "Title <mark>bold</mark> text"},
+		{"Tom & Jerry's <b>cat</b>", "cat jerry", "Tom &amp; <mark>Jerry</mark>&#39;s &lt;b <mark>cat</mark>&lt;/b"},
+		{`<script>alert("x")</script>`, "alert", "script <mark>alert</mark>&#34;x&#34;&lt;/script"},
+		// long content is cut down to the part around the first match
+		{long, "w2", "w1 <mark>w2</mark> w3 w4 w5 w6 w7 w8 w9 w10 w11 w12 w13 w14 w15 w16 w17 w18 w19 w20 w21 w22 w23 w24 " +
+			"w25 w26 w27 w28 w29 w30 &hellip;"},
+		{long, "w40", "&hellip; w30 w31 w32 w33 w34 w35 w36 w37 w38 w39 <mark>w40</mark> w41 w42 w43 w44 w45 w46 w47 w48 " +
+			"w49 w50"},
+	}
+
+	for _, test := range tests {
+		if got := string(snippet(test.content, parseQuery(test.q))); got != test.want {
+			t.Errorf("%q in %q:\ngot  %s\nwant %s", test.q, test.content, got, test.want)
+		}
+	}
+}
+
+func TestSearchPageLinks(t *testing.T) {
+	tests := []struct {
+		offset int
+		limit  int
+		total  int
+		prev   int
+		next   int
+	}{
+		{0, 20, 0, -1, -1},
+		{0, 20, 20, -1, -1},
+		{0, 20, 21, -1, 20},
+		{20, 20, 21, 0, -1},
+		{20, 20, 60, 0, 40},
+		{40, 20, 60, 20, -1},
+		// an offset which isn't a multiple of the limit goes back to the start
+		{5, 20, 60, 0, 25},
+		{100, 20, 60, 80, -1},
+	}
+
+	for _, test := range tests {
+		prev, next := searchPageLinks(test.offset, test.limit, test.total)
+		if prev != test.prev || next != test.next {
+			t.Errorf("%d+%d of %d: got %d and %d, want %d and %d",
+				test.offset, test.limit, test.total, prev, next, test.prev, test.next)
+		}
+	}
+}
+
+func TestApiSearchMethod(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiSearch(NewMemoryStore())(w, httptest.NewRequest("POST", "/api/search?q=fox", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Fatalf("expected 405 allowing GET, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestApiSearchLeavesExpiredPagesOutOfTheTotal(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		now := time.Now().UTC()
+		pages := []Page{
+			testPage("one-aaaaaaaa", "secret-one", "Zebra One"),
+			testPage("two-bbbbbbbb", "secret-two", "Zebra Two"),
+			expiringPage("gone-cccccccc", "secret-gone", now.Add(time.Hour)),
+		}
+		pages[2].Title = "Zebra Gone"
+		pages[2].Content = "Zebra Gone"
+		for _, page := range pages {
+			if err := store.CreatePage(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the last one expires, but hasn't been reaped yet
+		fakeClock(t, now.Add(2*time.Hour))
+
+		w := httptest.NewRecorder()
+		apiSearch(store)(w, httptest.NewRequest("GET", "/api/search?q=zebra&limit=1", nil))
+		resp := struct {
+			Ok      bool
+			Payload struct {
+				Total   int
+				Results []searchResultInfo
+			}
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Ok || resp.Payload.Total != 2 || len(resp.Payload.Results) != 1 {
+			t.Fatalf("expected 1 of 2 results, got %s", w.Body.String())
+		}
+	})
+}
+
+func TestBoltIndexedCount(t *testing.T) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "publish.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	expectCount := func(want int) {
+		t.Helper()
+		_, count, err := store.LookupTerms([]string{"fox"}, time.Now())
+		if err != nil || count != want {
+			t.Fatalf("expected %d pages in the index, got %d (%v)", want, count, err)
+		}
+	}
+
+	expectCount(0)
+	for _, name := range []string{"one-aaaaaaaa", "two-aaaaaaaa", "three-aaaaaaaa"} {
+		if err := store.CreatePage(testPage(name, "secret-"+name, "Fox")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCount(3)
+
+	// saving a page again doesn't count it twice, and hiding it takes it out
+	page, _ := store.GetPage("one-aaaaaaaa")
+	if err := store.PutPage(*page); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(3)
+	page.Unpublished = true
+	if err := store.PutPage(*page); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(2)
+
+	// deleting a hidden page leaves the count alone
+	if err := store.DeletePage("one-aaaaaaaa", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeletePage("two-aaaaaaaa", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(1)
+
+	// and an existing store is counted when it's upgraded
+	useSecretKey(t, "key")
+	if err := store.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	expectCount(1)
+}
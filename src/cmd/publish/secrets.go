@@ -0,0 +1,140 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// ErrNoSecretKey stops us hashing secrets without a key, since once the raw secrets are gone they can never be hashed
+// again with one.
+var ErrNoSecretKey = errors.New("SECRET_KEY is not set, and page secrets can't be hashed without it")
+
+// secretKey is the HMAC key used to hash each page's secret Id before it is stored. It comes from SECRET_KEY and must
+// never change, otherwise no secret will match its page any more.
+var secretKey []byte
+
+// hashSecret returns the hex encoded HMAC-SHA256 of the secret, which is what we store in place of the secret itself.
+func hashSecret(secret string) string {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyCheck is a fingerprint of SECRET_KEY for archives, the hex encoded HMAC-SHA256 of a random nonce under a label of
+// its own, so unlike hashSecret("") it is different every time and can't be mistaken for a hashed secret.
+func keyCheck(nonce string) string {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte("publish.li archive key check\x00" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isHashedSecret tells a stored hash apart from the raw 16 letter secrets we used to store.
+func isHashedSecret(id string) bool {
+	if len(id) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// secretMatches checks the secret against the page's stored hash in constant time.
+func secretMatches(page *Page, secret string) bool {
+	if page.Id == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(page.Id), []byte(hashSecret(secret))) == 1
+}
+
+// requestSecret returns the page secret from the request's 'Authorization: Bearer ...' header. Older clients send it as
+// `fallback` instead (from the body or query string, where proxies may log it), which still works but marks the
+// response as using a deprecated feature.
+func requestSecret(w http.ResponseWriter, r *http.Request, fallback string) string {
+	if secret := bearerToken(r); secret != "" {
+		return secret
+	}
+
+	if fallback != "" {
+		w.Header().Set("Deprecation", "true")
+	}
+	return fallback
+}
+
+// getPageUsingSecret finds the page this secret can edit, or nil if there isn't one.
+func getPageUsingSecret(store PageStore, secret string) (*Page, error) {
+	if secret == "" {
+		return nil, nil
+	}
+
+	page, err := store.GetPageUsingId(hashSecret(secret))
+	if err != nil || page == nil {
+		return nil, err
+	}
+
+	if !secretMatches(page, secret) {
+		return nil, nil
+	}
+	return page, nil
+}
+
+// hashSecrets replaces any raw secrets left in the store with their hashes, so the secrets authors already hold carry
+// on working. It's safe to run every time we start, since hashed secrets are left alone. With `dryRun` it only
+// counts them. The BoltStore does this in a migration instead, see migrateHashSecrets().
+func hashSecrets(store PageStore, dryRun bool) (int, error) {
+	if len(secretKey) == 0 {
+		return 0, ErrNoSecretKey
+	}
+
+	// collect them first, since we can't write to the store while iterating it
+	pages := []Page{}
+	err := store.IteratePages(func(page *Page) error {
+		if page.Id != "" && !isHashedSecret(page.Id) {
+			pages = append(pages, *page)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		log.Printf("Would hash the secrets of %d pages\n", len(pages))
+		return len(pages), nil
+	}
+
+	for _, page := range pages {
+		page.Id = hashSecret(page.Id)
+		if err := store.PutPage(page); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(pages) > 0 {
+		log.Printf("Hashed the secrets of %d pages\n", len(pages))
+	}
+
+	return len(pages), nil
+}
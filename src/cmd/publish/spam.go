@@ -0,0 +1,409 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a page whose scores add up to this much is quarantined
+const spamThreshold = 100
+
+// link density: at least this many links, with fewer than this many words for each, looks like a page of links
+const spamDenseLinks = 5
+const spamDenseWordsPerLink = 10
+const spamSparseLinks = 3
+const spamSparseWordsPerLink = 25
+
+// and more than this many links looks like spam however many words go with them
+const spamMaxLinks = 40
+
+// the same content this many times within the window is a bot, and shorter content is too likely to repeat by chance
+const spamMaxRepeats = 3
+const spamRepeatWindow = 24 * time.Hour
+const spamMinRepeatLength = 100
+
+// we stop remembering the oldest content past this many, rather than use up all the memory
+const maxSpamHashes = 100000
+
+// anything which looks like a link, whether or not Markdown would make it one
+var spamLinkRegexp = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>()\[\]"'` + "`" + `]+`)
+
+// spamFilters score every page as it is created or edited. None are used unless main sets them up.
+var spamFilters []SpamFilter
+
+// SpamSubmission is a page which is about to be saved, along with what else we know about it.
+type SpamSubmission struct {
+	Page     *Page
+	Previous *Page  // the page as it was before this edit, or nil for a new page
+	Honeypot string // the editor's hidden field, which people can't see, so only bots fill it in
+}
+
+// SpamFilter is one way of telling whether a page is spam. Score says how suspicious the page looks, where 0 means it
+// is fine, and why, for the operator.
+type SpamFilter interface {
+	Score(sub SpamSubmission) (int, string)
+}
+
+// SpamRecorder is implemented by filters which learn from what is posted. Record is only called once the page has
+// been saved, so that a save which fails or is refused, and then tried again, is only counted once.
+type SpamRecorder interface {
+	Record(sub SpamSubmission)
+}
+
+// newSpamFilters returns the filters we use by default, including the list of blocked domains in `blocklistPath` if
+// it is set.
+func newSpamFilters(blocklistPath string) ([]SpamFilter, error) {
+	filters := []SpamFilter{
+		honeypotFilter{},
+		linkDensityFilter{},
+		newRepeatFilter(),
+	}
+
+	if blocklistPath != "" {
+		blocklist, err := loadBlocklist(blocklistPath)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, blocklist)
+	}
+
+	return filters, nil
+}
+
+// checkSpam scores the page with every filter and quarantines it if the total reaches spamThreshold. A page only
+// leaves quarantine when an operator releases it, so one which is already there isn't scored again.
+func checkSpam(sub SpamSubmission) {
+	if sub.Page.Quarantined {
+		return
+	}
+
+	total := 0
+	reasons := []string{}
+	for _, filter := range spamFilters {
+		score, reason := filter.Score(sub)
+		if score > 0 {
+			total += score
+			reasons = append(reasons, reason)
+		}
+	}
+
+	if total >= spamThreshold {
+		sub.Page.Quarantined = true
+		log.Printf("Quarantined : %q scored %d (%s)\n", sub.Page.Title, total, strings.Join(reasons, "; "))
+	}
+}
+
+// recordSpam tells every filter which learns from what is posted that the page has been saved.
+func recordSpam(sub SpamSubmission) {
+	for _, filter := range spamFilters {
+		if recorder, ok := filter.(SpamRecorder); ok {
+			recorder.Record(sub)
+		}
+	}
+}
+
+// spamLinks returns every link in the page's title and content.
+func spamLinks(page *Page) []string {
+	return append(spamLinkRegexp.FindAllString(page.Title, -1), spamLinkRegexp.FindAllString(page.Content, -1)...)
+}
+
+// honeypotFilter catches bots which fill in every field they find.
+type honeypotFilter struct{}
+
+func (honeypotFilter) Score(sub SpamSubmission) (int, string) {
+	if sub.Honeypot == "" {
+		return 0, ""
+	}
+	return spamThreshold, "filled in the honeypot"
+}
+
+// linkDensityFilter catches pages which are mostly links, which is what SEO spam looks like.
+type linkDensityFilter struct{}
+
+func (linkDensityFilter) Score(sub SpamSubmission) (int, string) {
+	links := len(spamLinks(sub.Page))
+	words := len(strings.Fields(sub.Page.Title)) + len(strings.Fields(sub.Page.Content))
+
+	score := 0
+	if links >= spamDenseLinks && words < links*spamDenseWordsPerLink {
+		score += spamThreshold
+	} else if links >= spamSparseLinks && words < links*spamSparseWordsPerLink {
+		score += spamThreshold / 2
+	}
+	if links > spamMaxLinks {
+		score += spamThreshold / 2
+	}
+
+	return score, fmt.Sprintf("%d links in %d words", links, words)
+}
+
+// repeatFilter catches the same content being posted over and over, as bots do. It only counts content which is new,
+// so saving a page without changing it doesn't count, and only once the page has been saved, see Record().
+type repeatFilter struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	hashes map[string]*repeatedContent
+}
+
+type repeatedContent struct {
+	count int
+	first time.Time
+}
+
+func newRepeatFilter() *repeatFilter {
+	return &repeatFilter{
+		now:    clock,
+		hashes: make(map[string]*repeatedContent),
+	}
+}
+
+// normaliseContent ignores the differences bots make to get around simple checks like this one.
+func normaliseContent(content string) string {
+	return strings.Join(strings.Fields(strings.ToLower(content)), " ")
+}
+
+// contentHash is what identifies the page's content, or "" if it doesn't count.
+func (rf *repeatFilter) contentHash(sub SpamSubmission) string {
+	content := normaliseContent(sub.Page.Content)
+	if len(content) < spamMinRepeatLength {
+		return ""
+	}
+	if sub.Previous != nil && normaliseContent(sub.Previous.Content) == content {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(content))
+	return string(sum[:])
+}
+
+// seen returns what we know about the content, or nil if it hasn't been saved within the window. It must be called
+// with the lock held.
+func (rf *repeatFilter) seen(hash string, now time.Time) *repeatedContent {
+	seen, ok := rf.hashes[hash]
+	if !ok || now.Sub(seen.first) >= spamRepeatWindow {
+		return nil
+	}
+	return seen
+}
+
+func (rf *repeatFilter) Score(sub SpamSubmission) (int, string) {
+	hash := rf.contentHash(sub)
+	if hash == "" {
+		return 0, ""
+	}
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	// this would be one more than has been saved so far
+	count := 1
+	if seen := rf.seen(hash, rf.now()); seen != nil {
+		count += seen.count
+	}
+
+	if count <= spamMaxRepeats {
+		return 0, ""
+	}
+	return spamThreshold, fmt.Sprintf("the same content %d times", count)
+}
+
+func (rf *repeatFilter) Record(sub SpamSubmission) {
+	hash := rf.contentHash(sub)
+	if hash == "" {
+		return
+	}
+	now := rf.now()
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	seen := rf.seen(hash, now)
+	if seen == nil {
+		if len(rf.hashes) >= maxSpamHashes {
+			rf.forget(now)
+		}
+		seen = &repeatedContent{first: now}
+		rf.hashes[hash] = seen
+	}
+	seen.count++
+}
+
+// forget makes room for more content by dropping everything first seen before the window, or any one entry if that
+// doesn't help. It must be called with the lock held.
+func (rf *repeatFilter) forget(now time.Time) {
+	for hash, seen := range rf.hashes {
+		if now.Sub(seen.first) >= spamRepeatWindow {
+			delete(rf.hashes, hash)
+		}
+	}
+	for hash := range rf.hashes {
+		if len(rf.hashes) < maxSpamHashes {
+			break
+		}
+		delete(rf.hashes, hash)
+	}
+}
+
+// blocklistFilter catches links to domains which are only ever linked to by spam, including their subdomains.
+type blocklistFilter map[string]bool
+
+// loadBlocklist reads one domain per line, ignoring blank lines and comments starting with '#'.
+func loadBlocklist(path string) (blocklistFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	blocklist := blocklistFilter{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line != "" {
+			blocklist[strings.ToLower(strings.TrimPrefix(line, "."))] = true
+		}
+	}
+
+	return blocklist, scanner.Err()
+}
+
+// blocked returns which blocked domain `host` is, or is under, or "".
+func (bf blocklistFilter) blocked(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for host != "" {
+		if bf[host] {
+			return host
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return ""
+}
+
+func (bf blocklistFilter) Score(sub SpamSubmission) (int, string) {
+	links := spamLinks(sub.Page)
+	if sub.Page.Website != "" {
+		links = append(links, sub.Page.Website)
+	}
+
+	for _, link := range links {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		if domain := bf.blocked(u.Hostname()); domain != "" {
+			return spamThreshold, "links to " + domain
+		}
+	}
+
+	return 0, ""
+}
+
+// adminQuarantine lets an operator deal with quarantined pages. GET lists them, while POST with '?name=...' releases
+// the page (so that everyone can see it) and DELETE deletes it just as if its author had.
+func adminQuarantine(store PageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			pages := []*apiPage{}
+			err := store.IteratePages(func(page *Page) error {
+				if page.Quarantined && !page.IsDeleted() {
+					pages = append(pages, newApiPage(page))
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("Error: %v\n", err)
+				http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			sendJson(w, map[string]interface{}{"pages": pages})
+			return
+		}
+
+		if r.Method != "POST" && r.Method != "DELETE" {
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.FormValue("name")
+		page, errGet := store.GetPage(name)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		if page == nil || page.IsDeleted() || !page.Quarantined {
+			http.Error(w, "404 no such quarantined page", http.StatusNotFound)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			if err := store.DeletePage(page.Name, clock()); err != nil {
+				log.Printf("Error: %v\n", err)
+				http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Deleted Spam : %s\n", page.Name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// releasing the page doesn't change it, so the author's editor can carry on from the same version
+		page.Quarantined = false
+		errUpdate := store.UpdatePage(*page, page.Version)
+		if errUpdate == ErrVersionConflict {
+			http.Error(w, "409 the page changed while releasing it, please try again", http.StatusConflict)
+			return
+		}
+		if errUpdate != nil {
+			log.Printf("Error: %v\n", errUpdate)
+			http.Error(w, "500 internal server error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Released : %s\n", page.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		sendJson(w, newApiPage(page))
+	}
+}
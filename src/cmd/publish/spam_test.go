@@ -0,0 +1,314 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSpamFilters makes every page go through `filters` until the test is done.
+func useSpamFilters(t *testing.T, filters ...SpamFilter) {
+	orig := spamFilters
+	t.Cleanup(func() { spamFilters = orig })
+
+	spamFilters = filters
+}
+
+func TestLinkDensityFilter(t *testing.T) {
+	words := strings.Repeat("word ", 100)
+	tests := []struct {
+		content string
+		spam    bool
+	}{
+		{"Just some words about nothing much.", false},
+		{"Read https://example.com and www.example.org for more. " + words, false},
+		{strings.Repeat("cheap https://example.com/pills ", 5), true},
+		{strings.Repeat("see [this](http://example.com) ", 10) + words, false},
+		{strings.Repeat("see [this](http://example.com) ", 50) + words + words + words + words + words, true},
+	}
+
+	for i, test := range tests {
+		score, reason := linkDensityFilter{}.Score(SpamSubmission{Page: &Page{Title: "Hello", Content: test.content}})
+		if (score >= spamThreshold) != test.spam {
+			t.Errorf("%d: scored %d (%s)", i, score, reason)
+		}
+	}
+}
+
+func TestBlocklistFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := ioutil.WriteFile(path, []byte("# spammers\nspam.example\n\n.pills.example # and their friends\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	blocklist, err := loadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		page    Page
+		blocked string
+	}{
+		{Page{Content: "Nothing to see here, not even spam.example"}, ""},
+		{Page{Content: "Go to https://SPAM.example/now"}, "spam.example"},
+		{Page{Content: "Go to www.cheap.pills.example"}, "pills.example"},
+		{Page{Content: "Go to https://notspam.example"}, ""},
+		{Page{Website: "http://shop.spam.example"}, "spam.example"},
+	}
+
+	for i, test := range tests {
+		score, reason := blocklist.Score(SpamSubmission{Page: &test.page})
+		if (score >= spamThreshold) != (test.blocked != "") || (test.blocked != "" && reason != "links to "+test.blocked) {
+			t.Errorf("%d: scored %d (%s)", i, score, reason)
+		}
+	}
+}
+
+func TestRepeatFilter(t *testing.T) {
+	now := fakeClock(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	rf := newRepeatFilter()
+
+	content := strings.Repeat("Buy the best things from us today. ", 5)
+	score := func(page, previous *Page) int {
+		sub := SpamSubmission{Page: page, Previous: previous}
+		s, _ := rf.Score(sub)
+		rf.Record(sub)
+		return s
+	}
+
+	// content which is only checked, and never saved, doesn't count
+	for i := 0; i < spamMaxRepeats+1; i++ {
+		if s, _ := rf.Score(SpamSubmission{Page: &Page{Content: content}}); s != 0 {
+			t.Fatalf("%d: scored %d without being saved", i, s)
+		}
+	}
+
+	for i := 0; i < spamMaxRepeats; i++ {
+		if s := score(&Page{Content: content}, nil); s != 0 {
+			t.Fatalf("%d: scored %d too soon", i, s)
+		}
+	}
+
+	// saving the same page again without changing it doesn't count
+	if s := score(&Page{Content: content}, &Page{Content: content}); s != 0 {
+		t.Fatalf("an unchanged page scored %d", s)
+	}
+
+	// but the same content again does, even if it is dressed up a little
+	if s := score(&Page{Content: strings.ToUpper(content) + "\n\n"}, nil); s < spamThreshold {
+		t.Fatalf("repeated content scored %d", s)
+	}
+
+	// short content is too likely to repeat by chance
+	for i := 0; i < spamMaxRepeats+1; i++ {
+		if s := score(&Page{Content: "Hello, World!"}, nil); s != 0 {
+			t.Fatalf("short content scored %d", s)
+		}
+	}
+
+	// and it starts again after the window
+	*now = now.Add(spamRepeatWindow)
+	if s := score(&Page{Content: content}, nil); s != 0 {
+		t.Fatalf("content from before the window scored %d", s)
+	}
+}
+
+func TestRepeatsOnlyCountOnceSaved(t *testing.T) {
+	fakeClock(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	useSpamFilters(t, newRepeatFilter())
+	store := NewMemoryStore()
+	content := strings.Repeat("Buy the best things from us today. ", 5)
+
+	put := putTestPage(t, store, "Deals")
+	name := put.Payload["name"].(string)
+	page, _ := store.GetPage(name)
+
+	// an editor who keeps trying to save over a newer version never gets anywhere, so none of it counts
+	for i := 0; i < spamMaxRepeats+1; i++ {
+		stale := *page
+		if err := editPage(store, &stale, Page{Title: "Deals", Content: content, Version: page.Version - 1}, ""); err != ErrVersionConflict {
+			t.Fatalf("expected ErrVersionConflict, got %v", err)
+		}
+	}
+
+	// nor does content the store refuses to save
+	for i := 0; i < spamMaxRepeats+1; i++ {
+		missing := Page{Name: "missing-aaaaaaaa", Version: 1}
+		if err := editPage(store, &missing, Page{Title: "Deals", Content: content, Version: 1}, ""); err != ErrVersionConflict {
+			t.Fatalf("expected ErrVersionConflict for a missing page, got %v", err)
+		}
+	}
+
+	// so the first few which are saved are fine, and only the one after that is quarantined
+	for i := 0; i <= spamMaxRepeats; i++ {
+		w := httptest.NewRecorder()
+		body := `{"title":"Deals","content":"` + content + `"}`
+		apiPut(store)(w, httptest.NewRequest("PUT", "/api", strings.NewReader(body)))
+		quarantined := strings.Contains(w.Body.String(), `"quarantined":true`)
+		if quarantined != (i == spamMaxRepeats) {
+			t.Fatalf("%d: unexpected response %s", i, w.Body.String())
+		}
+	}
+}
+
+func TestApiV1HasNoHoneypot(t *testing.T) {
+	useSpamFilters(t, honeypotFilter{}, linkDensityFilter{})
+	store := NewMemoryStore()
+
+	// whatever is in the editor's hidden field means nothing here
+	page := apiPage{}
+	w := callApiV1(t, store, "POST", "/api/v1/pages", `{"title":"Hello","content":"World","email":"bot@example.com"}`, &page)
+	if w.Code != http.StatusCreated || page.Quarantined {
+		t.Fatalf("create with an email: %d %s", w.Code, w.Body.String())
+	}
+
+	// but the other filters still apply
+	body := `{"title":"Deals","content":"` + strings.Repeat("https://example.com/deal ", 10) + `"}`
+	w = callApiV1(t, store, "POST", "/api/v1/pages", body, &page)
+	if w.Code != http.StatusCreated || !page.Quarantined {
+		t.Fatalf("create with lots of links: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	useSpamFilters(t, honeypotFilter{}, linkDensityFilter{})
+	store := NewMemoryStore()
+
+	// people don't fill in the honeypot
+	w := httptest.NewRecorder()
+	apiPut(store)(w, httptest.NewRequest("PUT", "/api", strings.NewReader(`{"title":"Hello","content":"World"}`)))
+	resp := testResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Ok || resp.Payload["quarantined"] != false {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+
+	// but bots do
+	w = httptest.NewRecorder()
+	apiPut(store)(w, httptest.NewRequest("PUT", "/api", strings.NewReader(`{"title":"Hello","content":"World","email":"bot@example.com"}`)))
+	resp = testResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Ok || resp.Payload["quarantined"] != true {
+		t.Fatalf("expected the page to be quarantined, got %s", w.Body.String())
+	}
+	name := resp.Payload["name"].(string)
+	secret := resp.Payload["id"].(string)
+
+	// nobody but its author can see it
+	w = callApiV1(t, store, "GET", "/api/v1/pages/"+name, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("get a quarantined page: %d %s", w.Code, w.Body.String())
+	}
+	w = callApiV1WithSecret(t, store, "GET", "/api/v1/pages/"+name, secret, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get a quarantined page with its secret: %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	sitemap(w, httptest.NewRequest("GET", "/sitemap.txt", nil), "http://localhost", store)
+	if strings.Contains(w.Body.String(), name) {
+		t.Fatalf("a quarantined page is in the sitemap:\n%s", w.Body.String())
+	}
+
+	// editing it doesn't let it out
+	page, _ := store.GetPage(name)
+	if err := editPage(store, page, Page{Title: "Hello", Content: "Nothing to see", Version: 1}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := store.GetPage(name); !page.Quarantined {
+		t.Fatal("editing a page let it out of quarantine")
+	}
+
+	// only an operator can
+	w = httptest.NewRecorder()
+	adminQuarantine(store)(w, httptest.NewRequest("GET", "/admin/quarantine", nil))
+	list := struct{ Pages []apiPage }{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Pages) != 1 || list.Pages[0].Name != name {
+		t.Fatalf("unexpected list of quarantined pages: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	adminQuarantine(store)(w, httptest.NewRequest("POST", "/admin/quarantine?name="+name, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("release: %d %s", w.Code, w.Body.String())
+	}
+	page, _ = store.GetPage(name)
+	if page.Quarantined || page.Version != 2 {
+		t.Fatalf("unexpected page after releasing it: %#v", page)
+	}
+	w = callApiV1(t, store, "GET", "/api/v1/pages/"+name, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get a released page: %d %s", w.Code, w.Body.String())
+	}
+
+	// which can't be done twice
+	w = httptest.NewRecorder()
+	adminQuarantine(store)(w, httptest.NewRequest("POST", "/admin/quarantine?name="+name, nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("release again: %d %s", w.Code, w.Body.String())
+	}
+
+	// and a page full of links is quarantined when it's edited too, through either API
+	body := `{"title":"Deals","content":"` + strings.Repeat("https://example.com/deal ", 10) + `","version":2}`
+	w = callApiV1WithSecret(t, store, "PUT", "/api/v1/pages/"+name, secret, body, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"quarantined":true`) {
+		t.Fatalf("update with lots of links: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	adminQuarantine(store)(w, httptest.NewRequest("DELETE", "/admin/quarantine?name="+name, nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if page, _ := store.GetPage(name); !page.IsDeleted() {
+		t.Fatal("the page wasn't deleted")
+	}
+}
+
+func TestRestoringSpamIsQuarantined(t *testing.T) {
+	store := NewMemoryStore()
+	put := putTestPage(t, store, "Deals")
+	id := put.Payload["id"].(string)
+	name := put.Payload["name"].(string)
+
+	// a revision full of links from before the filters were turned on
+	saveTestEdit(t, store, name, func(page *Page) { page.Content = strings.Repeat("https://example.com/deal ", 10) })
+	saveTestEdit(t, store, name, func(page *Page) { page.Content = "Nothing to see" })
+	revisions, err := store.ListRevisions(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useSpamFilters(t, linkDensityFilter{})
+	resp := testResponse{}
+	body := fmt.Sprintf(`{"id":%q,"rev":"%d"}`, id, revisionOf(revisions[0]))
+	callRevisions(t, store, "POST", "/api/revisions", body, &resp)
+	if !resp.Ok || resp.Payload["quarantined"] != true {
+		t.Fatalf("expected the restored page to be quarantined, got %+v", resp)
+	}
+	if page, _ := store.GetPage(name); !page.Quarantined || !strings.Contains(page.Content, "deal") {
+		t.Fatalf("unexpected page after restoring spam: %#v", page)
+	}
+}
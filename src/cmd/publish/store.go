@@ -20,141 +20,128 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"log"
-
-	"github.com/boltdb/bolt"
+	"fmt"
+	"io"
+	"strings"
+	"time"
 )
 
-var ErrFatalNoPageBucket = errors.New("Bucket 'page' does not exist")
-var ErrFatalNoIdBucket = errors.New("Bucket 'id' does not exist")
-
-var pageBucketName = []byte("page")
-var idBucketName = []byte("id")
+var ErrInvalidPageName = errors.New("Invalid page name")
+var ErrPageNameExists = errors.New("Page name already exists")
+var ErrPageIdExists = errors.New("Page Id already exists")
+var ErrVersionConflict = errors.New("Page has been changed since that version")
 
-func storeIteratePages(db *bolt.DB, fn func(k, v []byte) error) error {
-	return db.View(func(tx *bolt.Tx) error {
-		// get the page bucket
-		pageBucket := tx.Bucket(pageBucketName)
-		if pageBucket == nil {
-			panic(ErrFatalNoPageBucket)
-		}
-
-		// now, iterate over every page
-		if err := pageBucket.ForEach(fn); err != nil {
-			return err
-		}
-
-		return nil
-	})
+// validPageName is false for names which could never have come from slugify() and aren't safe to use as a filename.
+func validPageName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
 }
 
-func storeGetPageUsingId(db *bolt.DB, id string) (*Page, error) {
-	var p *Page
-
-	// firstly, get this Id and see if it exists
-	err := db.View(func(tx *bolt.Tx) error {
-		idBucket := tx.Bucket(idBucketName)
-		if idBucket == nil {
-			panic(ErrFatalNoIdBucket)
-		}
-
-		// get this Id
-		rawName := idBucket.Get([]byte(id))
-		if rawName == nil {
-			return nil
-		}
-
-		// now get this page
-		name := string(rawName)
-
-		pageBucket := tx.Bucket(pageBucketName)
-		if pageBucket == nil {
-			panic(ErrFatalNoPageBucket)
-		}
-
-		rawPage := pageBucket.Get([]byte(name))
-
-		// see if this exists
-		if rawPage == nil {
-			log.Printf("Not Found : %s\n", name)
-			return nil
-		}
-
-		// try and decode
-		page := Page{}
-		err := json.Unmarshal(rawPage, &page)
-		if err != nil {
-			return err
-		}
-		p = &page
-		return nil
-	})
+// PageStore is everything the handlers need from a datastore. A nil *Page with a nil error means the page was not
+// found. IteratePages walks every page in name order, and `fn` must not write back to the store while it does.
+//
+// CreatePage saves a new page, checking in the same transaction that neither its name nor Id are in use already, and
+// returns ErrPageNameExists or ErrPageIdExists if they are. PutPage overwrites whatever is there.
+//
+// UpdatePage saves the page only if the one already there is at `version`, checking in the same transaction, and
+// otherwise (or if there is no page) returns ErrVersionConflict. The caller sets the page's new Version.
+//
+// DeletePage removes the page's Id, content and any revisions, leaving just a tombstone (see tombstone()) so that we
+// know the page used to exist. Deleting a page which doesn't exist is not an error. DeletePageIfExpired does the same
+// at the page's expiry time, but only if it has expired by `now`, checking in the same transaction, and returns
+// whether it did.
+type PageStore interface {
+	GetPage(name string) (*Page, error)
+	GetPageUsingId(id string) (*Page, error)
+	CreatePage(page Page) error
+	PutPage(page Page) error
+	UpdatePage(page Page, version int64) error
+	DeletePage(name string, deleted time.Time) error
+	DeletePageIfExpired(name string, now time.Time) (bool, error)
+	IteratePages(fn func(page *Page) error) error
+	Close() error
+}
 
-	return p, err
+// RevisionStore is implemented by stores which keep every previous version of a page whenever it is saved with a new
+// Updated time. A revision is identified by that Updated time, in nanoseconds.
+type RevisionStore interface {
+	ListRevisions(name string) ([]*Page, error) // newest first, not including the current page
+	GetRevision(name string, rev int64) (*Page, error)
 }
 
-func storeGetPage(db *bolt.DB, name string) (*Page, error) {
-	var p *Page
+// BatchUpdater is implemented by stores which can change many pages in one transaction. UpdatePages reads each of the
+// named pages in turn and calls `fn` with it, saving the page if `fn` returns true. Pages which don't exist are
+// skipped.
+type BatchUpdater interface {
+	UpdatePages(names []string, fn func(page *Page) bool) error
+}
 
-	// see if we can find this page
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(pageBucketName)
-		if b == nil {
-			panic(ErrFatalNoPageBucket)
-		}
+// BatchGetter is implemented by stores which can read many pages in one transaction. GetPages returns them in the
+// same order as `names`, with nil for any which don't exist.
+type BatchGetter interface {
+	GetPages(names []string) ([]*Page, error)
+}
 
-		raw := b.Get([]byte(name))
+// Snapshotter is implemented by stores which can write a consistent copy of all their data while still in use.
+type Snapshotter interface {
+	WriteSnapshot(w io.Writer) (int64, error)
+}
 
-		// see if this exists
-		if raw == nil {
-			log.Printf("Not Found : %s\n", name)
-			return nil
-		}
+// deleteWhen decides whether to delete the page as it is in the transaction, and when it was deleted.
+type deleteWhen func(page *Page) (time.Time, bool)
 
-		// try and decode
-		page := Page{}
-		err := json.Unmarshal(raw, &page)
-		if err != nil {
-			return err
-		}
-		p = &page
-		return nil
-	})
+// deleteAt always deletes the page, at `deleted`.
+func deleteAt(deleted time.Time) deleteWhen {
+	return func(page *Page) (time.Time, bool) {
+		return deleted, true
+	}
+}
 
-	return p, err
+// deleteIfExpired only deletes the page if it has expired by `now`, at its expiry time.
+func deleteIfExpired(now time.Time) deleteWhen {
+	return func(page *Page) (time.Time, bool) {
+		return page.Expires, !page.IsDeleted() && page.IsExpired(now)
+	}
 }
 
-func storePutPage(db *bolt.DB, page Page) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		pageBucket := tx.Bucket(pageBucketName)
-		if pageBucket == nil {
-			panic(ErrFatalNoPageBucket)
-		}
+// revisionOf returns the number which identifies this version of the page.
+func revisionOf(page *Page) int64 {
+	return page.Updated.UnixNano()
+}
 
-		// write this page out
-		bytes, errMarshal := json.Marshal(page)
-		if errMarshal != nil {
-			return errMarshal
-		}
+// tombstone returns what is left of a page once it has been deleted. Its Version still goes up, so that an editor who
+// loaded the page before it was deleted can't save over it.
+func tombstone(page *Page, deleted time.Time) Page {
+	return Page{
+		Name:     page.Name,
+		Inserted: page.Inserted,
+		Updated:  deleted,
+		Deleted:  deleted,
+		Version:  page.Version + 1,
+	}
+}
 
-		errPutPage := pageBucket.Put([]byte(page.Name), bytes)
-		if errPutPage != nil {
-			return errPutPage
+// openStore returns the PageStore named by `kind`, using `path` as its location if it needs one.
+func openStore(kind, path string) (PageStore, error) {
+	switch kind {
+	case "", "bolt":
+		if path == "" {
+			path = "publish.db"
 		}
-
-		// and make sure we have an Id pointing to this name
-		idBucket := tx.Bucket(idBucketName)
-		if idBucket == nil {
-			panic(ErrFatalNoIdBucket)
+		return NewBoltStore(path)
+	case "sqlite":
+		if path == "" {
+			path = "publish.sqlite"
 		}
-
-		errPutId := idBucket.Put([]byte(page.Id), []byte(page.Name))
-		if errPutId != nil {
-			return errPutId
+		return NewSQLiteStore(path)
+	case "fs":
+		if path == "" {
+			path = "pages"
 		}
+		return NewFileStore(path)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
 
-		return nil
-	})
+	return nil, fmt.Errorf("Unknown store '%s'", kind)
 }
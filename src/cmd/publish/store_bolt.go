@@ -0,0 +1,1208 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var ErrFatalNoPageBucket = errors.New("Bucket 'page' does not exist")
+var ErrFatalNoIdBucket = errors.New("Bucket 'id' does not exist")
+var ErrFatalNoRevisionBucket = errors.New("Bucket 'revision' does not exist")
+var ErrFatalNoInsertedBucket = errors.New("Bucket 'inserted' does not exist")
+var ErrFatalNoAuthorBucket = errors.New("Bucket 'author' does not exist")
+var ErrFatalNoSearchBucket = errors.New("Bucket 'search' does not exist")
+var ErrFatalNoViewsBucket = errors.New("Bucket 'views' does not exist")
+var ErrFatalNoUploadBucket = errors.New("Bucket 'upload' does not exist")
+var ErrFatalNoUploadPageBucket = errors.New("Bucket 'upload-page' does not exist")
+var ErrFatalNoPageUploadBucket = errors.New("Bucket 'page-upload' does not exist")
+
+var pageBucketName = []byte("page")
+var idBucketName = []byte("id")
+var revisionBucketName = []byte("revision")
+var insertedBucketName = []byte("inserted")
+var authorBucketName = []byte("author")
+var searchBucketName = []byte("search")
+var viewsBucketName = []byte("views")
+var uploadBucketName = []byte("upload")
+var uploadPageBucketName = []byte("upload-page")
+var pageUploadBucketName = []byte("page-upload")
+
+// BoltStore keeps each page as JSON in the 'page' bucket (keyed by name) and maps each secret Id to that name in the
+// 'id' bucket. Previous versions of each page are kept in the 'revision' bucket, see revisionKey(). The 'meta' bucket
+// records which version of the schema the data is in, see Migrate(), and how many pages are indexed. The 'inserted' and
+// 'author' buckets index the visible pages, see boltIndexPage(), and the 'search' bucket is an inverted index of them,
+// see boltSearchIndexPage(). The 'views' bucket holds how many times each page has been viewed, as a big-endian uint64,
+// and the 'upload' bucket holds every uploaded file, keyed by uploadKey(). Which pages each upload was for is kept both
+// ways round, in 'upload-page' and 'page-upload', see uploadPageKey().
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, errOpen := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	errUpdate := db.Update(func(tx *bolt.Tx) error {
+		_, err1 := tx.CreateBucketIfNotExists(pageBucketName)
+		if err1 != nil {
+			return err1
+		}
+
+		_, err2 := tx.CreateBucketIfNotExists(idBucketName)
+		if err2 != nil {
+			return err2
+		}
+
+		_, err3 := tx.CreateBucketIfNotExists(revisionBucketName)
+		if err3 != nil {
+			return err3
+		}
+
+		_, err4 := tx.CreateBucketIfNotExists(metaBucketName)
+		if err4 != nil {
+			return err4
+		}
+
+		_, err5 := tx.CreateBucketIfNotExists(insertedBucketName)
+		if err5 != nil {
+			return err5
+		}
+
+		_, err6 := tx.CreateBucketIfNotExists(authorBucketName)
+		if err6 != nil {
+			return err6
+		}
+
+		_, err7 := tx.CreateBucketIfNotExists(searchBucketName)
+		if err7 != nil {
+			return err7
+		}
+
+		_, err8 := tx.CreateBucketIfNotExists(viewsBucketName)
+		if err8 != nil {
+			return err8
+		}
+
+		_, err9 := tx.CreateBucketIfNotExists(uploadBucketName)
+		if err9 != nil {
+			return err9
+		}
+
+		_, err10 := tx.CreateBucketIfNotExists(uploadPageBucketName)
+		if err10 != nil {
+			return err10
+		}
+
+		_, err11 := tx.CreateBucketIfNotExists(pageUploadBucketName)
+		if err11 != nil {
+			return err11
+		}
+
+		return nil
+	})
+	if errUpdate != nil {
+		db.Close()
+		return nil, errUpdate
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// WriteSnapshot writes the whole database file as it is at the start of a read transaction, so that writes can carry on
+// while it streams.
+func (s *BoltStore) WriteSnapshot(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// readBoltPages calls `fn` with every page in the BoltDB file at `path`, which is opened read-only so that it is left
+// exactly as it was. Unlike NewBoltStore, it doesn't create any buckets.
+func readBoltPages(path string, fn func(page *Page) error) error {
+	// bolt creates the file if it isn't there, even when opening it read-only
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, errOpen := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if errOpen != nil {
+		return errOpen
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pageBucketName)
+		if b == nil {
+			return ErrFatalNoPageBucket
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			page := Page{}
+			if err := decodePage(v, &page); err != nil {
+				return err
+			}
+			return fn(&page)
+		})
+	})
+}
+
+func (s *BoltStore) IteratePages(fn func(page *Page) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		// get the page bucket
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		// now, iterate over every page
+		return pageBucket.ForEach(func(k, v []byte) error {
+			page := Page{}
+			err := decodePage(v, &page)
+			if err != nil {
+				return err
+			}
+			return fn(&page)
+		})
+	})
+}
+
+func (s *BoltStore) GetPageUsingId(id string) (*Page, error) {
+	var p *Page
+
+	// firstly, get this Id and see if it exists
+	err := s.db.View(func(tx *bolt.Tx) error {
+		idBucket := tx.Bucket(idBucketName)
+		if idBucket == nil {
+			panic(ErrFatalNoIdBucket)
+		}
+
+		// get this Id
+		rawName := idBucket.Get([]byte(id))
+		if rawName == nil {
+			return nil
+		}
+
+		// now get this page
+		name := string(rawName)
+
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		rawPage := pageBucket.Get([]byte(name))
+
+		// see if this exists
+		if rawPage == nil {
+			log.Printf("Not Found : %s\n", name)
+			return nil
+		}
+
+		// try and decode
+		page := Page{}
+		err := decodePage(rawPage, &page)
+		if err != nil {
+			return err
+		}
+		p = &page
+		return nil
+	})
+
+	return p, err
+}
+
+func (s *BoltStore) GetPage(name string) (*Page, error) {
+	var p *Page
+
+	// see if we can find this page
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pageBucketName)
+		if b == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		raw := b.Get([]byte(name))
+
+		// see if this exists
+		if raw == nil {
+			log.Printf("Not Found : %s\n", name)
+			return nil
+		}
+
+		// try and decode
+		page := Page{}
+		err := decodePage(raw, &page)
+		if err != nil {
+			return err
+		}
+		p = &page
+		return nil
+	})
+
+	return p, err
+}
+
+func (s *BoltStore) GetPages(names []string) ([]*Page, error) {
+	pages := make([]*Page, len(names))
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pageBucketName)
+		if b == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		for i, name := range names {
+			raw := b.Get([]byte(name))
+			if raw == nil {
+				continue
+			}
+
+			page := Page{}
+			if err := decodePage(raw, &page); err != nil {
+				return err
+			}
+			pages[i] = &page
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pages, nil
+}
+
+func (s *BoltStore) CreatePage(page Page) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		idBucket := tx.Bucket(idBucketName)
+		if idBucket == nil {
+			panic(ErrFatalNoIdBucket)
+		}
+
+		// make sure we're not about to overwrite someone else's page or secret
+		if pageBucket.Get([]byte(page.Name)) != nil {
+			return ErrPageNameExists
+		}
+		if idBucket.Get([]byte(page.Id)) != nil {
+			return ErrPageIdExists
+		}
+
+		return boltPutPage(tx, page)
+	})
+}
+
+func (s *BoltStore) PutPage(page Page) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutPage(tx, page)
+	})
+}
+
+func (s *BoltStore) UpdatePage(page Page, version int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		raw := pageBucket.Get([]byte(page.Name))
+		if raw == nil {
+			return ErrVersionConflict
+		}
+
+		current := Page{}
+		if err := decodePage(raw, &current); err != nil {
+			return err
+		}
+		if current.Version != version {
+			return ErrVersionConflict
+		}
+
+		return boltPutPage(tx, page)
+	})
+}
+
+func (s *BoltStore) UpdatePages(names []string, fn func(page *Page) bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		for _, name := range names {
+			raw := pageBucket.Get([]byte(name))
+			if raw == nil {
+				continue
+			}
+
+			page := Page{}
+			if err := decodePage(raw, &page); err != nil {
+				return err
+			}
+			if !fn(&page) {
+				continue
+			}
+
+			if err := boltPutPage(tx, page); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// boltPutPage writes the page and its Id, keeping the previous version as a revision.
+func boltPutPage(tx *bolt.Tx, page Page) error {
+	pageBucket := tx.Bucket(pageBucketName)
+	if pageBucket == nil {
+		panic(ErrFatalNoPageBucket)
+	}
+
+	idBucket := tx.Bucket(idBucketName)
+	if idBucket == nil {
+		panic(ErrFatalNoIdBucket)
+	}
+
+	// if this is a new version of an existing page, keep the old one
+	if rawPrev := pageBucket.Get([]byte(page.Name)); rawPrev != nil {
+		prev := Page{}
+		errUnmarshal := decodePage(rawPrev, &prev)
+		if errUnmarshal != nil {
+			return errUnmarshal
+		}
+
+		errArchive := archiveRevision(tx, &prev, rawPrev, page.Updated)
+		if errArchive != nil {
+			return errArchive
+		}
+
+		errUnindex := boltIndexPage(tx, &prev, false)
+		if errUnindex != nil {
+			return errUnindex
+		}
+
+		errUnsearch := boltSearchIndexPage(tx, &prev, false)
+		if errUnsearch != nil {
+			return errUnsearch
+		}
+
+		// and if the Id has changed, the old one should no longer point here
+		if prev.Id != "" && prev.Id != page.Id {
+			errDelId := idBucket.Delete([]byte(prev.Id))
+			if errDelId != nil {
+				return errDelId
+			}
+		}
+	}
+
+	// write this page out
+	raw, errMarshal := encodePage(page)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	errPutPage := pageBucket.Put([]byte(page.Name), raw)
+	if errPutPage != nil {
+		return errPutPage
+	}
+
+	errIndex := boltIndexPage(tx, &page, true)
+	if errIndex != nil {
+		return errIndex
+	}
+
+	errSearch := boltSearchIndexPage(tx, &page, true)
+	if errSearch != nil {
+		return errSearch
+	}
+
+	// and make sure we have an Id pointing to this name
+	if page.Id == "" {
+		return nil
+	}
+
+	errPutId := idBucket.Put([]byte(page.Id), []byte(page.Name))
+	if errPutId != nil {
+		return errPutId
+	}
+
+	return nil
+}
+
+func (s *BoltStore) DeletePage(name string, deleted time.Time) error {
+	_, err := s.deletePage(name, deleteAt(deleted))
+	return err
+}
+
+func (s *BoltStore) DeletePageIfExpired(name string, now time.Time) (bool, error) {
+	return s.deletePage(name, deleteIfExpired(now))
+}
+
+func (s *BoltStore) deletePage(name string, when deleteWhen) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		raw := pageBucket.Get([]byte(name))
+		if raw == nil {
+			return nil
+		}
+
+		page := Page{}
+		errUnmarshal := decodePage(raw, &page)
+		if errUnmarshal != nil {
+			return errUnmarshal
+		}
+
+		at, ok := when(&page)
+		if !ok {
+			return nil
+		}
+
+		// remove the Id so nobody can edit it again
+		idBucket := tx.Bucket(idBucketName)
+		if idBucket == nil {
+			panic(ErrFatalNoIdBucket)
+		}
+
+		if page.Id != "" {
+			errDelId := idBucket.Delete([]byte(page.Id))
+			if errDelId != nil {
+				return errDelId
+			}
+		}
+
+		errUnindex := boltIndexPage(tx, &page, false)
+		if errUnindex != nil {
+			return errUnindex
+		}
+
+		errUnsearch := boltSearchIndexPage(tx, &page, false)
+		if errUnsearch != nil {
+			return errUnsearch
+		}
+
+		// remove every revision, collecting the keys first since we can't delete while iterating
+		revisionBucket := tx.Bucket(revisionBucketName)
+		if revisionBucket == nil {
+			panic(ErrFatalNoRevisionBucket)
+		}
+
+		keys := [][]byte{}
+		prefix := append([]byte(name), 0)
+		c := revisionBucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			errDelRev := revisionBucket.Delete(k)
+			if errDelRev != nil {
+				return errDelRev
+			}
+		}
+
+		viewsBucket := tx.Bucket(viewsBucketName)
+		if viewsBucket == nil {
+			panic(ErrFatalNoViewsBucket)
+		}
+
+		errDelViews := viewsBucket.Delete([]byte(name))
+		if errDelViews != nil {
+			return errDelViews
+		}
+
+		// and finally, replace the page with its tombstone
+		rawTombstone, errMarshal := encodePage(tombstone(&page, at))
+		if errMarshal != nil {
+			return errMarshal
+		}
+
+		deleted = true
+		return pageBucket.Put([]byte(name), rawTombstone)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// revisionKey is the page name, a zero byte, then the revision as a big-endian uint64 so that each page's revisions are
+// together and in time order.
+func revisionKey(name string, rev int64) []byte {
+	key := make([]byte, len(name)+1+8)
+	copy(key, name)
+	binary.BigEndian.PutUint64(key[len(name)+1:], uint64(rev))
+	return key
+}
+
+// archiveRevision copies the previous version of the page (both decoded and `raw`) into the revision bucket, unless it
+// has the same Updated time as the page replacing it (e.g. when only the HTML has been regenerated).
+func archiveRevision(tx *bolt.Tx, prev *Page, raw []byte, updated time.Time) error {
+	if prev.Updated.Equal(updated) {
+		return nil
+	}
+
+	revisionBucket := tx.Bucket(revisionBucketName)
+	if revisionBucket == nil {
+		panic(ErrFatalNoRevisionBucket)
+	}
+
+	return revisionBucket.Put(revisionKey(prev.Name, revisionOf(prev)), raw)
+}
+
+func (s *BoltStore) ListRevisions(name string) ([]*Page, error) {
+	pages := []*Page{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revisionBucket := tx.Bucket(revisionBucketName)
+		if revisionBucket == nil {
+			panic(ErrFatalNoRevisionBucket)
+		}
+
+		// walk through all the keys with this prefix
+		prefix := append([]byte(name), 0)
+		c := revisionBucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			page := Page{}
+			err := decodePage(v, &page)
+			if err != nil {
+				return err
+			}
+			pages = append(pages, &page)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// reverse them so that the newest is first
+	for i, j := 0, len(pages)-1; i < j; i, j = i+1, j-1 {
+		pages[i], pages[j] = pages[j], pages[i]
+	}
+
+	return pages, nil
+}
+
+func (s *BoltStore) GetRevision(name string, rev int64) (*Page, error) {
+	var p *Page
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revisionBucket := tx.Bucket(revisionBucketName)
+		if revisionBucket == nil {
+			panic(ErrFatalNoRevisionBucket)
+		}
+
+		raw := revisionBucket.Get(revisionKey(name, rev))
+		if raw == nil {
+			return nil
+		}
+
+		page := Page{}
+		err := decodePage(raw, &page)
+		if err != nil {
+			return err
+		}
+		p = &page
+		return nil
+	})
+
+	return p, err
+}
+
+// ImportPages saves all of the pages in one transaction, so a failure part way through imports none of them.
+func (s *BoltStore) ImportPages(pages []Page, onConflict string) (*ImportResult, error) {
+	var result *ImportResult
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		result, err = importPages(boltPageTx{tx}, pages, onConflict)
+		return err
+	})
+	return result, err
+}
+
+type boltPageTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltPageTx) nameExists(name string) (bool, error) {
+	pageBucket := t.tx.Bucket(pageBucketName)
+	if pageBucket == nil {
+		panic(ErrFatalNoPageBucket)
+	}
+	return pageBucket.Get([]byte(name)) != nil, nil
+}
+
+func (t boltPageTx) idName(id string) (string, error) {
+	idBucket := t.tx.Bucket(idBucketName)
+	if idBucket == nil {
+		panic(ErrFatalNoIdBucket)
+	}
+	return string(idBucket.Get([]byte(id))), nil
+}
+
+func (t boltPageTx) putPage(page Page) error {
+	return boltPutPage(t.tx, page)
+}
+
+// authorIndexPrefix is the start of every key in the 'author' bucket for this (normalised) author.
+func authorIndexPrefix(author string) []byte {
+	return append([]byte(author), 0)
+}
+
+// getIndexedCount is how many pages are in the 'inserted' index, which is kept in the 'meta' bucket so that searching
+// doesn't have to count them.
+func getIndexedCount(tx *bolt.Tx) (int, error) {
+	metaBucket := tx.Bucket(metaBucketName)
+	if metaBucket == nil {
+		panic(ErrFatalNoMetaBucket)
+	}
+
+	raw := metaBucket.Get(indexedCountKey)
+	if raw == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(raw))
+}
+
+func putIndexedCount(tx *bolt.Tx, count int) error {
+	metaBucket := tx.Bucket(metaBucketName)
+	if metaBucket == nil {
+		panic(ErrFatalNoMetaBucket)
+	}
+
+	return metaBucket.Put(indexedCountKey, []byte(strconv.Itoa(count)))
+}
+
+func addIndexedCount(tx *bolt.Tx, delta int) error {
+	count, err := getIndexedCount(tx)
+	if err != nil {
+		return err
+	}
+	return putIndexedCount(tx, count+delta)
+}
+
+// boltIndexPage adds the page to the 'inserted' and 'author' indexes if it is visible, or if `add` is false removes it
+// from them. The keys are listPosition(page), after the author prefix in the 'author' bucket, and the values are empty.
+// It also keeps the count of indexed pages up to date, see getIndexedCount().
+func boltIndexPage(tx *bolt.Tx, page *Page, add bool) error {
+	insertedBucket := tx.Bucket(insertedBucketName)
+	if insertedBucket == nil {
+		panic(ErrFatalNoInsertedBucket)
+	}
+
+	authorBucket := tx.Bucket(authorBucketName)
+	if authorBucket == nil {
+		panic(ErrFatalNoAuthorBucket)
+	}
+
+	pos := listPosition(page)
+	author := normaliseAuthor(page.Author)
+	authorKey := append(authorIndexPrefix(author), pos...)
+
+	indexed := insertedBucket.Get(pos) != nil
+
+	if !add {
+		if indexed {
+			errDelInserted := insertedBucket.Delete(pos)
+			if errDelInserted != nil {
+				return errDelInserted
+			}
+			errCount := addIndexedCount(tx, -1)
+			if errCount != nil {
+				return errCount
+			}
+		}
+		return authorBucket.Delete(authorKey)
+	}
+
+	if !page.IsVisible() {
+		return nil
+	}
+
+	if !indexed {
+		errPutInserted := insertedBucket.Put(pos, []byte{})
+		if errPutInserted != nil {
+			return errPutInserted
+		}
+		errCount := addIndexedCount(tx, 1)
+		if errCount != nil {
+			return errCount
+		}
+	}
+
+	if author == "" {
+		return nil
+	}
+	return authorBucket.Put(authorKey, []byte{})
+}
+
+func (s *BoltStore) ListNewestPages(cursor string, limit int) ([]*Page, string, error) {
+	return s.listPages(insertedBucketName, ErrFatalNoInsertedBucket, []byte{}, cursor, limit)
+}
+
+func (s *BoltStore) ListAuthorPages(author string, cursor string, limit int) ([]*Page, string, error) {
+	return s.listPages(authorBucketName, ErrFatalNoAuthorBucket, authorIndexPrefix(author), cursor, limit)
+}
+
+// listPages walks backwards through the keys in the index bucket which start with `prefix` and come before the cursor.
+func (s *BoltStore) listPages(bucketName []byte, errNoBucket error, prefix []byte, cursor string, limit int) ([]*Page, string, error) {
+	before, errCursor := decodeCursor(cursor)
+	if errCursor != nil {
+		return nil, "", errCursor
+	}
+
+	pages := []*Page{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		indexBucket := tx.Bucket(bucketName)
+		if indexBucket == nil {
+			panic(errNoBucket)
+		}
+
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+
+		// find the first key after the ones we want, then step back from there
+		var end []byte
+		if before != nil {
+			end = append(append([]byte{}, prefix...), before...)
+		} else if len(prefix) > 0 {
+			end = append([]byte{}, prefix...)
+			end[len(end)-1]++
+		}
+
+		c := indexBucket.Cursor()
+		var k []byte
+		if end != nil {
+			k, _ = c.Seek(end)
+		}
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		// get one more than we need, to know if there are more
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(pages) <= limit; k, _ = c.Prev() {
+			name := k[len(prefix)+8:]
+			raw := pageBucket.Get(name)
+			if raw == nil {
+				continue
+			}
+
+			page := Page{}
+			err := decodePage(raw, &page)
+			if err != nil {
+				return err
+			}
+			pages = append(pages, &page)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pageOfPages(pages, limit)
+}
+
+// searchKey is the term, a zero byte (which tokenize() never puts in a term), then the page name. The empty term
+// holds when the page expires, in nanoseconds as a big-endian uint64, for those which do.
+func searchKey(term string, name string) []byte {
+	return []byte(term + "\x00" + name)
+}
+
+// boltSearchIndexPage adds the Postings of every term in the page to the 'search' bucket if it is visible, or if `add`
+// is false removes them.
+func boltSearchIndexPage(tx *bolt.Tx, page *Page, add bool) error {
+	searchBucket := tx.Bucket(searchBucketName)
+	if searchBucket == nil {
+		panic(ErrFatalNoSearchBucket)
+	}
+
+	if add && !page.IsVisible() {
+		return nil
+	}
+
+	expiresKey := searchKey("", page.Name)
+	if !add {
+		if err := searchBucket.Delete(expiresKey); err != nil {
+			return err
+		}
+	} else if !page.Expires.IsZero() {
+		plain := make([]byte, 8)
+		binary.BigEndian.PutUint64(plain, uint64(page.Expires.UnixNano()))
+		raw, errEncrypt := encryptValue(plain)
+		if errEncrypt != nil {
+			return errEncrypt
+		}
+		if err := searchBucket.Put(expiresKey, raw); err != nil {
+			return err
+		}
+	}
+
+	for term, postings := range pagePostings(page) {
+		key := searchKey(term, page.Name)
+		if !add {
+			if err := searchBucket.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		plain, errMarshal := json.Marshal(postings)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		raw, errEncrypt := encryptValue(plain)
+		if errEncrypt != nil {
+			return errEncrypt
+		}
+		if err := searchBucket.Put(key, raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// boltRebuildSearchIndex throws away the 'search' bucket and indexes every page again, returning how many it indexed.
+func boltRebuildSearchIndex(tx *bolt.Tx) (int, error) {
+	if err := tx.DeleteBucket(searchBucketName); err != nil && err != bolt.ErrBucketNotFound {
+		return 0, err
+	}
+	if _, err := tx.CreateBucket(searchBucketName); err != nil {
+		return 0, err
+	}
+
+	pageBucket := tx.Bucket(pageBucketName)
+	if pageBucket == nil {
+		panic(ErrFatalNoPageBucket)
+	}
+
+	count := 0
+	err := pageBucket.ForEach(func(k, v []byte) error {
+		page := Page{}
+		if err := decodePage(v, &page); err != nil {
+			return err
+		}
+		if !page.IsVisible() {
+			return nil
+		}
+
+		count++
+		return boltSearchIndexPage(tx, &page, true)
+	})
+
+	return count, err
+}
+
+func (s *BoltStore) RebuildSearchIndex() (int, error) {
+	var count int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		count, err = boltRebuildSearchIndex(tx)
+		return err
+	})
+	return count, err
+}
+
+func (s *BoltStore) LookupTerms(terms []string, now time.Time) (map[string]map[string]*Postings, int, error) {
+	found := map[string]map[string]*Postings{}
+	count := 0
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		searchBucket := tx.Bucket(searchBucketName)
+		if searchBucket == nil {
+			panic(ErrFatalNoSearchBucket)
+		}
+
+		// every visible page is in the 'inserted' index, so that's how many pages we're searching
+		var errCount error
+		count, errCount = getIndexedCount(tx)
+		if errCount != nil {
+			return errCount
+		}
+
+		// whether each page we come across has expired, so that we only look once
+		expired := map[string]bool{}
+		isExpired := func(name string) (bool, error) {
+			if gone, ok := expired[name]; ok {
+				return gone, nil
+			}
+			raw, err := decryptValue(searchBucket.Get(searchKey("", name)))
+			if err != nil {
+				return false, err
+			}
+			expired[name] = len(raw) == 8 && !now.Before(time.Unix(0, int64(binary.BigEndian.Uint64(raw))))
+			return expired[name], nil
+		}
+
+		c := searchBucket.Cursor()
+		for _, term := range terms {
+			found[term] = map[string]*Postings{}
+
+			prefix := searchKey(term, "")
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				name := string(k[len(prefix):])
+				gone, err := isExpired(name)
+				if err != nil {
+					return err
+				}
+				if gone {
+					continue
+				}
+
+				plain, err := decryptValue(v)
+				if err != nil {
+					return err
+				}
+				postings := &Postings{}
+				if err := json.Unmarshal(plain, postings); err != nil {
+					return err
+				}
+				found[term][name] = postings
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return found, count, nil
+}
+
+func (s *BoltStore) AddViews(counts map[string]int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pageBucket := tx.Bucket(pageBucketName)
+		if pageBucket == nil {
+			panic(ErrFatalNoPageBucket)
+		}
+		viewsBucket := tx.Bucket(viewsBucketName)
+		if viewsBucket == nil {
+			panic(ErrFatalNoViewsBucket)
+		}
+
+		for name, n := range counts {
+			// the page may have been deleted since it was viewed, and then its views have already gone
+			rawPage := pageBucket.Get([]byte(name))
+			if rawPage == nil {
+				continue
+			}
+			page := Page{}
+			if err := decodePage(rawPage, &page); err != nil {
+				return err
+			}
+			if page.IsDeleted() {
+				continue
+			}
+
+			var views uint64
+			if raw := viewsBucket.Get([]byte(name)); len(raw) == 8 {
+				views = binary.BigEndian.Uint64(raw)
+			}
+
+			raw := make([]byte, 8)
+			binary.BigEndian.PutUint64(raw, views+uint64(n))
+			if err := viewsBucket.Put([]byte(name), raw); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *BoltStore) GetViews(name string) (int64, error) {
+	var views int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		viewsBucket := tx.Bucket(viewsBucketName)
+		if viewsBucket == nil {
+			panic(ErrFatalNoViewsBucket)
+		}
+
+		if raw := viewsBucket.Get([]byte(name)); len(raw) == 8 {
+			views = int64(binary.BigEndian.Uint64(raw))
+		}
+		return nil
+	})
+	return views, err
+}
+
+// uploadPageKey is the two names with a zero byte between them, which is in neither an upload key nor a page name.
+func uploadPageKey(first, second string) []byte {
+	return []byte(first + "\x00" + second)
+}
+
+func boltUploadPageBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket) {
+	uploadPageBucket := tx.Bucket(uploadPageBucketName)
+	if uploadPageBucket == nil {
+		panic(ErrFatalNoUploadPageBucket)
+	}
+
+	pageUploadBucket := tx.Bucket(pageUploadBucketName)
+	if pageUploadBucket == nil {
+		panic(ErrFatalNoPageUploadBucket)
+	}
+
+	return uploadPageBucket, pageUploadBucket
+}
+
+func (s *BoltStore) PutUpload(key string, data []byte, page string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploadBucket := tx.Bucket(uploadBucketName)
+		if uploadBucket == nil {
+			panic(ErrFatalNoUploadBucket)
+		}
+		uploadPageBucket, pageUploadBucket := boltUploadPageBuckets(tx)
+
+		// the key comes from the content, so if it's there it's the same
+		if uploadBucket.Get([]byte(key)) == nil {
+			raw, err := encryptValue(data)
+			if err != nil {
+				return err
+			}
+			if err := uploadBucket.Put([]byte(key), raw); err != nil {
+				return err
+			}
+		}
+
+		if err := uploadPageBucket.Put(uploadPageKey(key, page), []byte{}); err != nil {
+			return err
+		}
+		return pageUploadBucket.Put(uploadPageKey(page, key), []byte{})
+	})
+}
+
+func (s *BoltStore) UploadPages() ([]string, error) {
+	pages := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, pageUploadBucket := boltUploadPageBuckets(tx)
+
+		return pageUploadBucket.ForEach(func(k, v []byte) error {
+			page := string(k[:bytes.IndexByte(k, 0)])
+			if len(pages) == 0 || pages[len(pages)-1] != page {
+				pages = append(pages, page)
+			}
+			return nil
+		})
+	})
+	return pages, err
+}
+
+func (s *BoltStore) DeleteUploads(page string) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		uploadBucket := tx.Bucket(uploadBucketName)
+		if uploadBucket == nil {
+			panic(ErrFatalNoUploadBucket)
+		}
+		uploadPageBucket, pageUploadBucket := boltUploadPageBuckets(tx)
+
+		// find them first, since deleting while using a cursor skips keys
+		prefix := uploadPageKey(page, "")
+		keys := []string{}
+		c := pageUploadBucket.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, string(k[len(prefix):]))
+		}
+
+		for _, key := range keys {
+			if err := pageUploadBucket.Delete(uploadPageKey(page, key)); err != nil {
+				return err
+			}
+			if err := uploadPageBucket.Delete(uploadPageKey(key, page)); err != nil {
+				return err
+			}
+
+			// is it still in any other page?
+			others := uploadPageKey(key, "")
+			if k, _ := uploadPageBucket.Cursor().Seek(others); k != nil && bytes.HasPrefix(k, others) {
+				continue
+			}
+			if err := uploadBucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (s *BoltStore) GetUpload(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		uploadBucket := tx.Bucket(uploadBucketName)
+		if uploadBucket == nil {
+			panic(ErrFatalNoUploadBucket)
+		}
+
+		raw := uploadBucket.Get([]byte(key))
+		if raw == nil {
+			return nil
+		}
+
+		// the value is only valid during the transaction, so copy it out
+		plain, err := decryptValue(raw)
+		if err != nil {
+			return err
+		}
+		data = append([]byte{}, plain...)
+		return nil
+	})
+	return data, err
+}
@@ -0,0 +1,357 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore keeps each page as '<name>.md' in a directory, with YAML front matter above the Markdown so the files can
+// be kept in version control and edited by hand. The secret Ids live in 'index.json' in the same directory. The HTML
+// is rendered whenever a page is read, so hand edits show up straight away. How many times each page has been viewed is
+// in 'views.json'.
+type FileStore struct {
+	mu    sync.RWMutex
+	dir   string
+	ids   map[string]string // id -> name
+	names map[string]string // name -> id
+	views map[string]int64  // name -> views
+}
+
+const fileStoreIndex = "index.json"
+const fileStoreViews = "views.json"
+const fileStoreExt = ".md"
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		dir:   dir,
+		ids:   make(map[string]string),
+		names: make(map[string]string),
+		views: make(map[string]int64),
+	}
+
+	raw, errRead := ioutil.ReadFile(filepath.Join(dir, fileStoreIndex))
+	if errRead != nil && !os.IsNotExist(errRead) {
+		return nil, errRead
+	}
+	if errRead == nil {
+		if err := json.Unmarshal(raw, &s.ids); err != nil {
+			return nil, err
+		}
+	}
+	for id, name := range s.ids {
+		s.names[name] = id
+	}
+
+	rawViews, errReadViews := ioutil.ReadFile(filepath.Join(dir, fileStoreViews))
+	if errReadViews != nil && !os.IsNotExist(errReadViews) {
+		return nil, errReadViews
+	}
+	if errReadViews == nil {
+		if err := json.Unmarshal(rawViews, &s.views); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// filename returns the path to the page, or "" if the name could escape the directory.
+func (s *FileStore) filename(name string) string {
+	if !validPageName(name) {
+		return ""
+	}
+	return filepath.Join(s.dir, name+fileStoreExt)
+}
+
+// writeFile makes sure that readers only ever see the old file or the new one, never half of one.
+func writeFile(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (s *FileStore) readPage(name string) (*Page, error) {
+	filename := s.filename(name)
+	if filename == "" {
+		return nil, nil
+	}
+
+	raw, errRead := ioutil.ReadFile(filename)
+	if os.IsNotExist(errRead) {
+		return nil, nil
+	}
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	page, errDecode := decodeMarkdown(raw)
+	if errDecode != nil {
+		return nil, errDecode
+	}
+
+	page.Name = name
+	page.Id = s.names[name]
+	renderPage(page)
+
+	return page, nil
+}
+
+func (s *FileStore) GetPage(name string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.readPage(name)
+}
+
+func (s *FileStore) GetPageUsingId(id string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.ids[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return s.readPage(name)
+}
+
+func (s *FileStore) CreatePage(page Page) error {
+	filename := s.filename(page.Name)
+	if filename == "" {
+		return ErrInvalidPageName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(filename); err == nil {
+		return ErrPageNameExists
+	}
+	if _, ok := s.ids[page.Id]; ok {
+		return ErrPageIdExists
+	}
+
+	return s.putPage(page)
+}
+
+func (s *FileStore) PutPage(page Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.putPage(page)
+}
+
+func (s *FileStore) UpdatePage(page Page, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.readPage(page.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Version != version {
+		return ErrVersionConflict
+	}
+
+	return s.putPage(page)
+}
+
+// putPage must be called with the lock held.
+func (s *FileStore) putPage(page Page) error {
+	filename := s.filename(page.Name)
+	if filename == "" {
+		return ErrInvalidPageName
+	}
+
+	raw, errEncode := encodeMarkdown(&page)
+	if errEncode != nil {
+		return errEncode
+	}
+
+	if err := writeFile(filename, raw); err != nil {
+		return err
+	}
+
+	// only rewrite the index if it has changed
+	prevId, ok := s.names[page.Name]
+	if ok && prevId == page.Id {
+		return nil
+	}
+	if ok {
+		delete(s.ids, prevId)
+		delete(s.names, page.Name)
+	}
+	if page.Id != "" {
+		s.ids[page.Id] = page.Name
+		s.names[page.Name] = page.Id
+	}
+
+	return s.writeIndex()
+}
+
+func (s *FileStore) writeIndex() error {
+	index, errMarshal := json.MarshalIndent(s.ids, "", "  ")
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return writeFile(filepath.Join(s.dir, fileStoreIndex), index)
+}
+
+func (s *FileStore) DeletePage(name string, deleted time.Time) error {
+	_, err := s.deletePage(name, deleteAt(deleted))
+	return err
+}
+
+func (s *FileStore) DeletePageIfExpired(name string, now time.Time) (bool, error) {
+	return s.deletePage(name, deleteIfExpired(now))
+}
+
+func (s *FileStore) deletePage(name string, when deleteWhen) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page, errRead := s.readPage(name)
+	if errRead != nil {
+		return false, errRead
+	}
+	if page == nil {
+		return false, nil
+	}
+
+	deleted, ok := when(page)
+	if !ok {
+		return false, nil
+	}
+
+	dead := tombstone(page, deleted)
+	raw, errEncode := encodeMarkdown(&dead)
+	if errEncode != nil {
+		return false, errEncode
+	}
+
+	if err := writeFile(s.filename(name), raw); err != nil {
+		return false, err
+	}
+
+	if _, ok := s.views[name]; ok {
+		views := make(map[string]int64, len(s.views))
+		for other, n := range s.views {
+			if other != name {
+				views[other] = n
+			}
+		}
+		if err := s.writeViews(views); err != nil {
+			return false, err
+		}
+	}
+
+	if page.Id == "" {
+		return true, nil
+	}
+	delete(s.ids, page.Id)
+	delete(s.names, name)
+	return true, s.writeIndex()
+}
+
+func (s *FileStore) IteratePages(fn func(page *Page) error) error {
+	s.mu.RLock()
+	matches, errGlob := filepath.Glob(filepath.Join(s.dir, "*"+fileStoreExt))
+	s.mu.RUnlock()
+	if errGlob != nil {
+		return errGlob
+	}
+	sort.Strings(matches)
+
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), fileStoreExt)
+
+		page, err := s.GetPage(name)
+		if err != nil {
+			return err
+		}
+		if page == nil {
+			continue
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileStore) AddViews(counts map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// only keep the new counts once they're on disk
+	views := make(map[string]int64, len(s.views))
+	for name, n := range s.views {
+		views[name] = n
+	}
+	for name, n := range counts {
+		// only pages which are still there, since a tombstone has no Id
+		if _, ok := s.names[name]; !ok {
+			continue
+		}
+		views[name] += n
+	}
+
+	return s.writeViews(views)
+}
+
+// writeViews saves `views` to disk then keeps them, so the caller must hold the lock.
+func (s *FileStore) writeViews(views map[string]int64) error {
+	raw, errMarshal := json.MarshalIndent(views, "", "  ")
+	if errMarshal != nil {
+		return errMarshal
+	}
+	if err := writeFile(filepath.Join(s.dir, fileStoreViews), raw); err != nil {
+		return err
+	}
+
+	s.views = views
+	return nil
+}
+
+func (s *FileStore) GetViews(name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.views[name], nil
+}
@@ -0,0 +1,286 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in maps and forgets it all on exit. It's handy for development and tests.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	pages     map[string]Page   // name -> page
+	ids       map[string]string // id -> name
+	revisions map[string][]Page // name -> previous versions, oldest first
+	views     map[string]int64  // name -> views
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		pages:     make(map[string]Page),
+		ids:       make(map[string]string),
+		revisions: make(map[string][]Page),
+		views:     make(map[string]int64),
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) GetPage(name string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	page, ok := s.pages[name]
+	if !ok {
+		return nil, nil
+	}
+	return &page, nil
+}
+
+func (s *MemoryStore) GetPageUsingId(id string) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name, ok := s.ids[id]
+	if !ok {
+		return nil, nil
+	}
+
+	page, ok := s.pages[name]
+	if !ok {
+		return nil, nil
+	}
+	return &page, nil
+}
+
+func (s *MemoryStore) CreatePage(page Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.pages[page.Name]; ok {
+		return ErrPageNameExists
+	}
+	if _, ok := s.ids[page.Id]; ok {
+		return ErrPageIdExists
+	}
+
+	s.putPage(page)
+	return nil
+}
+
+func (s *MemoryStore) PutPage(page Page) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.putPage(page)
+	return nil
+}
+
+func (s *MemoryStore) UpdatePage(page Page, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.pages[page.Name]
+	if !ok || current.Version != version {
+		return ErrVersionConflict
+	}
+
+	s.putPage(page)
+	return nil
+}
+
+func (s *MemoryStore) UpdatePages(names []string, fn func(page *Page) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, name := range names {
+		page, ok := s.pages[name]
+		if ok && fn(&page) {
+			s.putPage(page)
+		}
+	}
+	return nil
+}
+
+// putPage must be called with the lock held.
+func (s *MemoryStore) putPage(page Page) {
+	if prev, ok := s.pages[page.Name]; ok {
+		if !prev.Updated.Equal(page.Updated) {
+			s.revisions[page.Name] = append(s.revisions[page.Name], prev)
+		}
+		if prev.Id != page.Id {
+			delete(s.ids, prev.Id)
+		}
+	}
+
+	s.pages[page.Name] = page
+	if page.Id != "" {
+		s.ids[page.Id] = page.Name
+	}
+}
+
+// IteratePages walks the pages in name order, the same as the BoltStore does.
+func (s *MemoryStore) IteratePages(fn func(page *Page) error) error {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.pages))
+	for name := range s.pages {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		page, err := s.GetPage(name)
+		if err != nil {
+			return err
+		}
+		if page == nil {
+			continue
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeletePage(name string, deleted time.Time) error {
+	_, err := s.deletePage(name, deleteAt(deleted))
+	return err
+}
+
+func (s *MemoryStore) DeletePageIfExpired(name string, now time.Time) (bool, error) {
+	return s.deletePage(name, deleteIfExpired(now))
+}
+
+func (s *MemoryStore) deletePage(name string, when deleteWhen) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	page, ok := s.pages[name]
+	if !ok {
+		return false, nil
+	}
+
+	deleted, ok := when(&page)
+	if !ok {
+		return false, nil
+	}
+
+	delete(s.ids, page.Id)
+	delete(s.revisions, name)
+	delete(s.views, name)
+	s.pages[name] = tombstone(&page, deleted)
+	return true, nil
+}
+
+func (s *MemoryStore) ListRevisions(name string) ([]*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	revisions := s.revisions[name]
+	pages := make([]*Page, 0, len(revisions))
+	for i := len(revisions) - 1; i >= 0; i-- {
+		page := revisions[i]
+		pages = append(pages, &page)
+	}
+	return pages, nil
+}
+
+func (s *MemoryStore) GetRevision(name string, rev int64) (*Page, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, page := range s.revisions[name] {
+		if revisionOf(&page) == rev {
+			return &page, nil
+		}
+	}
+	return nil, nil
+}
+
+// ImportPages works on a copy of the maps and only swaps them in once every page has been saved, so that a failure
+// part way through imports none of them.
+func (s *MemoryStore) ImportPages(pages []Page, onConflict string) (*ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scratch := NewMemoryStore()
+	for name, page := range s.pages {
+		scratch.pages[name] = page
+	}
+	for id, name := range s.ids {
+		scratch.ids[id] = name
+	}
+	for name, revisions := range s.revisions {
+		scratch.revisions[name] = append([]Page{}, revisions...)
+	}
+
+	result, err := importPages(memoryPageTx{scratch}, pages, onConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pages, s.ids, s.revisions = scratch.pages, scratch.ids, scratch.revisions
+	return result, nil
+}
+
+type memoryPageTx struct {
+	s *MemoryStore
+}
+
+func (t memoryPageTx) nameExists(name string) (bool, error) {
+	_, ok := t.s.pages[name]
+	return ok, nil
+}
+
+func (t memoryPageTx) idName(id string) (string, error) {
+	return t.s.ids[id], nil
+}
+
+func (t memoryPageTx) putPage(page Page) error {
+	t.s.putPage(page)
+	return nil
+}
+
+func (s *MemoryStore) AddViews(counts map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, n := range counts {
+		if page, ok := s.pages[name]; !ok || page.IsDeleted() {
+			continue
+		}
+		s.views[name] += n
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetViews(name string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.views[name], nil
+}
@@ -0,0 +1,545 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The 'page' table has columns for the fields you'd want to query by hand, plus the whole Page as JSON in 'data' so
+// that new fields don't need a schema change. The 'id' is NULL once a page has been deleted. The 'page_list' table
+// holds just the visible pages, by normalised author and inserted time (in nanoseconds), for listing them.
+// 'page_views' counts how many times each page has been viewed.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS page (
+		name     TEXT NOT NULL PRIMARY KEY,
+		id       TEXT,
+		title    TEXT NOT NULL,
+		author   TEXT NOT NULL,
+		inserted DATETIME NOT NULL,
+		updated  DATETIME NOT NULL,
+		data     TEXT NOT NULL
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS page_id ON page (id)`,
+	`CREATE INDEX IF NOT EXISTS page_inserted ON page (inserted)`,
+	`CREATE TABLE IF NOT EXISTS page_list (
+		name     TEXT NOT NULL PRIMARY KEY,
+		author   TEXT NOT NULL,
+		inserted INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS page_list_inserted ON page_list (inserted, name)`,
+	`CREATE INDEX IF NOT EXISTS page_list_author ON page_list (author, inserted, name)`,
+	`CREATE TABLE IF NOT EXISTS page_views (
+		name  TEXT NOT NULL PRIMARY KEY,
+		views INTEGER NOT NULL
+	)`,
+}
+
+// sqliteVersion is recorded in the database's user_version once sqliteUpgrade() has filled in anything added since it
+// was created.
+const sqliteVersion = 1
+
+// sqliteIterateBatch is how many pages IteratePages() reads at a time.
+const sqliteIterateBatch = 100
+
+// SQLiteStore keeps pages in a SQLite database. It runs in WAL mode so that other processes can read (and query) the
+// file while the server is running.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, errOpen := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if errOpen != nil {
+		return nil, errOpen
+	}
+
+	// SQLite only allows one writer at a time anyway, so don't fight over the lock, see IteratePages()
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	if err := sqliteUpgrade(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// nullString stores an empty string as NULL, so that the unique index on 'id' ignores it.
+func nullString(str string) sql.NullString {
+	return sql.NullString{String: str, Valid: str != ""}
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) getPage(query string, arg string) (*Page, error) {
+	var raw string
+	err := s.db.QueryRow(query, arg).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	page := Page{}
+	err = json.Unmarshal([]byte(raw), &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (s *SQLiteStore) GetPage(name string) (*Page, error) {
+	return s.getPage(`SELECT data FROM page WHERE name = ?`, name)
+}
+
+func (s *SQLiteStore) GetPageUsingId(id string) (*Page, error) {
+	return s.getPage(`SELECT data FROM page WHERE id = ?`, id)
+}
+
+func (s *SQLiteStore) CreatePage(page Page) error {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	// make sure we're not about to overwrite someone else's page or secret
+	var count int
+	errName := tx.QueryRow(`SELECT COUNT(*) FROM page WHERE name = ?`, page.Name).Scan(&count)
+	if errName != nil {
+		return errName
+	}
+	if count > 0 {
+		return ErrPageNameExists
+	}
+
+	errId := tx.QueryRow(`SELECT COUNT(*) FROM page WHERE id = ?`, page.Id).Scan(&count)
+	if errId != nil {
+		return errId
+	}
+	if count > 0 {
+		return ErrPageIdExists
+	}
+
+	if err := sqlitePutPage(tx, page); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) PutPage(page Page) error {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	if err := sqlitePutPage(tx, page); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdatePage(page Page, version int64) error {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	var raw string
+	errSelect := tx.QueryRow(`SELECT data FROM page WHERE name = ?`, page.Name).Scan(&raw)
+	if errSelect == sql.ErrNoRows {
+		return ErrVersionConflict
+	}
+	if errSelect != nil {
+		return errSelect
+	}
+
+	current := Page{}
+	if err := json.Unmarshal([]byte(raw), &current); err != nil {
+		return err
+	}
+	if current.Version != version {
+		return ErrVersionConflict
+	}
+
+	if err := sqlitePutPage(tx, page); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdatePages(names []string, fn func(page *Page) bool) error {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		pages, err := sqliteQueryPages(tx, `SELECT data FROM page WHERE name = ?`, name)
+		if err != nil {
+			return err
+		}
+		if len(pages) == 0 || !fn(pages[0]) {
+			continue
+		}
+
+		if err := sqlitePutPage(tx, *pages[0]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// sqlitePutPage writes the page and keeps 'page_list' up to date.
+func sqlitePutPage(tx *sql.Tx, page Page) error {
+	bytes, errMarshal := json.Marshal(page)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO page (name, id, title, author, inserted, updated, data) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			id = excluded.id,
+			title = excluded.title,
+			author = excluded.author,
+			inserted = excluded.inserted,
+			updated = excluded.updated,
+			data = excluded.data`,
+		page.Name,
+		nullString(page.Id),
+		page.Title,
+		page.Author,
+		page.Inserted.UTC().Format(time.RFC3339Nano),
+		page.Updated.UTC().Format(time.RFC3339Nano),
+		string(bytes),
+	)
+	if err != nil {
+		return err
+	}
+
+	return sqliteIndexPage(tx, &page)
+}
+
+// sqliteIndexPage puts the page in 'page_list' if it is visible, and takes it out if not.
+func sqliteIndexPage(tx *sql.Tx, page *Page) error {
+	_, errDelete := tx.Exec(`DELETE FROM page_list WHERE name = ?`, page.Name)
+	if errDelete != nil {
+		return errDelete
+	}
+
+	if !page.IsVisible() {
+		return nil
+	}
+
+	_, errInsert := tx.Exec(
+		`INSERT INTO page_list (name, author, inserted) VALUES (?, ?, ?)`,
+		page.Name,
+		normaliseAuthor(page.Author),
+		page.Inserted.UnixNano(),
+	)
+	return errInsert
+}
+
+// sqliteUpgrade fills in anything a database made by an older version is missing.
+func sqliteUpgrade(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= sqliteVersion {
+		return nil
+	}
+
+	tx, errBegin := db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	// version 1 added 'page_list'
+	pages, errQuery := sqliteQueryPages(tx, `SELECT data FROM page`)
+	if errQuery != nil {
+		return errQuery
+	}
+	for _, page := range pages {
+		if err := sqliteIndexPage(tx, page); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, sqliteVersion)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sqliteQueryPages decodes the 'data' column of every row.
+func sqliteQueryPages(db querier, query string, args ...interface{}) ([]*Page, error) {
+	rows, errQuery := db.Query(query, args...)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	defer rows.Close()
+
+	pages := []*Page{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+
+		page := Page{}
+		if err := json.Unmarshal([]byte(raw), &page); err != nil {
+			return nil, err
+		}
+		pages = append(pages, &page)
+	}
+
+	return pages, rows.Err()
+}
+
+func (s *SQLiteStore) DeletePage(name string, deleted time.Time) error {
+	_, err := s.deletePage(name, deleteAt(deleted))
+	return err
+}
+
+func (s *SQLiteStore) DeletePageIfExpired(name string, now time.Time) (bool, error) {
+	return s.deletePage(name, deleteIfExpired(now))
+}
+
+func (s *SQLiteStore) deletePage(name string, when deleteWhen) (bool, error) {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return false, errBegin
+	}
+	defer tx.Rollback()
+
+	var raw string
+	errSelect := tx.QueryRow(`SELECT data FROM page WHERE name = ?`, name).Scan(&raw)
+	if errSelect == sql.ErrNoRows {
+		return false, nil
+	}
+	if errSelect != nil {
+		return false, errSelect
+	}
+
+	page := Page{}
+	errUnmarshal := json.Unmarshal([]byte(raw), &page)
+	if errUnmarshal != nil {
+		return false, errUnmarshal
+	}
+
+	deleted, ok := when(&page)
+	if !ok {
+		return false, nil
+	}
+
+	rawTombstone, errMarshal := json.Marshal(tombstone(&page, deleted))
+	if errMarshal != nil {
+		return false, errMarshal
+	}
+
+	_, errUnindex := tx.Exec(`DELETE FROM page_list WHERE name = ?`, name)
+	if errUnindex != nil {
+		return false, errUnindex
+	}
+
+	_, errDelViews := tx.Exec(`DELETE FROM page_views WHERE name = ?`, name)
+	if errDelViews != nil {
+		return false, errDelViews
+	}
+
+	_, errUpdate := tx.Exec(
+		`UPDATE page SET id = NULL, updated = ?, data = ? WHERE name = ?`,
+		deleted.UTC().Format(time.RFC3339Nano),
+		string(rawTombstone),
+		name,
+	)
+	if errUpdate != nil {
+		return false, errUpdate
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// IteratePages reads the pages a batch at a time and closes the rows before calling `fn`, since with only the one
+// connection `fn` couldn't read the store otherwise.
+func (s *SQLiteStore) IteratePages(fn func(page *Page) error) error {
+	after := ""
+	for {
+		pages, err := sqliteQueryPages(s.db, `SELECT data FROM page WHERE name > ? ORDER BY name LIMIT ?`, after, sqliteIterateBatch)
+		if err != nil {
+			return err
+		}
+
+		for _, page := range pages {
+			if err := fn(page); err != nil {
+				return err
+			}
+		}
+
+		if len(pages) < sqliteIterateBatch {
+			return nil
+		}
+		after = pages[len(pages)-1].Name
+	}
+}
+
+// ImportPages saves all of the pages in one transaction, so a failure part way through imports none of them.
+func (s *SQLiteStore) ImportPages(pages []Page, onConflict string) (*ImportResult, error) {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return nil, errBegin
+	}
+	defer tx.Rollback()
+
+	result, err := importPages(sqlitePageTx{tx}, pages, onConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+type sqlitePageTx struct {
+	tx *sql.Tx
+}
+
+func (t sqlitePageTx) nameExists(name string) (bool, error) {
+	var count int
+	err := t.tx.QueryRow(`SELECT COUNT(*) FROM page WHERE name = ?`, name).Scan(&count)
+	return count > 0, err
+}
+
+func (t sqlitePageTx) idName(id string) (string, error) {
+	var name string
+	err := t.tx.QueryRow(`SELECT name FROM page WHERE id = ?`, id).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return name, err
+}
+
+func (t sqlitePageTx) putPage(page Page) error {
+	return sqlitePutPage(t.tx, page)
+}
+
+func (s *SQLiteStore) ListNewestPages(cursor string, limit int) ([]*Page, string, error) {
+	return s.listPages("", cursor, limit)
+}
+
+func (s *SQLiteStore) ListAuthorPages(author string, cursor string, limit int) ([]*Page, string, error) {
+	return s.listPages(author, cursor, limit)
+}
+
+func (s *SQLiteStore) listPages(author string, cursor string, limit int) ([]*Page, string, error) {
+	before, errCursor := decodeCursor(cursor)
+	if errCursor != nil {
+		return nil, "", errCursor
+	}
+
+	query := `SELECT p.data FROM page_list l JOIN page p ON p.name = l.name WHERE 1 = 1`
+	args := []interface{}{}
+	if author != "" {
+		query += ` AND l.author = ?`
+		args = append(args, author)
+	}
+	if before != nil {
+		query += ` AND (l.inserted, l.name) < (?, ?)`
+		args = append(args, int64(binary.BigEndian.Uint64(before)), string(before[8:]))
+	}
+
+	// get one more than we need, to know if there are more
+	query += ` ORDER BY l.inserted DESC, l.name DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	pages, err := sqliteQueryPages(s.db, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pageOfPages(pages, limit)
+}
+
+func (s *SQLiteStore) AddViews(counts map[string]int64) error {
+	tx, errBegin := s.db.Begin()
+	if errBegin != nil {
+		return errBegin
+	}
+	defer tx.Rollback()
+
+	for name, n := range counts {
+		_, err := tx.Exec(
+			`INSERT INTO page_views (name, views)
+			SELECT name, ? FROM page WHERE name = ? AND id IS NOT NULL
+			ON CONFLICT (name) DO UPDATE SET views = views + excluded.views`,
+			n,
+			name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetViews(name string) (int64, error) {
+	var views int64
+	err := s.db.QueryRow(`SELECT views FROM page_views WHERE name = ?`, name).Scan(&views)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return views, err
+}
@@ -0,0 +1,360 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// withEachStore runs the test against a fresh, empty instance of every kind of store.
+func withEachStore(t *testing.T, fn func(t *testing.T, store PageStore)) {
+	dir, err := ioutil.TempDir("", "publish-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]func() (PageStore, error){
+		"memory": func() (PageStore, error) { return NewMemoryStore(), nil },
+		"bolt":   func() (PageStore, error) { return NewBoltStore(filepath.Join(dir, "publish.db")) },
+		"sqlite": func() (PageStore, error) { return NewSQLiteStore(filepath.Join(dir, "publish.sqlite")) },
+		"fs":     func() (PageStore, error) { return NewFileStore(filepath.Join(dir, "pages")) },
+	}
+
+	for kind, open := range stores {
+		t.Run(kind, func(t *testing.T) {
+			store, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			fn(t, store)
+		})
+	}
+}
+
+func testPage(name, id, title string) Page {
+	now := time.Now().UTC()
+	return Page{
+		Id:       id,
+		Name:     name,
+		Title:    title,
+		Content:  title,
+		Inserted: now,
+		Updated:  now,
+	}
+}
+
+func TestPageStore(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		page, err := store.GetPage("first-aaaaaaaa")
+		if err != nil || page != nil {
+			t.Fatalf("expected no page yet, got %#v (%v)", page, err)
+		}
+
+		if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.CreatePage(testPage("second-bbbbbbbb", "secret-two", "Second")); err != nil {
+			t.Fatal(err)
+		}
+
+		page, err = store.GetPageUsingId("secret-two")
+		if err != nil || page == nil || page.Name != "second-bbbbbbbb" || page.Title != "Second" {
+			t.Fatalf("unexpected page for its Id: %#v (%v)", page, err)
+		}
+
+		// PutPage overwrites whatever is there
+		page.Title = "Second Again"
+		if err := store.PutPage(*page); err != nil {
+			t.Fatal(err)
+		}
+		page, err = store.GetPage("second-bbbbbbbb")
+		if err != nil || page == nil || page.Title != "Second Again" {
+			t.Fatalf("unexpected page after PutPage: %#v (%v)", page, err)
+		}
+
+		names := []string{}
+		err = store.IteratePages(func(page *Page) error {
+			names = append(names, page.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != "first-aaaaaaaa,second-bbbbbbbb" {
+			t.Fatalf("unexpected pages: %v", names)
+		}
+
+		// deleting leaves a tombstone, which can't be found by its Id
+		deleted := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+		if err := store.DeletePage("first-aaaaaaaa", deleted); err != nil {
+			t.Fatal(err)
+		}
+		page, err = store.GetPage("first-aaaaaaaa")
+		if err != nil || page == nil || !page.IsDeleted() || !page.Deleted.Equal(deleted) || page.Title != "" {
+			t.Fatalf("expected a tombstone, got %#v (%v)", page, err)
+		}
+		page, err = store.GetPageUsingId("secret-one")
+		if err != nil || page != nil {
+			t.Fatalf("expected the deleted page's Id to be gone, got %#v (%v)", page, err)
+		}
+
+		// and deleting a page which isn't there is fine
+		if err := store.DeletePage("missing-cccccccc", deleted); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCreatePageCollisions(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+			t.Fatalf("CreatePage: %v", err)
+		}
+
+		// the same name with a different Id
+		err := store.CreatePage(testPage("first-aaaaaaaa", "secret-two", "Hijack"))
+		if err != ErrPageNameExists {
+			t.Fatalf("CreatePage with a used name: expected ErrPageNameExists, got %v", err)
+		}
+
+		// a different name with the same Id
+		err = store.CreatePage(testPage("second-bbbbbbbb", "secret-one", "Hijack"))
+		if err != ErrPageIdExists {
+			t.Fatalf("CreatePage with a used Id: expected ErrPageIdExists, got %v", err)
+		}
+
+		// neither attempt should have changed anything
+		page, err := store.GetPage("first-aaaaaaaa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page == nil || page.Title != "First" {
+			t.Fatalf("first page was overwritten: %#v", page)
+		}
+
+		page, err = store.GetPageUsingId("secret-one")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page == nil || page.Name != "first-aaaaaaaa" {
+			t.Fatalf("first Id was overwritten: %#v", page)
+		}
+
+		page, err = store.GetPage("second-bbbbbbbb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page != nil {
+			t.Fatalf("second page should not exist: %#v", page)
+		}
+
+		page, err = store.GetPageUsingId("secret-two")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page != nil {
+			t.Fatalf("second Id should not exist: %#v", page)
+		}
+	})
+}
+
+func TestUpdatePageVersion(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		page := testPage("first-aaaaaaaa", "secret-one", "First")
+		if err := store.CreatePage(page); err != nil {
+			t.Fatal(err)
+		}
+
+		page.Title = "Second"
+		page.Version = 1
+		if err := store.UpdatePage(page, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// someone else who loaded version 0 is too late
+		stale := page
+		stale.Title = "Stale"
+		if err := store.UpdatePage(stale, 0); err != ErrVersionConflict {
+			t.Fatalf("expected ErrVersionConflict, got %v", err)
+		}
+		current, err := store.GetPage("first-aaaaaaaa")
+		if err != nil || current == nil || current.Title != "Second" || current.Version != 1 {
+			t.Fatalf("a stale update was saved: %#v (%v)", current, err)
+		}
+
+		// and there's no version of a page which isn't there
+		if err := store.UpdatePage(testPage("missing-bbbbbbbb", "secret-two", "Missing"), 0); err != ErrVersionConflict {
+			t.Fatalf("expected ErrVersionConflict for a missing page, got %v", err)
+		}
+	})
+}
+
+func TestIteratePagesCanReadTheStore(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		// enough to need more than one batch from SQLite
+		count := sqliteIterateBatch + 1
+		for i := 0; i < count; i++ {
+			name := fmt.Sprintf("page-%03d-aaaaaaaa", i)
+			if err := store.PutPage(testPage(name, "secret-"+name, "Page")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan int)
+		go func() {
+			seen := 0
+			err := store.IteratePages(func(page *Page) error {
+				got, err := store.GetPage(page.Name)
+				if err != nil || got == nil {
+					return fmt.Errorf("couldn't get %s while iterating: %#v (%v)", page.Name, got, err)
+				}
+				seen++
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			done <- seen
+		}()
+
+		select {
+		case seen := <-done:
+			if seen != count {
+				t.Fatalf("expected %d pages, saw %d", count, seen)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("reading the store while iterating over it deadlocked")
+		}
+	})
+}
+
+func TestReadBoltPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "publish.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreatePage(testPage("first-aaaaaaaa", "secret-one", "First")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	err = readBoltPages(path, func(page *Page) error {
+		names = append(names, page.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "first-aaaaaaaa" {
+		t.Fatalf("unexpected pages: %v", names)
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Fatal("reading the pages changed the file")
+	}
+
+	// a file which isn't there isn't created either
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	if err := readBoltPages(missing, func(page *Page) error { return nil }); err == nil {
+		t.Fatal("expected an error reading a missing file")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatal("reading a missing file created it")
+	}
+}
+
+func TestMigrateNeedsSecretKey(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		orig := secretKey
+		t.Cleanup(func() { secretKey = orig })
+
+		secretKey = nil
+		if err := migrateStore(store, false); err == nil || !strings.Contains(err.Error(), ErrNoSecretKey.Error()) {
+			t.Fatalf("expected migrating without SECRET_KEY to fail, got %v", err)
+		}
+
+		secretKey = []byte("key")
+		if err := migrateStore(store, false); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMigrateHashSecretsCountsRevisions(t *testing.T) {
+	orig := secretKey
+	t.Cleanup(func() { secretKey = orig })
+	secretKey = []byte("key")
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "publish.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// a page saved three times by an old version, so it has a raw secret and two revisions sharing it
+	page := testPage("first-aaaaaaaa", "rawsecretrawsecr", "First")
+	if err := store.CreatePage(page); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		page.Updated = page.Updated.Add(time.Second)
+		page.Version++
+		if err := store.UpdatePage(page, page.Version-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		count, err = migrateHashSecrets(tx)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected 3 records to be rewritten, got %d", count)
+	}
+}
@@ -23,17 +23,41 @@ import (
 )
 
 type Page struct {
-	Id        string        `json:"id"`        // e.g. "aoAAhc5i4bmKMSZk"
-	Name      string        `json:"name"`      // e.g. "first-post-chzc9BkU
-	Title     string        `json:"title"`     // e.g. "First Post"
-	Author    string        `json:"author"`    // e.g. "Andrew Chilton"
-	Website   string        `json:"website"`   // e.g. "https://chilts.org"
-	Twitter   string        `json:"twitter"`   // e.g. "andychilton"
-	Facebook  string        `json:"facebook"`  // e.g. "andrew.peter.chilton"
-	GitHub    string        `json:"github"`    // e.g. "chilts"
-	Instagram string        `json:"instagram"` // e.g. "thechilts"
-	Content   string        `json:"content"`   // e.g. "My story."
-	Html      template.HTML `json:"html"`      // i.e. the transformed Markdown into HTML
-	Inserted  time.Time     `json:"inserted"`  // i.e. The inserted time
-	Updated   time.Time     `json:"updated"`   // i.e. The updated time
+	Id          string        `json:"id"`          // e.g. "aoAAhc5i4bmKMSZk"
+	Name        string        `json:"name"`        // e.g. "first-post-chzc9BkU
+	Title       string        `json:"title"`       // e.g. "First Post"
+	Author      string        `json:"author"`      // e.g. "Andrew Chilton"
+	Website     string        `json:"website"`     // e.g. "https://chilts.org"
+	Twitter     string        `json:"twitter"`     // e.g. "andychilton"
+	Facebook    string        `json:"facebook"`    // e.g. "andrew.peter.chilton"
+	GitHub      string        `json:"github"`      // e.g. "chilts"
+	Instagram   string        `json:"instagram"`   // e.g. "thechilts"
+	Content     string        `json:"content"`     // e.g. "My story."
+	Html        template.HTML `json:"html"`        // i.e. the transformed Markdown into HTML
+	Unpublished bool          `json:"unpublished"` // i.e. hidden from everyone, but still editable
+	Quarantined bool          `json:"quarantined"` // i.e. looked like spam, so hidden until an operator releases it
+	Inserted    time.Time     `json:"inserted"`    // i.e. The inserted time
+	Updated     time.Time     `json:"updated"`     // i.e. The updated time
+	Deleted     time.Time     `json:"deleted"`     // i.e. The deleted time, if this is just a tombstone
+	Version     int64         `json:"version"`     // i.e. How many times this page has been saved, see UpdatePage()
+	Renderer    int           `json:"renderer"`    // i.e. The rendererVersion which made the Html
+	Expires     time.Time     `json:"expires"`     // i.e. When the page goes away by itself, if ever
+}
+
+// clock is where everything gets the time from, so that tests can change it.
+var clock = time.Now
+
+// IsDeleted is true if this page is the tombstone left behind by DeletePage().
+func (p *Page) IsDeleted() bool {
+	return !p.Deleted.IsZero()
+}
+
+// IsExpired is true if the page has an expiry time and it has passed.
+func (p *Page) IsExpired(now time.Time) bool {
+	return !p.Expires.IsZero() && !now.Before(p.Expires)
+}
+
+// IsVisible is true if anyone may see this page.
+func (p *Page) IsVisible() bool {
+	return !p.IsDeleted() && !p.Unpublished && !p.Quarantined
 }
@@ -0,0 +1,402 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the largest file we'll take, and the most files in one request
+const maxUploadSize = 5 << 20
+const maxUploadFiles = 10
+
+// uploadTypes is every type of file which can be uploaded, as sniffed from its content, and the extension it is served
+// with. SVGs aren't allowed, since they can carry scripts.
+var uploadTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// uploadKeyRegexp matches the names uploads are kept and served under, which is the SHA-256 of the content and the
+// extension for its type.
+var uploadKeyRegexp = regexp.MustCompile(`^[0-9a-f]{64}\.(png|jpg|gif|webp|pdf)$`)
+
+// UploadStore keeps uploaded files, keyed by uploadKey(), along with the names of the pages they were uploaded for.
+// Since the key is made from the content, PutUpload with a key which already exists just adds the page. GetUpload
+// returns nil if there is no such upload. UploadPages lists every page with uploads, and DeleteUploads takes the page
+// off its uploads and deletes any which are left without a page, returning how many. Uploads from before pages were
+// recorded have none, and are kept.
+type UploadStore interface {
+	PutUpload(key string, data []byte, page string) error
+	GetUpload(key string) ([]byte, error)
+	UploadPages() ([]string, error)
+	DeleteUploads(page string) (int, error)
+}
+
+// uploadKey returns the name the file is kept under, or "" if it isn't a type we allow.
+func uploadKey(data []byte) string {
+	ext, ok := uploadTypes[http.DetectContentType(data)]
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// uploadType is the MIME type an upload is served with.
+func uploadType(key string) string {
+	ext := filepath.Ext(key)
+	for mimeType, typeExt := range uploadTypes {
+		if typeExt == ext {
+			return mimeType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// uploadMarkdown is what to paste into a page to show the upload: an image, or a link to anything else.
+func uploadMarkdown(filename, url, mimeType string) string {
+	text := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	text = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(text)
+	if text == "" || text == "." {
+		text = "file"
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		return fmt.Sprintf("![%s](%s)", text, url)
+	}
+	return fmt.Sprintf("[%s](%s)", text, url)
+}
+
+// DirUploadStore keeps each upload as a file in a directory, spread over subdirectories named after the first two
+// characters of the key so that none of them gets too big. Next to each upload, '<key>.pages' lists the pages it was
+// uploaded for, and 'pages/<name>' lists the keys of each page's uploads, one per line.
+type DirUploadStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewDirUploadStore(dir string) (*DirUploadStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "pages"), 0700); err != nil {
+		return nil, err
+	}
+	return &DirUploadStore{dir: dir}, nil
+}
+
+func (s *DirUploadStore) filename(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+func (s *DirUploadStore) pagesFilename(key string) string {
+	return s.filename(key) + ".pages"
+}
+
+func (s *DirUploadStore) keysFilename(page string) string {
+	return filepath.Join(s.dir, "pages", page)
+}
+
+func (s *DirUploadStore) PutUpload(key string, data []byte, page string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filename := s.filename(key)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return err
+		}
+		if err := writeFile(filename, data); err != nil {
+			return err
+		}
+	}
+
+	if err := addLine(s.pagesFilename(key), page); err != nil {
+		return err
+	}
+	return addLine(s.keysFilename(page), key)
+}
+
+func (s *DirUploadStore) UploadPages() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, "pages"))
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make([]string, len(infos))
+	for i, info := range infos {
+		pages[i] = info.Name()
+	}
+	return pages, nil
+}
+
+func (s *DirUploadStore) DeleteUploads(page string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys, err := readLines(s.keysFilename(page))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, key := range keys {
+		if !uploadKeyRegexp.MatchString(key) {
+			continue
+		}
+
+		left, err := removeLine(s.pagesFilename(key), page)
+		if err != nil {
+			return count, err
+		}
+		if left > 0 {
+			continue
+		}
+
+		for _, filename := range []string{s.filename(key), s.pagesFilename(key)} {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return count, err
+			}
+		}
+		count++
+	}
+
+	if err := os.Remove(s.keysFilename(page)); err != nil && !os.IsNotExist(err) {
+		return count, err
+	}
+	return count, nil
+}
+
+// readLines returns the lines in the file, or none if it doesn't exist.
+func readLines(filename string) ([]string, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(raw)), nil
+}
+
+// addLine adds the line to the file, unless it is already there.
+func addLine(filename, line string) error {
+	lines, err := readLines(filename)
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if l == line {
+			return nil
+		}
+	}
+
+	lines = append(lines, line)
+	return writeFile(filename, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// removeLine takes the line out of the file, returning how many are left. The file is removed once it is empty.
+func removeLine(filename, line string) (int, error) {
+	lines, err := readLines(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	left := []string{}
+	for _, l := range lines {
+		if l != line {
+			left = append(left, l)
+		}
+	}
+
+	if len(left) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return len(left), writeFile(filename, []byte(strings.Join(left, "\n")+"\n"))
+}
+
+func (s *DirUploadStore) GetUpload(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.filename(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// readUpload reads the whole of an uploaded file, or returns nil if it is too big.
+func readUpload(fileHeader *multipart.FileHeader) ([]byte, error) {
+	if fileHeader.Size > maxUploadSize {
+		return nil, nil
+	}
+
+	f, errOpen := fileHeader.Open()
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	defer f.Close()
+
+	data, errRead := ioutil.ReadAll(io.LimitReader(f, maxUploadSize+1))
+	if errRead != nil {
+		return nil, errRead
+	}
+	if len(data) > maxUploadSize {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// apiUpload takes a multipart form with one or more files in 'file', for the page whose secret is the bearer token.
+// Every file is checked before any are kept, and each one comes back with its URL and the Markdown to embed it.
+func apiUpload(store PageStore, uploads UploadStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// leave some room for the other fields and the multipart headers
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadFiles*maxUploadSize+1<<20)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			sendError(w, fmt.Sprintf("Upload at most %d files of up to %d MB each.", maxUploadFiles, maxUploadSize>>20))
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		page, errGet := getPageUsingSecret(store, requestSecret(w, r, r.FormValue("id")))
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		if page == nil || page.IsExpired(clock()) {
+			sendError(w, "This page Id does not exist.")
+			return
+		}
+
+		files := r.MultipartForm.File["file"]
+		if len(files) == 0 {
+			sendError(w, "Choose a file to upload.")
+			return
+		}
+		if len(files) > maxUploadFiles {
+			sendError(w, fmt.Sprintf("Upload at most %d files at once.", maxUploadFiles))
+			return
+		}
+
+		keys := make([]string, len(files))
+		contents := make([][]byte, len(files))
+		for i, fileHeader := range files {
+			data, errRead := readUpload(fileHeader)
+			if errRead != nil {
+				log.Printf("Error: %v\n", errRead)
+				sendError(w, "Internal Error. Please try again later.")
+				return
+			}
+			if data == nil {
+				sendError(w, fmt.Sprintf("'%s' is bigger than %d MB.", fileHeader.Filename, maxUploadSize>>20))
+				return
+			}
+
+			keys[i] = uploadKey(data)
+			if keys[i] == "" {
+				sendError(w, fmt.Sprintf("'%s' is not a PNG, JPEG, GIF, WebP or PDF file.", fileHeader.Filename))
+				return
+			}
+			contents[i] = data
+		}
+
+		payload := make([]map[string]interface{}, len(files))
+		for i, fileHeader := range files {
+			if err := uploads.PutUpload(keys[i], contents[i], page.Name); err != nil {
+				log.Printf("Error: %v\n", err)
+				sendError(w, "Internal Error. Please try again later.")
+				return
+			}
+
+			url := baseUrl + "/u/" + keys[i]
+			mimeType := uploadType(keys[i])
+			payload[i] = map[string]interface{}{
+				"filename": fileHeader.Filename,
+				"url":      url,
+				"type":     mimeType,
+				"size":     len(contents[i]),
+				"markdown": uploadMarkdown(fileHeader.Filename, url, mimeType),
+			}
+			log.Printf("Upload : %s for %s (%d bytes)\n", keys[i], page.Name, len(contents[i]))
+		}
+
+		sendPayload(w, "", payload)
+	}
+}
+
+// serveUpload serves '/u/<key>'. An upload never changes once it has a key, so it can be cached for as long as anyone
+// likes. Anything which isn't an image is downloaded rather than shown, so it can't run in our origin.
+func serveUpload(uploads UploadStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/u/")
+		if !uploadKeyRegexp.MatchString(key) {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, errGet := uploads.GetUpload(key)
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			http.Error(w, "Internal Error. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+		if data == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", uploadType(key))
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", `"`+strings.TrimSuffix(key, filepath.Ext(key))+`"`)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if !strings.HasPrefix(uploadType(key), "image/") {
+			w.Header().Set("Content-Disposition", `attachment; filename="`+key+`"`)
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	}
+}
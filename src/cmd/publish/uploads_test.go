@@ -0,0 +1,235 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testUpload struct {
+	filename string
+	data     []byte
+}
+
+// testPng is enough of a PNG for http.DetectContentType, followed by `n` more bytes.
+func testPng(n int) []byte {
+	return append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{'x'}, n)...)
+}
+
+// callUpload posts the files to /api/uploads for the page with this secret.
+func callUpload(t *testing.T, store PageStore, uploads UploadStore, secret string, files ...testUpload) testResponse {
+	body := bytes.Buffer{}
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("id", secret)
+	for _, file := range files {
+		fw, err := mw.CreateFormFile("file", file.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(file.data)
+	}
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/uploads", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	apiUpload(store, uploads)(w, r)
+
+	// the payload is a list, which testResponse can't hold
+	resp := struct {
+		testResponse
+		Payload []map[string]interface{} `json:"payload"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if len(resp.Payload) > 0 {
+		resp.testResponse.Payload = resp.Payload[0]
+	}
+	return resp.testResponse
+}
+
+// testUploadStore is where the server would keep uploads for this store: in it if it can, otherwise in a directory.
+func testUploadStore(t *testing.T, store PageStore) UploadStore {
+	if uploads, ok := store.(UploadStore); ok {
+		return uploads
+	}
+	uploads, err := NewDirUploadStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uploads
+}
+
+func TestApiUpload(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		uploads := testUploadStore(t, store)
+
+		secret := putTestPage(t, store, "Photos").Payload["id"].(string)
+		png := testPng(100)
+
+		resp := callUpload(t, store, uploads, secret, testUpload{"holiday.png", png})
+		if !resp.Ok {
+			t.Fatalf("upload failed: %s", resp.Msg)
+		}
+		key := uploadKey(png)
+		if resp.Payload["url"] != baseUrl+"/u/"+key || resp.Payload["markdown"] != "![holiday]("+baseUrl+"/u/"+key+")" {
+			t.Fatalf("unexpected payload %v", resp.Payload)
+		}
+
+		w := httptest.NewRecorder()
+		serveUpload(uploads)(w, httptest.NewRequest("GET", "/u/"+key, nil))
+		if served, _ := ioutil.ReadAll(w.Body); w.Code != 200 || !bytes.Equal(served, png) {
+			t.Fatalf("serving the upload: %d", w.Code)
+		}
+		if w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Content-Disposition") != "" {
+			t.Fatalf("unexpected type %q (%q)", w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition"))
+		}
+	})
+}
+
+func TestServeUploadDownloadsPdfs(t *testing.T) {
+	uploads, err := NewDirUploadStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdf := []byte("%PDF-1.4\n<script>alert(1)</script>")
+	key := uploadKey(pdf)
+	if err := uploads.PutUpload(key, pdf, "notes-aaaaaaaa"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	serveUpload(uploads)(w, httptest.NewRequest("GET", "/u/"+key, nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatalf("serving the upload: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Content-Disposition") != `attachment; filename="`+key+`"` || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("expected it to be downloaded, got %v", w.Header())
+	}
+}
+
+func TestReaperDeletesUploadsOfDeletedPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		uploads := testUploadStore(t, store)
+		rp := newReaper(store, uploads)
+
+		first := putTestPage(t, store, "First").Payload
+		second := putTestPage(t, store, "Second").Payload
+		own, shared := testPng(1), testPng(2)
+		if resp := callUpload(t, store, uploads, first["id"].(string), testUpload{"own.png", own}, testUpload{"shared.png", shared}); !resp.Ok {
+			t.Fatalf("upload failed: %s", resp.Msg)
+		}
+		if resp := callUpload(t, store, uploads, second["id"].(string), testUpload{"shared.png", shared}); !resp.Ok {
+			t.Fatalf("upload failed: %s", resp.Msg)
+		}
+
+		deleteAndCount := func(name string, expected int) {
+			t.Helper()
+			if err := store.DeletePage(name, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			count, err := rp.DeleteUploads()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != expected {
+				t.Fatalf("expected %d uploads to be deleted, got %d", expected, count)
+			}
+		}
+		exists := func(data []byte) bool {
+			t.Helper()
+			got, err := uploads.GetUpload(uploadKey(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got != nil
+		}
+
+		// nothing has been deleted yet
+		if count, err := rp.DeleteUploads(); err != nil || count != 0 {
+			t.Fatalf("expected no uploads to be deleted, got %d (%v)", count, err)
+		}
+
+		// the shared one is still in the second page
+		deleteAndCount(first["name"].(string), 1)
+		if exists(own) || !exists(shared) {
+			t.Fatalf("expected only the first page's own upload to be deleted")
+		}
+
+		deleteAndCount(second["name"].(string), 1)
+		if exists(shared) {
+			t.Fatalf("expected the shared upload to be deleted with the last page it was in")
+		}
+
+		pages, err := uploads.UploadPages()
+		if err != nil || len(pages) != 0 {
+			t.Fatalf("expected no pages with uploads, got %v (%v)", pages, err)
+		}
+	})
+}
+
+func TestApiUploadLimits(t *testing.T) {
+	store := NewMemoryStore()
+	uploads, err := NewDirUploadStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := putTestPage(t, store, "Photos").Payload["id"].(string)
+	good := testUpload{"good.png", testPng(10)}
+	svg := testUpload{"logo.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`)}
+
+	tooMany := []testUpload{}
+	for i := 0; i <= maxUploadFiles; i++ {
+		tooMany = append(tooMany, testUpload{"many.png", testPng(i)})
+	}
+
+	tests := []struct {
+		secret string
+		files  []testUpload
+		msg    string
+	}{
+		{"wrong", []testUpload{good}, "This page Id does not exist."},
+		{secret, nil, "Choose a file to upload."},
+		{secret, tooMany, "Upload at most 10 files at once."},
+		{secret, []testUpload{good, {"big.png", testPng(maxUploadSize)}}, "'big.png' is bigger than 5 MB."},
+		{secret, []testUpload{good, {"notes.txt", []byte("just some text")}}, "'notes.txt' is not a PNG"},
+		{secret, []testUpload{good, svg}, "'logo.svg' is not a PNG"},
+	}
+
+	for _, test := range tests {
+		resp := callUpload(t, store, uploads, test.secret, test.files...)
+		if resp.Ok || !strings.HasPrefix(resp.Msg, test.msg) {
+			t.Errorf("expected %q, got %+v", test.msg, resp)
+		}
+	}
+
+	// every file is checked before any are kept, so the good one never was
+	if data, err := uploads.GetUpload(uploadKey(good.data)); err != nil || data != nil {
+		t.Fatalf("a file from a failed upload was kept (%v)", err)
+	}
+}
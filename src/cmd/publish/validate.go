@@ -0,0 +1,174 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Machiel/slugify"
+)
+
+const maxTitleLength = 200      // characters
+const maxAuthorLength = 100     // characters
+const maxWebsiteLength = 2000   // bytes
+const maxContentLength = 256000 // bytes
+
+// maxRequestSize is the most we'll read of a request to save a page, which is the content plus room for the rest. Each
+// byte of the content can take up to 6 once it is escaped in the JSON, e.g. "\u0001".
+const maxRequestSize = 6*maxContentLength + 64000
+
+var ErrRequestTooLarge = errors.New("The page is too big")
+
+// what each social network allows in a handle
+var twitterHandleRegexp = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+var facebookHandleRegexp = regexp.MustCompile(`^[A-Za-z0-9.]{5,50}$`)
+var githubHandleRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,37}[A-Za-z0-9])?$`)
+var instagramHandleRegexp = regexp.MustCompile(`^[A-Za-z0-9._]{1,30}$`)
+
+// pageFields are the names of the fields an author sets, in the order the editor shows them.
+var pageFields = []string{"title", "author", "website", "twitter", "facebook", "github", "instagram", "content", "expires"}
+
+// FieldErrors says what is wrong with each field of a page, keyed by the field's name in the JSON.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	msgs := []string{}
+	for _, field := range pageFields {
+		if msg, ok := e[field]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	return strings.Join(msgs, ". ")
+}
+
+// copyAuthorFields copies just the fields an author may set from `from`, since we don't trust anything else the client
+// sends.
+func copyAuthorFields(page *Page, from Page) {
+	page.Title = from.Title
+	page.Author = from.Author
+	page.Website = from.Website
+	page.Twitter = from.Twitter
+	page.Facebook = from.Facebook
+	page.GitHub = from.GitHub
+	page.Instagram = from.Instagram
+	page.Content = from.Content
+	page.Unpublished = from.Unpublished
+	page.Expires = from.Expires
+}
+
+// validatePage tidies up the fields an author sets (e.g. trimming spaces, and the '@' people put before a handle) then
+// checks them, returning nil if they're all fine.
+func validatePage(page *Page, now time.Time) FieldErrors {
+	errs := FieldErrors{}
+
+	page.Title = strings.TrimSpace(page.Title)
+	if slugify.Slugify(page.Title) == "" {
+		errs["title"] = "Provide a title"
+	} else if utf8.RuneCountInString(page.Title) > maxTitleLength {
+		errs["title"] = fmt.Sprintf("The title must be at most %d characters", maxTitleLength)
+	}
+
+	page.Author = strings.TrimSpace(page.Author)
+	if utf8.RuneCountInString(page.Author) > maxAuthorLength {
+		errs["author"] = fmt.Sprintf("The name must be at most %d characters", maxAuthorLength)
+	}
+
+	page.Website = strings.TrimSpace(page.Website)
+	if page.Website != "" && !validWebsite(page.Website) {
+		errs["website"] = "The website must be a full address starting with http:// or https://"
+	}
+
+	page.Twitter = trimHandle(page.Twitter)
+	if page.Twitter != "" && !twitterHandleRegexp.MatchString(page.Twitter) {
+		errs["twitter"] = "A Twitter handle is up to 15 letters, digits and underscores"
+	}
+
+	page.Facebook = trimHandle(page.Facebook)
+	if page.Facebook != "" && !facebookHandleRegexp.MatchString(page.Facebook) {
+		errs["facebook"] = "A Facebook username is 5 to 50 letters, digits and dots"
+	}
+
+	page.GitHub = trimHandle(page.GitHub)
+	if page.GitHub != "" && (!githubHandleRegexp.MatchString(page.GitHub) || strings.Contains(page.GitHub, "--")) {
+		errs["github"] = "A GitHub username is up to 39 letters, digits and single hyphens, not at either end"
+	}
+
+	page.Instagram = trimHandle(page.Instagram)
+	if page.Instagram != "" && !instagramHandleRegexp.MatchString(page.Instagram) {
+		errs["instagram"] = "An Instagram handle is up to 30 letters, digits, dots and underscores"
+	}
+
+	if len(page.Content) > maxContentLength {
+		errs["content"] = fmt.Sprintf("The content must be at most %d KB", maxContentLength/1000)
+	}
+
+	if page.IsExpired(now) {
+		errs["expires"] = "The expiry time must be in the future"
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func trimHandle(handle string) string {
+	return strings.TrimPrefix(strings.TrimSpace(handle), "@")
+}
+
+// validWebsite is true for an absolute http or https URL, which is all we're willing to link to.
+func validWebsite(website string) bool {
+	if len(website) > maxWebsiteLength {
+		return false
+	}
+
+	u, err := url.Parse(website)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// decodePageRequest reads a JSON request body of up to maxRequestSize into `v`, returning ErrRequestTooLarge if there's
+// more.
+func decodePageRequest(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+
+	raw, errRead := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if errRead != nil {
+		return errRead
+	}
+	if len(raw) > maxRequestSize {
+		return ErrRequestTooLarge
+	}
+
+	return json.Unmarshal(raw, v)
+}
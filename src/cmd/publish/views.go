@@ -0,0 +1,246 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a reader viewing the same page again within this long only counts once
+const viewWindow = 30 * time.Minute
+
+// how often the counts are written to the store
+const viewFlushInterval = 10 * time.Second
+
+// we stop remembering new readers past this many, rather than use up all the memory
+const maxSeenViews = 100000
+
+// anything which looks like it isn't a person reading the page
+var botUserAgent = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|archiver|preview|fetch|monitor|headless|curl|wget|python|go-http-client|java/|okhttp|facebookexternalhit`)
+
+// trustedProxies is how many proxies we are behind, each of which adds the address it was connected from to
+// X-Forwarded-For. It comes from TRUST_PROXY.
+var trustedProxies int
+
+// ViewStore is implemented by stores which can count how many times each page has been viewed. AddViews adds all of the
+// counts in one transaction, dropping those for pages which are missing or have been deleted.
+type ViewStore interface {
+	AddViews(counts map[string]int64) error
+	GetViews(name string) (int64, error)
+}
+
+// viewCounter adds up views in memory and writes them to the store every so often, so that serving a page never waits
+// for a write transaction.
+type viewCounter struct {
+	store ViewStore
+	now   func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]int64     // name -> views not yet written
+	seen    map[string]time.Time // reader and name -> when they were last counted
+}
+
+func newViewCounter(store ViewStore) *viewCounter {
+	return &viewCounter{
+		store:   store,
+		now:     clock,
+		pending: make(map[string]int64),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// parseTrustProxy reads TRUST_PROXY, which is how many proxies we are behind. Anything else which isn't empty means
+// one, as it always has.
+func parseTrustProxy(s string) int {
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 1
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// clientIP is the address of whoever made the request. Behind proxies, it is the address the outermost one was
+// connected from, which is that many from the end of X-Forwarded-For. Anything before that came from the client, who
+// could have made it up.
+func clientIP(r *http.Request) string {
+	if trustedProxies > 0 {
+		addrs := []string{}
+		for _, fwd := range r.Header["X-Forwarded-For"] {
+			for _, addr := range strings.Split(fwd, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+		if len(addrs) >= trustedProxies {
+			if ip := net.ParseIP(addrs[len(addrs)-trustedProxies]); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func isBot(r *http.Request) bool {
+	ua := r.Header.Get("User-Agent")
+	return ua == "" || botUserAgent.MatchString(ua)
+}
+
+// Record counts a view of the page, unless it came from a bot or the same reader has viewed it recently.
+func (vc *viewCounter) Record(r *http.Request, name string) {
+	if isBot(r) {
+		return
+	}
+
+	key := clientIP(r) + "\x00" + r.Header.Get("User-Agent") + "\x00" + name
+	now := vc.now()
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if last, ok := vc.seen[key]; ok && now.Sub(last) < viewWindow {
+		return
+	}
+	if len(vc.seen) < maxSeenViews {
+		vc.seen[key] = now
+	}
+
+	vc.pending[name]++
+}
+
+// Pending is how many views of the page haven't been written yet.
+func (vc *viewCounter) Pending(name string) int64 {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	return vc.pending[name]
+}
+
+// Views is the total for the page, including those not yet written.
+func (vc *viewCounter) Views(name string) (int64, error) {
+	stored, err := vc.store.GetViews(name)
+	if err != nil {
+		return 0, err
+	}
+	return stored + vc.Pending(name), nil
+}
+
+// Flush writes the pending views to the store, keeping them for next time if that fails. It also forgets readers seen
+// longer ago than the window.
+func (vc *viewCounter) Flush() error {
+	vc.mu.Lock()
+	pending := vc.pending
+	vc.pending = make(map[string]int64)
+
+	now := vc.now()
+	for key, last := range vc.seen {
+		if now.Sub(last) >= viewWindow {
+			delete(vc.seen, key)
+		}
+	}
+	vc.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := vc.store.AddViews(pending)
+	if err != nil {
+		vc.mu.Lock()
+		for name, n := range pending {
+			vc.pending[name] += n
+		}
+		vc.mu.Unlock()
+	}
+	return err
+}
+
+// Run flushes every `interval` until `stop` is closed, then flushes one last time.
+func (vc *viewCounter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := vc.Flush(); err != nil {
+				log.Printf("Error: %v\n", err)
+			}
+		case <-stop:
+			if err := vc.Flush(); err != nil {
+				log.Printf("Error: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// apiViews is GET /api/views?id=..., which tells the author how many times their page has been viewed.
+func apiViews(store PageStore, views *viewCounter) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if views == nil {
+			sendError(w, "This server does not count views.")
+			return
+		}
+
+		page, errGet := getPageUsingSecret(store, requestSecret(w, r, r.FormValue("id")))
+		if errGet != nil {
+			log.Printf("Error: %v\n", errGet)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		if page == nil {
+			sendError(w, "This page Id does not exist.")
+			return
+		}
+
+		n, errViews := views.Views(page.Name)
+		if errViews != nil {
+			log.Printf("Error: %v\n", errViews)
+			sendError(w, "Internal Error. Please try again later.")
+			return
+		}
+
+		payload := map[string]interface{}{
+			"name":  page.Name,
+			"views": n,
+		}
+		sendPayload(w, "", payload)
+	}
+}
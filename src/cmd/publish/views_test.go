@@ -0,0 +1,298 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testBrowser = "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+
+// viewRequest is a view of a page from `addr` using this User-Agent.
+func viewRequest(addr, ua string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = addr + ":1234"
+	if ua != "" {
+		r.Header.Set("User-Agent", ua)
+	}
+	return r
+}
+
+// openViewStore is a real BoltStore with one page in it, `name`, whose secret is `secret`.
+func openViewStore(t *testing.T) (*BoltStore, string, string) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "publish.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	put := putTestPage(t, store, "Viewed")
+	return store, put.Payload["name"].(string), put.Payload["id"].(string)
+}
+
+func TestIsBot(t *testing.T) {
+	tests := []struct {
+		ua  string
+		bot bool
+	}{
+		{testBrowser, false},
+		{"", true},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", true},
+		{"Mozilla/5.0 (compatible; bingbot/2.0)", true},
+		{"Slackbot-LinkExpanding 1.0", true},
+		{"facebookexternalhit/1.1", true},
+		{"curl/8.0.1", true},
+		{"Wget/1.21", true},
+		{"python-requests/2.31", true},
+		{"Go-http-client/1.1", true},
+		{"Mozilla/5.0 HeadlessChrome/120.0", true},
+	}
+
+	for _, test := range tests {
+		if got := isBot(viewRequest("192.0.2.1", test.ua)); got != test.bot {
+			t.Errorf("%q: got %v, want %v", test.ua, got, test.bot)
+		}
+	}
+}
+
+func TestParseTrustProxy(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1", 1},
+		{"3", 3},
+		{"-1", 0},
+		// anything else means one, as TRUST_PROXY=true always has
+		{"true", 1},
+		{"yes", 1},
+	}
+
+	for _, test := range tests {
+		if got := parseTrustProxy(test.value); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	orig := trustedProxies
+	defer func() { trustedProxies = orig }()
+
+	tests := []struct {
+		proxies int
+		fwd     []string
+		want    string
+	}{
+		{0, []string{"203.0.113.9"}, "192.0.2.1"},
+		{1, nil, "192.0.2.1"},
+		{1, []string{"203.0.113.9"}, "203.0.113.9"},
+		// whatever the client sent comes before what our proxy added
+		{1, []string{"10.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{1, []string{"10.0.0.1", "203.0.113.9"}, "203.0.113.9"},
+		{2, []string{"10.0.0.1, 203.0.113.9, 198.51.100.7"}, "203.0.113.9"},
+		{3, []string{"10.0.0.1, 203.0.113.9", "198.51.100.7, 198.51.100.8"}, "203.0.113.9"},
+		{2, []string{"203.0.113.9"}, "192.0.2.1"},
+		{1, []string{"not an address"}, "192.0.2.1"},
+		{1, []string{" 2001:db8::1 "}, "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		trustedProxies = test.proxies
+		r := httptest.NewRequest("GET", "/api", nil)
+		for _, fwd := range test.fwd {
+			r.Header.Add("X-Forwarded-For", fwd)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("%d proxies, %q: got %s, want %s", test.proxies, test.fwd, got, test.want)
+		}
+	}
+}
+
+func TestViewCounterRecord(t *testing.T) {
+	now := fakeClock(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	store, name, _ := openViewStore(t)
+	views := newViewCounter(store)
+
+	tests := []struct {
+		after time.Duration // since the last view
+		addr  string
+		ua    string
+		want  int64
+	}{
+		{0, "192.0.2.1", testBrowser, 1},
+		// the same reader again is the same view
+		{time.Minute, "192.0.2.1", testBrowser, 1},
+		{viewWindow - 2*time.Minute, "192.0.2.1", testBrowser, 1},
+		// but someone else isn't, even from the same address
+		{0, "192.0.2.1", testBrowser + " Other", 2},
+		{0, "192.0.2.2", testBrowser, 3},
+		// and bots never count
+		{0, "192.0.2.3", "Googlebot/2.1", 3},
+		{0, "192.0.2.3", "", 3},
+		// once the window has passed since they were last counted, it's a new view
+		{2 * time.Minute, "192.0.2.1", testBrowser, 4},
+	}
+
+	for i, test := range tests {
+		*now = now.Add(test.after)
+		views.Record(viewRequest(test.addr, test.ua), name)
+		if got := views.Pending(name); got != test.want {
+			t.Fatalf("%d: expected %d pending views, got %d", i, test.want, got)
+		}
+	}
+
+	// flushing moves them into the store
+	if err := views.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if pending := views.Pending(name); pending != 0 {
+		t.Fatalf("expected nothing pending after flushing, got %d", pending)
+	}
+	if stored, err := store.GetViews(name); err != nil || stored != 4 {
+		t.Fatalf("expected 4 stored views, got %d (%v)", stored, err)
+	}
+	if total, err := views.Views(name); err != nil || total != 4 {
+		t.Fatalf("expected 4 views in total, got %d (%v)", total, err)
+	}
+}
+
+// failingViews is a ViewStore whose writes fail while `err` is set.
+type failingViews struct {
+	ViewStore
+	err error
+}
+
+func (f *failingViews) AddViews(counts map[string]int64) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.ViewStore.AddViews(counts)
+}
+
+func TestViewCounterFlushFails(t *testing.T) {
+	fakeClock(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	store, name, _ := openViewStore(t)
+	failing := &failingViews{ViewStore: store, err: errors.New("disk full")}
+	views := newViewCounter(failing)
+
+	views.Record(viewRequest("192.0.2.1", testBrowser), name)
+	views.Record(viewRequest("192.0.2.2", testBrowser), name)
+	if err := views.Flush(); err != failing.err {
+		t.Fatalf("expected the store's error, got %v", err)
+	}
+
+	// the views are kept for next time, along with any which came in since
+	if pending := views.Pending(name); pending != 2 {
+		t.Fatalf("expected 2 views to be put back, got %d", pending)
+	}
+	views.Record(viewRequest("192.0.2.3", testBrowser), name)
+
+	failing.err = nil
+	if err := views.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := store.GetViews(name); err != nil || stored != 3 {
+		t.Fatalf("expected 3 stored views, got %d (%v)", stored, err)
+	}
+}
+
+func TestAddViewsSkipsDeletedPages(t *testing.T) {
+	withEachStore(t, func(t *testing.T, store PageStore) {
+		viewStore, ok := store.(ViewStore)
+		if !ok {
+			t.Skip("this store doesn't count views")
+		}
+		for _, name := range []string{"live-aaaaaaaa", "deleted-aaaaaaaa"} {
+			if err := store.CreatePage(testPage(name, "secret-"+name, "Viewed")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := store.DeletePage("deleted-aaaaaaaa", time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		// as if the views were pending when the page was deleted
+		counts := map[string]int64{"live-aaaaaaaa": 2, "deleted-aaaaaaaa": 3, "missing-aaaaaaaa": 4}
+		if err := viewStore.AddViews(counts); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, want := range map[string]int64{"live-aaaaaaaa": 2, "deleted-aaaaaaaa": 0, "missing-aaaaaaaa": 0} {
+			if got, err := viewStore.GetViews(name); err != nil || got != want {
+				t.Errorf("%s: expected %d views, got %d (%v)", name, want, got, err)
+			}
+		}
+	})
+}
+
+func TestApiViews(t *testing.T) {
+	fakeClock(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+	store, name, secret := openViewStore(t)
+	views := newViewCounter(store)
+	views.Record(viewRequest("192.0.2.1", testBrowser), name)
+
+	tests := []struct {
+		views  *viewCounter
+		query  string
+		bearer string
+		msg    string
+	}{
+		{views, "", "", "This page Id does not exist."},
+		{views, "?id=wrong", "", "This page Id does not exist."},
+		{views, "", "wrong", "This page Id does not exist."},
+		// knowing the page's name isn't enough
+		{views, "?id=" + name, "", "This page Id does not exist."},
+		{views, "?id=" + secret, "", ""},
+		{views, "", secret, ""},
+		{nil, "", secret, "This server does not count views."},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/views"+test.query, nil)
+		if test.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		apiViews(store, test.views)(w, r)
+
+		resp := testResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decoding %q: %v", w.Body.String(), err)
+		}
+		if test.msg != "" {
+			if resp.Ok || resp.Msg != test.msg || resp.Payload != nil {
+				t.Errorf("%q %q: expected %q, got %s", test.query, test.bearer, test.msg, w.Body.String())
+			}
+			continue
+		}
+		if !resp.Ok || resp.Payload["name"] != name || resp.Payload["views"] != float64(1) {
+			t.Errorf("%q %q: unexpected response %s", test.query, test.bearer, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+// Package publishli is a client for the /api/v1 API of a publish.li server, so that Go programs can publish and edit
+// pages without building the JSON by hand. The server describes the same API at /api/v1/openapi.json.
+package publishli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The codes an Error can have.
+const (
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidPage      = "invalid_page"
+	CodeTooLarge         = "request_too_large"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeGone             = "gone"
+	CodeVersionConflict  = "version_conflict"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeRateLimited      = "rate_limited"
+	CodeInternal         = "internal_error"
+)
+
+// PageInput is everything about a page which its author chooses. Only the Title is required.
+type PageInput struct {
+	Title       string     `json:"title"`
+	Author      string     `json:"author"`
+	Website     string     `json:"website"`
+	Twitter     string     `json:"twitter"`
+	Facebook    string     `json:"facebook"`
+	GitHub      string     `json:"github"`
+	Instagram   string     `json:"instagram"`
+	Content     string     `json:"content"` // Markdown
+	Unpublished bool       `json:"unpublished"`
+	Expires     *time.Time `json:"expires,omitempty"` // nil to keep the page forever
+}
+
+// Page is a page as the server returns it.
+type Page struct {
+	Name        string     `json:"name"`
+	Secret      string     `json:"secret"` // only set by Create, and needed to Fetch, Update or Delete the page
+	Title       string     `json:"title"`
+	Author      string     `json:"author"`
+	Website     string     `json:"website"`
+	Twitter     string     `json:"twitter"`
+	Facebook    string     `json:"facebook"`
+	GitHub      string     `json:"github"`
+	Instagram   string     `json:"instagram"`
+	Content     string     `json:"content"`
+	Html        string     `json:"html"`
+	Unpublished bool       `json:"unpublished"`
+	Quarantined bool       `json:"quarantined"` // looked like spam, so only its author can see it until it is checked
+	Version     int64      `json:"version"`     // goes up by one each time the page is saved
+	Inserted    time.Time  `json:"inserted"`
+	Updated     time.Time  `json:"updated"`
+	Expires     *time.Time `json:"expires"`
+	Url         string     `json:"url"` // where the page can be read
+}
+
+// Input returns the fields of the page which can be changed, ready to Update it with.
+func (p *Page) Input() PageInput {
+	return PageInput{
+		Title:       p.Title,
+		Author:      p.Author,
+		Website:     p.Website,
+		Twitter:     p.Twitter,
+		Facebook:    p.Facebook,
+		GitHub:      p.GitHub,
+		Instagram:   p.Instagram,
+		Content:     p.Content,
+		Unpublished: p.Unpublished,
+		Expires:     p.Expires,
+	}
+}
+
+// Error is returned whenever the server doesn't answer with a success. Code is one of the Code constants, or "" if the
+// response didn't come from publish.li itself (e.g. a proxy in front of it). With CodeVersionConflict, Page is the page
+// as it is now, and with CodeInvalidPage, Fields says what is wrong with each field (keyed by its name in the JSON).
+// With CodeRateLimited, RetryAfter is how long to wait before trying again.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Page       *Page
+	Fields     map[string]string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("publishli: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("publishli: %s (%s)", e.Message, e.Code)
+}
+
+// ErrorCode returns the Code of `err` if it is an *Error, or "".
+func ErrorCode(err error) string {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// Client talks to one publish.li server.
+type Client struct {
+	BaseURL    string // e.g. "https://publish.li"
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the server at `baseURL`, using http.DefaultClient.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Create publishes a new page. Keep the returned page's Secret, since it can't be retrieved again.
+func (c *Client) Create(ctx context.Context, in PageInput) (*Page, error) {
+	page := &Page{}
+	if err := c.do(ctx, "POST", "/api/v1/pages", "", in, http.StatusCreated, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Get fetches a published page.
+func (c *Client) Get(ctx context.Context, name string) (*Page, error) {
+	return c.Fetch(ctx, name, "")
+}
+
+// Fetch is like Get, but also returns the page when it is unpublished if `secret` is the page's secret.
+func (c *Client) Fetch(ctx context.Context, name, secret string) (*Page, error) {
+	page := &Page{}
+	if err := c.do(ctx, "GET", pagePath(name), secret, nil, http.StatusOK, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Update replaces the page's fields with `in`. The `version` is the one the changes were made to, and if the page has
+// been saved since then the error has CodeVersionConflict along with the page as it is now.
+func (c *Client) Update(ctx context.Context, name, secret string, version int64, in PageInput) (*Page, error) {
+	body := struct {
+		PageInput
+		Version int64 `json:"version"`
+	}{in, version}
+
+	page := &Page{}
+	if err := c.do(ctx, "PUT", pagePath(name), secret, body, http.StatusOK, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Delete deletes the page, after which Get returns an error with CodeGone.
+func (c *Client) Delete(ctx context.Context, name, secret string) error {
+	return c.do(ctx, "DELETE", pagePath(name), secret, nil, http.StatusNoContent, nil)
+}
+
+func pagePath(name string) string {
+	return "/api/v1/pages/" + url.PathEscape(name)
+}
+
+// do sends `body` (if not nil) as JSON along with `secret` (if set) as a bearer token, and decodes the response into
+// `out` (if not nil) when it has the status `want`. Anything else becomes an *Error.
+func (c *Client) do(ctx context.Context, method, path, secret string, body interface{}, want int, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(raw)
+	}
+
+	req, errReq := http.NewRequest(method, c.BaseURL+path, reqBody)
+	if errReq != nil {
+		return errReq
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, errDo := httpClient.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != want {
+		return decodeError(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// decodeError reads the error envelope from the response, falling back to its status if there isn't one.
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    http.StatusText(resp.StatusCode),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	raw, errRead := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if errRead != nil {
+		return apiErr
+	}
+
+	envelope := struct {
+		Error *struct {
+			Code    string            `json:"code"`
+			Message string            `json:"message"`
+			Page    *Page             `json:"page"`
+			Fields  map[string]string `json:"fields"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(raw, &envelope); err != nil || envelope.Error == nil || envelope.Error.Code == "" {
+		return apiErr
+	}
+
+	apiErr.Code = envelope.Error.Code
+	apiErr.Message = envelope.Error.Message
+	apiErr.Page = envelope.Error.Page
+	apiErr.Fields = envelope.Error.Fields
+	return apiErr
+}
@@ -0,0 +1,146 @@
+// --------------------------------------------------------------------------------------------------------------------
+//
+// This file is part of https://github.com/appsattic/publish.li
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// --------------------------------------------------------------------------------------------------------------------
+
+package publishli
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeServer answers every request with `status` and `body`, remembering the request it was sent.
+func fakeServer(t *testing.T, status int, body string) (*Client, *http.Request, *[]byte) {
+	t.Helper()
+
+	var got http.Request
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = *r
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return NewClient(server.URL + "/"), &got, &gotBody
+}
+
+func TestCreate(t *testing.T) {
+	client, req, reqBody := fakeServer(t, http.StatusCreated, `{"name":"hello-abcdefgh","secret":"s3cret","title":"Hello","version":1}`)
+
+	page, err := client.Create(context.Background(), PageInput{Title: "Hello", Content: "World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Name != "hello-abcdefgh" || page.Secret != "s3cret" || page.Version != 1 {
+		t.Fatalf("unexpected page: %#v", page)
+	}
+
+	if req.Method != "POST" || req.URL.Path != "/api/v1/pages" {
+		t.Fatalf("unexpected request: %s %s", req.Method, req.URL.Path)
+	}
+	sent := map[string]interface{}{}
+	if err := json.Unmarshal(*reqBody, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent["title"] != "Hello" || sent["content"] != "World" {
+		t.Fatalf("unexpected body: %s", *reqBody)
+	}
+	if _, ok := sent["expires"]; ok {
+		t.Fatalf("expires should be left out: %s", *reqBody)
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	client, req, reqBody := fakeServer(t, http.StatusConflict, `{"error":{"code":"version_conflict","message":"Changed","page":{"name":"hello-abcdefgh","version":3}}}`)
+
+	_, err := client.Update(context.Background(), "hello-abcdefgh", "s3cret", 2, PageInput{Title: "Hi"})
+	if ErrorCode(err) != CodeVersionConflict {
+		t.Fatalf("expected a version conflict, got %v", err)
+	}
+	apiErr := err.(*Error)
+	if apiErr.StatusCode != http.StatusConflict || apiErr.Page == nil || apiErr.Page.Version != 3 {
+		t.Fatalf("unexpected error: %#v", apiErr)
+	}
+
+	if req.Method != "PUT" || req.URL.Path != "/api/v1/pages/hello-abcdefgh" {
+		t.Fatalf("unexpected request: %s %s", req.Method, req.URL.Path)
+	}
+	sent := map[string]interface{}{}
+	if err := json.Unmarshal(*reqBody, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent["version"] != 2.0 || sent["title"] != "Hi" {
+		t.Fatalf("unexpected body: %s", *reqBody)
+	}
+	if _, ok := sent["secret"]; ok {
+		t.Fatalf("the secret should not be in the body: %s", *reqBody)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Fatalf("unexpected Authorization header: %q", auth)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	client, req, _ := fakeServer(t, http.StatusNoContent, "")
+
+	if err := client.Delete(context.Background(), "hello-abcdefgh", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "DELETE" || req.URL.Path != "/api/v1/pages/hello-abcdefgh" {
+		t.Fatalf("unexpected request: %s %s", req.Method, req.URL.Path)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer s3cret" {
+		t.Fatalf("unexpected Authorization header: %q", auth)
+	}
+}
+
+func TestErrorWithoutEnvelope(t *testing.T) {
+	client, _, _ := fakeServer(t, http.StatusBadGateway, `<html>Bad Gateway</html>`)
+
+	_, err := client.Get(context.Background(), "hello-abcdefgh")
+	apiErr, ok := err.(*Error)
+	if !ok || apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "90")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":{"code":"rate_limited","message":"Too many requests."}}`))
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL).Create(context.Background(), PageInput{Title: "Hello"})
+	if ErrorCode(err) != CodeRateLimited {
+		t.Fatalf("expected to be rate limited, got %v", err)
+	}
+	if wait := err.(*Error).RetryAfter; wait != 90*time.Second {
+		t.Fatalf("unexpected RetryAfter: %v", wait)
+	}
+}
@@ -1,9 +1,10 @@
 // --------------------------------------------------------------------------------------------------------------------
 
-function ajax(method, url, data, callback) {
-  if ( method !== 'get' && method !== 'post' && method !== 'put' ) {
+// ajax sends the request, with the page's secret (if given) in the Authorization header so that it stays out of URLs
+function ajax(method, url, data, callback, secret) {
+  if ( method !== 'get' && method !== 'post' && method !== 'put' && method !== 'delete' ) {
     setTimeout(function() {
-      callback(new Error("Method should be get, post, or put"))
+      callback(new Error("Method should be get, post, put, or delete"))
     }, 0)
   }
 
@@ -12,7 +13,13 @@ function ajax(method, url, data, callback) {
     url : url,
   }
 
-  if ( method === 'get' ) {
+  if ( secret ) {
+    request.headers = {
+      Authorization : 'Bearer ' + secret,
+    }
+  }
+
+  if ( method === 'get' || method === 'delete' ) {
     request.params = data
   }
   else {
@@ -28,7 +35,8 @@ function ajax(method, url, data, callback) {
       console.log('data:', data)
 
       if ( !data.ok ) {
-        return callback(data.msg)
+        // the payload, if any, says what was wrong with each field
+        return callback(data.msg, data.payload)
       }
 
       console.log('data.payload:', data.payload)
@@ -38,10 +46,34 @@ function ajax(method, url, data, callback) {
     })
     .catch(function (err) {
       console.warn(err)
+
+      // a conflict still tells us why, along with the current page
+      if ( err.response && err.response.status === 409 ) {
+        return callback(err.response.data.msg, err.response.data.payload)
+      }
+
+      // as does being asked to slow down
+      if ( err.response && err.response.status === 429 ) {
+        return callback(err.response.data.msg)
+      }
+
       callback('Server Error: ' + err)
     })
 }
 
+// localTime turns a time from the server into what a datetime-local input wants, or '' if it isn't set
+function localTime(iso) {
+  var d = new Date(iso)
+  if ( !iso || isNaN(d) || d.getFullYear() <= 1 ) {
+    return ''
+  }
+
+  function pad(n) {
+    return n < 10 ? '0' + n : '' + n
+  }
+  return d.getFullYear() + '-' + pad(d.getMonth() + 1) + '-' + pad(d.getDate()) + 'T' + pad(d.getHours()) + ':' + pad(d.getMinutes())
+}
+
 var app = new Vue({
   el   : '#app',
   data : {
@@ -61,6 +93,14 @@ var app = new Vue({
     facebook   : '',
     github     : '',
     instagram  : '',
+    unpublished : false,
+    version    : 0,
+    conflict   : null,
+    views      : null,
+    expires    : '',
+    fieldErrors : {},
+    quarantined : false,
+    email      : '',
   },
   watch: {
     state : function(newState, oldState) {
@@ -101,6 +141,13 @@ var app = new Vue({
       app.github = ''
       app.instagram = ''
       app.content = ''
+      app.unpublished = false
+      app.version = 0
+      app.conflict = null
+      app.views = null
+      app.expires = ''
+      app.fieldErrors = {}
+      app.quarantined = false
       app.err = null
       app.state = 'editing'
     },
@@ -111,10 +158,7 @@ var app = new Vue({
       app.state = 'loading'
       app.err   = null
 
-      var data = {
-        id : app.idLocal,
-      }
-      ajax('get', '/api', data, function(err, payload) {
+      ajax('get', '/api', {}, function(err, payload) {
         // whether there is an error or not, set back to editing
         app.state = 'editing'
 
@@ -125,19 +169,102 @@ var app = new Vue({
         }
 
         // all good, copy the data from the payload
-        app.id        = payload.id
-        app.idLocal   = payload.id
-        app.name      = payload.name
-        app.title     = payload.title
-        app.author    = payload.author
-        app.website   = payload.website
-        app.twitter   = payload.twitter
-        app.facebook  = payload.facebook
-        app.github    = payload.github
-        app.instagram = payload.instagram
-        app.content   = payload.content
-        app.err       = null
-      })
+        app.copyPage(payload)
+        app.onLoadViews()
+      }, app.idLocal)
+    },
+    onLoadViews : function() {
+      ajax('get', '/api/views', {}, function(err, payload) {
+        // not knowing how many views there have been isn't worth an error
+        if (err) {
+          console.warn(err)
+          return
+        }
+        app.views = payload.views
+      }, app.id)
+    },
+    copyPage : function(payload) {
+      app.id        = payload.id
+      app.idLocal   = payload.id
+      app.name      = payload.name
+      app.title     = payload.title
+      app.author    = payload.author
+      app.website   = payload.website
+      app.twitter   = payload.twitter
+      app.facebook  = payload.facebook
+      app.github    = payload.github
+      app.instagram = payload.instagram
+      app.content   = payload.content
+      app.unpublished = payload.unpublished
+      app.version   = payload.version
+      app.expires   = localTime(payload.expires)
+      app.quarantined = payload.quarantined
+      app.conflict  = null
+      app.fieldErrors = {}
+      app.err       = null
+    },
+    onTakeTheirs : function() {
+      // throw away our changes and carry on from theirs
+      app.copyPage(app.conflict)
+    },
+    onKeepMine : function() {
+      // save our changes over theirs, now that we've seen them
+      app.version = app.conflict.version
+      app.conflict = null
+      app.onSave()
+    },
+    onDelete : function() {
+      if ( !confirm('Delete this page? This can not be undone.') ) {
+        return
+      }
+
+      app.state = 'loading'
+      app.err   = null
+
+      ajax('delete', '/api', {}, function(err, payload) {
+        // whether there is an error or not, set back to editing
+        app.state = 'editing'
+
+        if (err) {
+          // stringify either an Error or a string
+          app.err = err
+          return
+        }
+
+        // all gone, so start afresh
+        app.onNew()
+      }, app.id)
+    },
+    onUpload : function(ev) {
+      var files = ev.target.files
+      if ( !files.length ) {
+        return
+      }
+
+      var form = new FormData()
+      for ( var i = 0; i < files.length; i++ ) {
+        form.append('file', files[i])
+      }
+
+      app.state = 'loading'
+      app.err   = null
+
+      ajax('post', '/api/uploads', form, function(err, payload) {
+        // whether there is an error or not, set back to editing
+        app.state = 'editing'
+        ev.target.value = ''
+
+        if (err) {
+          // stringify either an Error or a string
+          app.err = err
+          return
+        }
+
+        // embed each one, which is saved when the page is next published
+        payload.forEach(function(upload) {
+          app.content += '\n\n' + upload.markdown + '\n'
+        })
+      }, app.id)
     },
     onSave : function() {
       var method
@@ -150,13 +277,17 @@ var app = new Vue({
         github    : app.github,
         instagram : app.instagram,
         content   : app.content,
+        expires   : app.expires ? new Date(app.expires).toISOString() : null,
+        // the hidden field which only bots fill in
+        email     : app.email,
       }
 
       if ( app.name ) {
         // update
         method = 'post'
-        data.id = app.id
         data.name = app.name
+        data.unpublished = app.unpublished
+        data.version = app.version
       }
       else {
         // create
@@ -166,6 +297,7 @@ var app = new Vue({
       // set to loading
       app.state = 'loading'
       app.err   = null
+      app.fieldErrors = {}
 
       ajax(method, '/api', data, function(err, payload) {
         // whether there is an error or not, set back to editing
@@ -174,6 +306,20 @@ var app = new Vue({
         if (err) {
           // stringify either an Error or a string
           app.err = err
+
+          // show what is wrong next to each field
+          if ( payload && payload.fields ) {
+            app.fieldErrors = payload.fields
+            if ( payload.fields.twitter || payload.fields.facebook || payload.fields.github || payload.fields.instagram ) {
+              app.showSocial = true
+            }
+            return
+          }
+
+          // someone else has saved since we loaded it, so let the user choose what to keep
+          if ( payload ) {
+            app.conflict = payload
+          }
           return
         }
 
@@ -181,7 +327,10 @@ var app = new Vue({
         app.id = payload.id
         app.idLocal = payload.id
         app.name = payload.name
-      })
+        app.version = payload.version
+        app.quarantined = payload.quarantined
+        app.conflict = null
+      }, app.id)
 
     },
   },